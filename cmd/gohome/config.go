@@ -3,46 +3,157 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"os/user"
+	"path/filepath"
 	"strings"
 
-	"github.com/barnybug/gohome/pubsub"
+	gohomeconfig "github.com/barnybug/gohome/config"
 	"github.com/barnybug/gohome/services"
 )
 
 var NL = []byte{'\n'}
 
-func config(path string, filenames []string) {
-	if path != "config" && !strings.HasPrefix(path, "config/") {
-		fmt.Println("Path must begin with 'config'")
-		return
-	}
+// span of lines of a file in concatenated config
+type span struct {
+	filename string
+	start    int
+	lines    int
+}
 
-	// concatenate files together
+// concatenate files together, optionally resolving any !include relative to
+// each file.
+func readConfig(filenames []string, includes bool) (*bytes.Buffer, []span, error) {
 	data := &bytes.Buffer{}
+	var spans []span
 	for _, filename := range filenames {
-		f, err := os.Open(filename)
+		b, err := ioutil.ReadFile(filename)
 		if err != nil {
-			fmt.Printf("Error opening %s: %s\n", filename, err)
-			return
+			return nil, nil, fmt.Errorf("Error reading %s: %s", filename, err)
 		}
-		defer f.Close()
-		_, err = io.Copy(data, f)
-		if err != nil {
-			fmt.Printf("Error reading %s: %s\n", filename, err)
-			return
+		if includes {
+			r := &gohomeconfig.Resolver{Dir: filepath.Dir(filename), IncludesOnly: true}
+			b, err = r.Resolve(b)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Error resolving %s: %s", filename, err)
+			}
 		}
+		start := bytes.Count(data.Bytes(), NL)
+		data.Write(b)
 		if !bytes.HasSuffix(data.Bytes(), NL) {
 			data.WriteByte('\n')
 		}
+		spans = append(spans, span{filename, start, bytes.Count(data.Bytes(), NL) - start})
+	}
+	return data, spans, nil
+}
+
+// printProblems prints problems located by file and line, returning true if
+// any are errors.
+func printProblems(problems gohomeconfig.Problems, spans []span) bool {
+	for _, p := range problems {
+		filename, line := spans[0].filename, p.Line
+		for _, s := range spans {
+			if p.Line > s.start && p.Line <= s.start+s.lines {
+				filename, line = s.filename, p.Line-s.start
+			}
+		}
+		p.Line = 0
+		fmt.Printf("%s:%d: %s\n", filename, line, p)
+	}
+	return problems.Err() != nil
+}
+
+// check resolves secrets and environment leniently, as they're resolved by
+// services on their own hosts.
+func check(data []byte) gohomeconfig.Problems {
+	r := *gohomeconfig.DefaultResolver
+	r.Lenient = true
+	_, problems := r.Check(data)
+	return problems
+}
+
+// check config files, exiting with failure if invalid
+func configCheck(filenames []string) {
+	if len(filenames) == 0 {
+		usage()
+		os.Exit(1)
+	}
+	data, spans, err := readConfig(filenames, true)
+	if err != nil {
+		fmtFatalf("%s\n", err)
+	}
+	if printProblems(check(data.Bytes()), spans) {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", strings.Join(filenames, ", "))
+}
+
+// author of config changes, as user@host
+func author() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+func validPath(path string) bool {
+	if path != "config" && !strings.HasPrefix(path, "config/") {
+		fmt.Println("Path must begin with 'config'")
+		return false
+	}
+	return true
+}
+
+// configDryRun shows what updating path would do, without publishing. Automata
+// are compiled by the running automata service, which reports the changes.
+func configDryRun(path string, filenames []string) {
+	if !validPath(path) {
+		return
+	}
+	data, spans, err := readConfig(filenames, path == "config")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	switch path {
+	case "config":
+		if !printProblems(check(data.Bytes()), spans) {
+			fmt.Printf("%s: OK\n", strings.Join(filenames, ", "))
+		}
+	case "config/automata":
+		queryBody("automata/validate", data.String(), url.Values{"responses": {"1"}})
+	default:
+		fmt.Printf("Would update %s (%d bytes)\n", path, data.Len())
+	}
+}
+
+func config(path string, filenames []string) {
+	if !validPath(path) {
+		return
+	}
+
+	// includes are resolved before publishing, secrets and environment
+	// variables by services
+	data, spans, err := readConfig(filenames, path == "config")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if path == "config" {
+		// refuse to publish config services would reject
+		if printProblems(check(data.Bytes()), spans) {
+			fmt.Println("Config invalid, not updated")
+			return
+		}
 	}
 
-	// emit event
-	ev := pubsub.NewRawEvent(path, data.Bytes())
-	ev.SetRetained(true) // config messages are retained
 	services.SetupBroker("cmd")
-	services.Publisher.Emit(ev)
+	services.SendConfig(path, data.Bytes(), author(), "cmd")
 	fmt.Printf("Updated %s (%d bytes)\n", path, data.Len())
 	services.Shutdown()
 }
@@ -21,12 +21,15 @@ import (
 	"github.com/barnybug/gohome/services/currentcost"
 	"github.com/barnybug/gohome/services/datalogger"
 	"github.com/barnybug/gohome/services/energenie"
+	"github.com/barnybug/gohome/services/energy"
 	"github.com/barnybug/gohome/services/espeaker"
 	"github.com/barnybug/gohome/services/esphome"
 	"github.com/barnybug/gohome/services/frigate"
 	"github.com/barnybug/gohome/services/googlehome"
 	"github.com/barnybug/gohome/services/graphite"
 	"github.com/barnybug/gohome/services/heating"
+	"github.com/barnybug/gohome/services/history"
+	"github.com/barnybug/gohome/services/homeassistant"
 	"github.com/barnybug/gohome/services/hwmon"
 	"github.com/barnybug/gohome/services/irrigation"
 	"github.com/barnybug/gohome/services/jabber"
@@ -49,6 +52,7 @@ import (
 	"github.com/barnybug/gohome/services/systemd"
 	"github.com/barnybug/gohome/services/tasmota"
 	"github.com/barnybug/gohome/services/telegram"
+	"github.com/barnybug/gohome/services/tracker"
 	"github.com/barnybug/gohome/services/twitter"
 	"github.com/barnybug/gohome/services/ups"
 	"github.com/barnybug/gohome/services/watchdog"
@@ -77,12 +81,15 @@ func registerServices() {
 	services.Register(&currentcost.Service{})
 	services.Register(&datalogger.Service{})
 	services.Register(&energenie.Service{})
+	services.Register(&energy.Service{})
 	services.Register(&espeaker.Service{})
 	services.Register(&esphome.Service{})
 	services.Register(&frigate.Service{})
 	services.Register(&googlehome.Service{})
 	services.Register(&graphite.Service{})
 	services.Register(&heating.Service{})
+	services.Register(&history.Service{})
+	services.Register(&homeassistant.Service{})
 	services.Register(&hwmon.Service{})
 	services.Register(&irrigation.Service{})
 	services.Register(&jabber.Service{})
@@ -105,6 +112,7 @@ func registerServices() {
 	services.Register(&systemd.Service{})
 	services.Register(&telegram.Service{})
 	services.Register(&tasmota.Service{})
+	services.Register(&tracker.Service{})
 	services.Register(&twitter.Service{})
 	services.Register(&ups.Service{})
 	services.Register(&watchdog.Service{})
@@ -122,13 +130,21 @@ func usage() {
 	fmt.Println()
 	fmt.Println("Commands:")
 	fmt.Println("   config  path filenames  Update config")
+	fmt.Println("   config  check filenames Validate config")
+	fmt.Println("   config  --dry-run path filenames")
+	fmt.Println("                           Validate and preview changes")
+	fmt.Println("   config  history [path]  List config revisions")
+	fmt.Println("   config  diff rev [rev]  Diff config revisions")
+	fmt.Println("   config  rollback rev    Republish a config revision")
 	fmt.Println("   logs                    Tail logs")
 	fmt.Println("   restart [service]       Restart a service")
 	fmt.Println("   run     [service]       Run a service")
 	fmt.Println("   start   [service]       Start a service")
 	fmt.Println("   status  [service]       Get service status")
 	fmt.Println("   stop    [service]       Stop a process")
+	fmt.Println("   switch  device [args]   Command a device, group:<group> or room:<room>")
 	fmt.Println("   query   ...             Query services")
+	fmt.Println("   replay  [options] files Replay datalogger archives")
 	fmt.Println()
 }
 
@@ -162,10 +178,34 @@ func main() {
 	default:
 		usage()
 	case "config":
+		if len(ps) == 0 {
+			usage()
+			return
+		}
+		// revisions are kept by the history service
+		switch ps[0] {
+		case "history":
+			query("history/revisions", ps[1:], url.Values{"responses": {"1"}})
+			return
+		case "diff":
+			query("history/diff", ps[1:], url.Values{"responses": {"1"}})
+			return
+		case "rollback":
+			query("history/rollback", ps[1:], url.Values{"responses": {"1"}})
+			return
+		}
 		if len(ps) < 2 {
 			usage()
 			return
 		}
+		if ps[0] == "check" {
+			configCheck(ps[1:])
+			return
+		}
+		if ps[0] == "--dry-run" && len(ps) >= 3 {
+			configDryRun(ps[1], ps[2:])
+			return
+		}
 		config(ps[0], ps[1:])
 	case "start":
 		query("start", ps, emptyParams)
@@ -195,6 +235,8 @@ func main() {
 		query(ps[0], ps[1:], url.Values{"timeout": {"5000"}, "responses": {"1"}})
 	case "logs":
 		stream("logs", emptyParams)
+	case "replay":
+		replay(ps)
 	}
 }
 
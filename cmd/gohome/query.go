@@ -17,7 +17,11 @@ func fmtFatalf(format string, v ...interface{}) {
 }
 
 func stream(path string, params url.Values) {
-	resp, err := request(path, params)
+	output(request(path, params))
+}
+
+// output the responses streamed.
+func output(resp *http.Response, err error) {
 	if err != nil {
 		if strings.HasSuffix(err.Error(), " EOF") { // yuck
 			fmtFatalf("Server disconnected\n")
@@ -49,13 +53,17 @@ func stream(path string, params url.Values) {
 	}
 }
 
-func request(path string, params url.Values) (*http.Response, error) {
+func apiUrl(path string) string {
 	if os.Getenv("GOHOME_API") == "" {
 		fmtFatalf("Set GOHOME_API to the gohome api url.")
 	}
 	// add http auth
 	api := os.Getenv("GOHOME_API")
-	uri := fmt.Sprintf("%s/%s", api, path)
+	return fmt.Sprintf("%s/%s", api, path)
+}
+
+func request(path string, params url.Values) (*http.Response, error) {
+	uri := apiUrl(path)
 	if len(params) > 0 {
 		uri += "?" + params.Encode()
 	}
@@ -63,6 +71,11 @@ func request(path string, params url.Values) (*http.Response, error) {
 	return resp, err
 }
 
+// post params as a form, for those too large for a url.
+func post(path string, params url.Values) (*http.Response, error) {
+	return http.PostForm(apiUrl(path), params)
+}
+
 func query(first string, rest []string, params url.Values) {
 	q := strings.Join(rest, " ")
 	u := url.Values{"q": {q}}
@@ -73,3 +86,13 @@ func query(first string, rest []string, params url.Values) {
 	path := fmt.Sprintf("query/%s", first)
 	stream(path, u)
 }
+
+// queryBody sends a query with a large argument, eg. a document, in the
+// request body.
+func queryBody(first string, arg string, params url.Values) {
+	u := url.Values{"q": {arg}}
+	for key, value := range params {
+		u[key] = value
+	}
+	output(post("query/"+first, u))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/lib/datalog"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
+)
+
+func replayUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("Usage: gohome replay [options] files...")
+		fmt.Println()
+		fmt.Println("Re-emit events from datalogger archives (data.log, rotated or gzipped), merged by timestamp.")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+}
+
+func replayTopics(topics, device string) []pubsub.Topic {
+	var subs []pubsub.Topic
+	if topics == "" {
+		subs = append(subs, pubsub.All())
+	} else {
+		for _, t := range strings.Split(topics, ",") {
+			subs = append(subs, pubsub.Prefix(t))
+		}
+	}
+	if device != "" {
+		for i, sub := range subs {
+			subs[i] = pubsub.Filter(sub, pubsub.Device(device))
+		}
+	}
+	return subs
+}
+
+func replayMatch(subs []pubsub.Topic, ev *pubsub.Event) bool {
+	topic := ev.Topic
+	if ev.Device() != "" {
+		topic += "/" + ev.Device()
+	}
+	for _, sub := range subs {
+		if pubsub.Matches(sub, topic, ev) {
+			return true
+		}
+	}
+	return false
+}
+
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "speed multiplier (eg. 60 for an hour a minute), 0 for as fast as possible")
+	topics := fs.String("topics", "", "only replay these topics (comma separated)")
+	device := fs.String("device", "", "only replay devices matching glob (eg. light.*)")
+	dryRun := fs.Bool("dry-run", false, "print events instead of emitting them")
+	keep := fs.Bool("keep-timestamps", false, "emit with the original timestamps, rather than the time of replay")
+	fs.Usage = replayUsage(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return
+	}
+
+	var readers []*datalog.Reader
+	for _, filename := range fs.Args() {
+		r, err := datalog.Open(filename)
+		if err != nil {
+			fmtFatalf("Error opening %s: %s\n", filename, err)
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+	subs := replayTopics(*topics, *device)
+
+	if !*dryRun {
+		services.SetupBroker("replay")
+		defer services.Shutdown()
+	}
+
+	var first, last time.Time
+	started := time.Now()
+	n := 0
+	merger := datalog.Merge(readers...)
+	for ev := merger.Next(); ev != nil; ev = merger.Next() {
+		if !replayMatch(subs, ev) {
+			continue
+		}
+		if first.IsZero() {
+			first = ev.Timestamp
+		}
+		if *speed > 0 {
+			// wait until the scaled offset from the first event
+			offset := time.Duration(float64(ev.Timestamp.Sub(first)) / *speed)
+			if d := time.Until(started.Add(offset)); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		last = ev.Timestamp
+		if !*keep {
+			ev.Timestamp = time.Now().UTC()
+		}
+		if *dryRun {
+			fmt.Printf("%s %s\n", last.Local().Format(time.StampMilli), ev)
+		} else {
+			services.Publisher.Emit(ev)
+			// don't overrun the publish queue when replaying quickly
+			ev.Published.Wait()
+		}
+		n += 1
+	}
+	for _, r := range readers {
+		if err := r.Err(); err != nil {
+			fmt.Println("Error reading:", err)
+		}
+	}
+	fmt.Printf("Replayed %d events", n)
+	if n > 0 {
+		fmt.Printf(" covering %s in %s", util.ShortDuration(last.Sub(first)), time.Since(started).Round(time.Millisecond))
+	}
+	fmt.Println()
+}
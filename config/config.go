@@ -13,12 +13,37 @@ import (
 )
 
 type BillConf struct {
-	Electricity struct {
-		Primary_Rate    float64
-		Standing_Charge float64
-	}
-	Vat      float64
-	Currency string
+	Electricity ElectricityConf
+	Vat         float64 // %
+	Currency    string
+}
+
+// ElectricityConf is the electricity tariff, with rates in pence (or cents)
+// per kWh and the standing charge per day. Bands are time of use rates (eg.
+// economy 7), overriding the primary rate:
+//
+//	electricity:
+//	  primary_rate: 24.5
+//	  standing_charge: 53.4
+//	  export_rate: 15
+//	  bands:
+//	  - time: 00:30-07:30
+//	    rate: 7.5
+//	  meter: meter.grid
+//
+// Meter is the whole house meter, otherwise the whole house is the sum of
+// devices.
+type ElectricityConf struct {
+	Primary_Rate    float64
+	Standing_Charge float64
+	Export_Rate     float64
+	Bands           []TariffBandConf
+	Meter           string
+}
+
+type TariffBandConf struct {
+	Time string // 23:30-06:30, may span midnight
+	Rate float64
 }
 
 type CameraNodeConf struct {
@@ -116,9 +141,10 @@ type GeneralConf struct {
 }
 
 type GooglehomeConf struct {
-	Id           string
-	Secret       string
-	Redirect_uri string
+	Id              string
+	Secret          string
+	Redirect_uri    string
+	Service_Account string // key file, to report state to HomeGraph
 }
 
 type GraphiteConf struct {
@@ -127,10 +153,87 @@ type GraphiteConf struct {
 }
 
 type HeatingConf struct {
-	Device  string
-	Zones   map[string]string
-	Minimum float64
-	Slop    float64
+	Device   string
+	Zones    map[string]HeatingZoneConf
+	Minimum  float64
+	Slop     float64
+	Away     float64 // setpoint of scheduled zones when everyone's away, or 0 for no away
+	Holidays []HeatingHolidayConf
+	Preheat  Duration // longest to start early for a scheduled setpoint, or 0 to not
+	Outside  string   // outside temperature sensor, default weather.sensors.temp
+	Band     float64  // proportional band of zones with valves (°C), default 1
+	Demand   float64  // total zone demand (%) to fire the boiler, default 25
+	Min_On   Duration // minimum time the boiler's on/off for, to prevent short cycling
+	Min_Off  Duration
+	Window   HeatingWindowConf
+}
+
+// HeatingZoneConf is a zone's temperature sensor (temp.<zone> by default) and
+// weekly schedule. A zone can be given as just its sensor:
+//
+//	zones:
+//	  hallway: temp.hallway
+//	  living:
+//	    sensor: temp.living
+//	    schedule:
+//	      Mon-Fri:
+//	      - '7:40': 16.5
+//	      - '8:10': 14
+//	      - 17:30-22:15: 17
+//	      Weekends:
+//	      - 09:00-22:50: 16
+//	    valves: [trv.living]
+//	    windows: [sensor.living_window]
+//
+// A time sets the temperature from then, a time range only during it
+// (reverting to the minimum). Valves are the zone's radiator valves, opened
+// in proportion to the zone's demand for heat. Windows are contact sensors
+// that suspend the zone's heating while open.
+type HeatingZoneConf struct {
+	Sensor   string
+	Schedule map[string][]map[string]float64 // days -> [{time: temp}]
+	Valves   []string
+	Windows  []string
+}
+
+func (self *HeatingZoneConf) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var sensor string
+	if err := unmarshal(&sensor); err == nil {
+		self.Sensor = sensor
+		return nil
+	}
+	type plain HeatingZoneConf
+	return unmarshal((*plain)(self))
+}
+
+// HeatingHolidayConf overrides the schedules over dates (inclusive), with the
+// schedule of another day (eg. Sunday) or a fixed temperature.
+type HeatingHolidayConf struct {
+	From string // 2006-01-02
+	To   string
+	Day  string
+	Temp float64
+}
+
+// HeatingWindowConf detects open windows by a zone's temperature falling
+// faster than Drop (°C/hr), suspending its heating for Suspend.
+type HeatingWindowConf struct {
+	Drop    float64 // or 0 to not detect
+	Suspend Duration
+	Alert   string // alert target
+}
+
+type HistoryConf struct {
+	Path      string
+	Retention map[string]Duration // topic (or "default") -> retention
+}
+
+// HomeassistantConf is the Home Assistant MQTT discovery prefix (default
+// homeassistant), and topic prefix for device state and commands (default
+// gohome-ha, outside the gohome/ events).
+type HomeassistantConf struct {
+	Prefix string
+	Topic  string
 }
 
 type IrrigationConf struct {
@@ -204,6 +307,19 @@ type TelegramConf struct {
 	Chat_id int64
 }
 
+// TrackerConf is the policy for confirming commands, by protocol (device
+// source prefix, eg. homeeasy) or "default". Devices of protocols without a
+// policy aren't tracked.
+type TrackerConf struct {
+	Alert     string
+	Protocols map[string]TrackerPolicyConf
+}
+
+type TrackerPolicyConf struct {
+	Timeout Duration // to wait for confirmation
+	Retries int
+}
+
 type VoiceConf map[string]string
 
 type WeatherConf struct {
@@ -230,36 +346,40 @@ type WundergroundConf struct {
 // Configuration structure
 type Config struct {
 	// yaml fields
-	Devices      map[string]DeviceConf
-	Endpoints    EndpointsConf
-	Bill         BillConf
-	Camera       CameraConf
-	Caps         CapsConf
-	Currentcost  CurrentcostConf
-	Datalogger   DataloggerConf
-	Earth        EarthConf
-	Espeak       EspeakConf
-	Frigate      FrigateConf
-	General      GeneralConf
-	Googlehome   GooglehomeConf
-	Graphite     GraphiteConf
-	Heating      HeatingConf
-	Irrigation   IrrigationConf
-	Jabber       JabberConf
-	Mastodon     MastodonConf
-	Orvibo       OrviboConf
-	Presence     PresenceConf
-	Pushbullet   PushbulletConf
-	Rfid         RfidConf
-	Slack        SlackConf
-	Solaredge    SolaredgeConf
-	SMS          SMSConf
-	Telegram     TelegramConf
-	Twitter      TwitterConf
-	Voice        VoiceConf
-	Watchdog     WatchdogConf
-	Weather      WeatherConf
-	Wunderground WundergroundConf
+	Devices       map[string]DeviceConf
+	Endpoints     EndpointsConf
+	Bill          BillConf
+	Camera        CameraConf
+	Caps          CapsConf
+	Currentcost   CurrentcostConf
+	Datalogger    DataloggerConf
+	Earth         EarthConf
+	Espeak        EspeakConf
+	Frigate       FrigateConf
+	General       GeneralConf
+	Googlehome    GooglehomeConf
+	Graphite      GraphiteConf
+	Heating       HeatingConf
+	History       HistoryConf
+	Homeassistant HomeassistantConf
+	Irrigation    IrrigationConf
+	Jabber        JabberConf
+	Mastodon      MastodonConf
+	Orvibo        OrviboConf
+	Presence      PresenceConf
+	Pushbullet    PushbulletConf
+	Rfid          RfidConf
+	Scenes        map[string]SceneConf
+	Slack         SlackConf
+	Solaredge     SolaredgeConf
+	SMS           SMSConf
+	Telegram      TelegramConf
+	Tracker       TrackerConf
+	Twitter       TwitterConf
+	Voice         VoiceConf
+	Watchdog      WatchdogConf
+	Weather       WeatherConf
+	Wunderground  WundergroundConf
 
 	Sources map[string]string // source -> device id
 }
@@ -322,8 +442,13 @@ func OpenReader(r io.Reader) (*Config, error) {
 	return OpenRaw(data)
 }
 
-// Open configuration from []byte.
+// Open configuration from []byte, resolving !include, !secret and ${ENV}
+// with DefaultResolver.
 func OpenRaw(data []byte) (*Config, error) {
+	return DefaultResolver.Open(data)
+}
+
+func parse(data []byte) (*Config, error) {
 	config := &Config{}
 	config.Sources = map[string]string{}
 	err := yaml.Unmarshal(data, config)
@@ -331,6 +456,13 @@ func OpenRaw(data []byte) (*Config, error) {
 		return nil, err
 	}
 
+	for zone, z := range config.Heating.Zones {
+		if z.Sensor == "" {
+			z.Sensor = "temp." + zone
+			config.Heating.Zones[zone] = z
+		}
+	}
+
 	for id, device := range config.Devices {
 		device.Id = id
 		// prepend 'inherited' caps by type prefix
@@ -23,6 +23,9 @@ devices:
     name: Living room thermostat
     group: heating
     location: Living Room
+  temp.living:
+    name: Living room temperature
+    source: oregon.a1
   trv.living:
     name: Living room thermostat
     source: energenie.00097f
@@ -40,6 +43,10 @@ bill:
   electricity:
     primary_rate: 8.54
     standing_charge: 18.9
+    export_rate: 5.5
+    bands:
+    - time: 00:30-07:30
+      rate: 4.5
   gas:
     calorific_value: 39.3
     conversion_factor: 1.02264
@@ -60,26 +67,31 @@ general:
     server: localhost:25
 heating:
   device: heater.boiler
-  hallway:
-    schedule:
-      Weekdays:
-      - 00:00-23:59: 0
-      Weekends:
-      - 09:00-22:30: 15.5
-  living:
-    schedule:
-      Friday:
-      - 07:45-08:10: 16
-      Monday,Tuesday,Wednesday,Thursday:
-      - 07:40-08:10: 16.5
-      Weekends:
-      - 09:00-22:50: 16
-  office:
-    schedule:
-      Weekdays:
-      - 09:00-18:00: 16
-      Saturday,Sunday:
-      - 00:00-23:59: 0
+  zones:
+    living:
+      sensor: temp.living
+      schedule:
+        Friday:
+        - 07:45-08:10: 16
+        - 16:45-22:20: 17
+        Mon-Thu:
+        - 07:40-08:10: 16.5
+        - 17:30-22:15: 17
+        Weekends:
+        - 09:00-22:50: 16
+      valves: [trv.living]
+  holidays:
+  - from: 2024-12-24
+    to: 2024-12-26
+    day: Sunday
+  away: 12
+  preheat: 2h
+  min_on: 5m
+  min_off: 5m
+  window:
+    drop: 6
+    suspend: 30m
+    alert: admin
   minimum: 10
   slop: 0.3
 irrigation:
@@ -95,8 +107,21 @@ irrigation:
 jabber:
   jid: myjabberid@gmail.com/gohome
   pass: password
+scenes:
+  movie:
+    name: Movie time
+    location: Living Room
+    devices:
+      light.glowworm: on level=20
+      light.kitchen: off
 sms:
   telephone: '+441234567890'
+tracker:
+  alert: admin
+  protocols:
+    x10:
+      timeout: 5s
+      retries: 2
 twitter:
   auth:
     consumer_key: xxx
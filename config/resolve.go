@@ -0,0 +1,254 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/barnybug/gohome/util"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// Resolver expands the extensions to yaml config:
+//
+//	devices: !include devices.yml   # another yaml file, relative to Dir
+//	token: !secret telegram_token   # value from the secrets file
+//	broker: tcp://${MQTT_HOST}:1883 # environment variable
+//	url: ${API_URL:-http://localhost:8723}
+//
+// Only environment variables in Env are substituted, others are left as is.
+// '$${' escapes a literal '${' of those.
+type Resolver struct {
+	// Directory !include paths are relative to.
+	Dir string
+	// Yaml file of secret name -> value.
+	SecretsFile string
+	// Environment variables that may be substituted.
+	Env []string
+	// Only resolve !include, leaving secrets and environment to services.
+	IncludesOnly bool
+	// Refuse !include, for config received from elsewhere.
+	NoIncludes bool
+	// Substitute missing secrets and environment variables with "", rather
+	// than failing.
+	Lenient bool
+
+	secrets map[string]string
+}
+
+// DefaultResolver is used by OpenRaw and Check, on config services receive
+// over MQTT, so it refuses !include (resolved by `gohome config` before
+// publishing) and substitutes only the environment variables listed in
+// $GOHOME_CONFIG_ENV (comma separated). Dir defaults to ~/.config/gohome (or
+// $GOHOME_CONFIG_DIR), and SecretsFile to secrets.yml there.
+var DefaultResolver = defaultResolver()
+
+func defaultResolver() *Resolver {
+	r := NewResolver(configDir())
+	r.NoIncludes = true
+	for _, name := range strings.Split(os.Getenv("GOHOME_CONFIG_ENV"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			r.Env = append(r.Env, name)
+		}
+	}
+	return r
+}
+
+func configDir() string {
+	if dir := os.Getenv("GOHOME_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	return util.ExpandUser("~/.config/gohome")
+}
+
+// NewResolver creates a Resolver for dir, with secrets.yml there.
+func NewResolver(dir string) *Resolver {
+	return &Resolver{Dir: dir, SecretsFile: filepath.Join(dir, "secrets.yml")}
+}
+
+var reEnv = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+func needsResolving(data []byte) bool {
+	return bytes.Contains(data, []byte("!include")) ||
+		bytes.Contains(data, []byte("!secret")) ||
+		bytes.Contains(data, []byte("${"))
+}
+
+// Resolve expands the data. Data without any extensions is returned as is.
+func (r *Resolver) Resolve(data []byte) ([]byte, error) {
+	if !needsResolving(data) {
+		return data, nil
+	}
+	r.secrets = nil // reread on each resolve
+	node, err := r.resolveNode(data)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	enc := yaml3.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return nil, err
+	}
+	enc.Close()
+	return out.Bytes(), nil
+}
+
+func (r *Resolver) resolveNode(data []byte) (*yaml3.Node, error) {
+	var root yaml3.Node
+	if err := yaml3.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if err := r.resolve(&root, r.Dir, nil); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+func (r *Resolver) resolve(node *yaml3.Node, dir string, including []string) error {
+	switch node.Kind {
+	case yaml3.DocumentNode, yaml3.SequenceNode:
+		for _, c := range node.Content {
+			if err := r.resolve(c, dir, including); err != nil {
+				return err
+			}
+		}
+	case yaml3.MappingNode:
+		// values only, keys are left alone
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := r.resolve(node.Content[i], dir, including); err != nil {
+				return err
+			}
+		}
+	case yaml3.ScalarNode:
+		switch node.Tag {
+		case "!include":
+			return r.include(node, dir, including)
+		case "!secret":
+			if r.IncludesOnly {
+				return nil
+			}
+			value, err := r.secret(node.Value)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", node.Line, err)
+			}
+			node.Tag = "!!str"
+			node.Value = value
+			node.Style = yaml3.DoubleQuotedStyle
+		default:
+			if r.IncludesOnly || !bytes.Contains([]byte(node.Value), []byte("${")) {
+				return nil
+			}
+			value, err := r.substitute(node.Value)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", node.Line, err)
+			}
+			node.Value = value
+			if node.Style == 0 {
+				// re-infer type, eg. port: ${PORT}
+				node.Tag = ""
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) include(node *yaml3.Node, dir string, including []string) error {
+	if r.NoIncludes {
+		return fmt.Errorf("line %d: !include not allowed here, it's resolved before publishing", node.Line)
+	}
+	filename := util.ExpandUser(node.Value)
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(dir, filename)
+	}
+	for _, f := range including {
+		if f == filename {
+			return fmt.Errorf("line %d: recursive include of %s", node.Line, filename)
+		}
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("line %d: %s", node.Line, err)
+	}
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	if len(doc.Content) == 0 {
+		// empty file
+		*node = yaml3.Node{Kind: yaml3.ScalarNode, Tag: "!!null", Line: node.Line}
+		return nil
+	}
+	if err := r.resolve(&doc, filepath.Dir(filename), append(including, filename)); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	*node = *doc.Content[0]
+	return nil
+}
+
+func (r *Resolver) secret(name string) (string, error) {
+	if r.secrets == nil {
+		r.secrets = map[string]string{}
+		data, err := ioutil.ReadFile(r.SecretsFile)
+		if err == nil {
+			err = yaml3.Unmarshal(data, &r.secrets)
+		}
+		if err != nil && !r.Lenient {
+			r.secrets = nil
+			return "", fmt.Errorf("reading secrets: %s", err)
+		}
+	}
+	value, ok := r.secrets[name]
+	if !ok && !r.Lenient {
+		return "", fmt.Errorf("secret '%s' not found in %s", name, r.SecretsFile)
+	}
+	return value, nil
+}
+
+func (r *Resolver) substitute(s string) (string, error) {
+	var err error
+	s = reEnv.ReplaceAllStringFunc(s, func(m string) string {
+		match := reEnv.FindStringSubmatch(m)
+		if !r.allowed(match[1]) {
+			// not ours to substitute, eg. a literal '${'
+			return m
+		}
+		if m[1] == '$' {
+			// escaped
+			return m[1:]
+		}
+		value, ok := os.LookupEnv(match[1])
+		if !ok {
+			if match[2] != "" {
+				return match[3]
+			}
+			if !r.Lenient && err == nil {
+				err = fmt.Errorf("environment variable %s not set", match[1])
+			}
+		}
+		return value
+	})
+	return s, err
+}
+
+func (r *Resolver) allowed(name string) bool {
+	for _, env := range r.Env {
+		if env == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Open configuration from []byte, resolving extensions.
+func (r *Resolver) Open(data []byte) (*Config, error) {
+	resolved, err := r.Resolve(data)
+	if err != nil {
+		return nil, err
+	}
+	return parse(resolved)
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		assert.NoError(t, err)
+	}
+	return dir
+}
+
+var mainYaml = `
+devices: !include devices/all.yml
+telegram:
+  token: !secret telegram_token
+  chat_id: ${TEST_CHAT_ID}
+endpoints:
+  api: http://${TEST_API_HOST:-localhost}:8723/$${literal}
+`
+
+func TestResolve(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"secrets.yml": "telegram_token: '123:abc'\n",
+	})
+	os.Mkdir(filepath.Join(dir, "devices"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "devices", "all.yml"), []byte("light.kitchen: !include kitchen.yml\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "devices", "kitchen.yml"), []byte("name: Kitchen\nsource: x10.b06\n"), 0600)
+	os.Setenv("TEST_CHAT_ID", "42")
+	defer os.Unsetenv("TEST_CHAT_ID")
+
+	r := NewResolver(dir)
+	r.Env = []string{"TEST_CHAT_ID", "TEST_API_HOST", "literal"}
+	config, err := r.Open([]byte(mainYaml))
+	assert.NoError(t, err)
+	assert.Equal(t, "Kitchen", config.Devices["light.kitchen"].Name)
+	assert.Equal(t, "light.kitchen", config.Sources["x10.b06"])
+	assert.Equal(t, "123:abc", config.Telegram.Token)
+	assert.Equal(t, int64(42), config.Telegram.Chat_id)
+	assert.Equal(t, "http://localhost:8723/${literal}", config.Endpoints.Api)
+}
+
+func TestResolveErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"loop.yml":    "a: !include loop.yml\n",
+		"secrets.yml": "other: x\n",
+	})
+	r := NewResolver(dir)
+	r.Env = []string{"TEST_UNSET_VARIABLE"}
+	_, err := r.Open([]byte("x: !include missing.yml\n"))
+	assert.Error(t, err)
+	_, err = r.Open([]byte("x: !include loop.yml\n"))
+	assert.Contains(t, err.Error(), "recursive include")
+	_, err = r.Open([]byte("x: !secret nope\n"))
+	assert.Contains(t, err.Error(), "secret 'nope' not found")
+	_, err = r.Open([]byte("x: ${TEST_UNSET_VARIABLE}\n"))
+	assert.Contains(t, err.Error(), "TEST_UNSET_VARIABLE not set")
+
+	r.Lenient = true
+	_, err = r.Open([]byte("x: !secret nope\ny: ${TEST_UNSET_VARIABLE}\n"))
+	assert.NoError(t, err)
+}
+
+func TestResolveDefault(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"devices.yml": "light.kitchen: {}\n"})
+	os.Setenv("TEST_NOT_ALLOWED", "secret")
+	defer os.Unsetenv("TEST_NOT_ALLOWED")
+	r := defaultResolver()
+	r.Dir = dir
+
+	// config from MQTT can't read local files
+	_, err := r.Open([]byte("devices: !include devices.yml\n"))
+	assert.Contains(t, err.Error(), "!include not allowed")
+
+	// nor environment not allowed, which is left as is
+	config, err := r.Open([]byte("endpoints:\n  api: http://${TEST_NOT_ALLOWED}/$${x}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "http://${TEST_NOT_ALLOWED}/$${x}", config.Endpoints.Api)
+
+	os.Setenv("GOHOME_CONFIG_ENV", "TEST_NOT_ALLOWED, OTHER")
+	defer os.Unsetenv("GOHOME_CONFIG_ENV")
+	r = defaultResolver()
+	assert.Equal(t, []string{"TEST_NOT_ALLOWED", "OTHER"}, r.Env)
+	config, err = r.Open([]byte("endpoints:\n  api: http://${TEST_NOT_ALLOWED}/\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "http://secret/", config.Endpoints.Api)
+}
+
+func ExampleResolver_IncludesOnly() {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "devices.yml"), []byte("light.kitchen:\n  name: Kitchen\n"), 0600)
+
+	// secrets and environment are left for services to resolve
+	r := &Resolver{Dir: dir, IncludesOnly: true}
+	data, _ := r.Resolve([]byte("devices: !include devices.yml\ntoken: !secret token\nhost: ${HOST}\n"))
+	fmt.Print(string(data))
+	// Output:
+	// devices:
+	//   light.kitchen:
+	//     name: Kitchen
+	// token: !secret token
+	// host: ${HOST}
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/util"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// SceneConf is a named set of device commands, applied together:
+//
+//	scenes:
+//	  movie:
+//	    name: Movie time
+//	    location: Living Room
+//	    devices:
+//	      light.glowworm: on level=20
+//	      light.lamp: on colour=#ff8000
+//	      light.kitchen: off
+type SceneConf struct {
+	Name     string
+	Location string
+	Devices  map[string]string // device -> command and arguments
+}
+
+// Commands of the scene, by device id.
+func (self SceneConf) Commands() []*pubsub.Event {
+	var evs []*pubsub.Event
+	for _, device := range sortedKeys(self.Devices) {
+		command, fields := util.ParseArgs(strings.Fields(self.Devices[device]))
+		if command == "" {
+			command = "on"
+		}
+		ev := pubsub.NewEvent("command", fields)
+		ev.SetField("device", device)
+		ev.SetField("command", command)
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+// AddScene adds (or replaces) a scene in config data, preserving the rest of
+// the document.
+func AddScene(data []byte, id string, scene SceneConf) ([]byte, error) {
+	var root yaml3.Node
+	if err := yaml3.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		root = yaml3.Node{Kind: yaml3.DocumentNode, Content: []*yaml3.Node{{Kind: yaml3.MappingNode}}}
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml3.MappingNode {
+		return nil, fmt.Errorf("config is not a mapping")
+	}
+
+	fields := map[string]interface{}{"devices": scene.Devices}
+	if scene.Name != "" {
+		fields["name"] = scene.Name
+	}
+	if scene.Location != "" {
+		fields["location"] = scene.Location
+	}
+	b, err := yaml3.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var value yaml3.Node
+	if err := yaml3.Unmarshal(b, &value); err != nil {
+		return nil, err
+	}
+	scenes := setKey(doc, "scenes", &yaml3.Node{Kind: yaml3.MappingNode}, false)
+	if scenes.Kind != yaml3.MappingNode {
+		// eg. empty
+		scenes = setKey(doc, "scenes", &yaml3.Node{Kind: yaml3.MappingNode}, true)
+	}
+	setKey(scenes, id, value.Content[0], true)
+
+	var out bytes.Buffer
+	enc := yaml3.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return nil, err
+	}
+	enc.Close()
+	return out.Bytes(), nil
+}
+
+// setKey returns the value of key in a mapping node, adding value if missing
+// (or replacing the existing value).
+func setKey(node *yaml3.Node, key string, value *yaml3.Node, replace bool) *yaml3.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			if replace {
+				node.Content[i+1] = value
+			}
+			return node.Content[i+1]
+		}
+	}
+	node.Content = append(node.Content, &yaml3.Node{Kind: yaml3.ScalarNode, Value: key}, value)
+	return value
+}
+
+// CaptureCommand describes the current state of a device from its latest
+// events as scene command arguments, eg. "on level=20".
+func CaptureCommand(events map[string]*pubsub.Event) (string, bool) {
+	ev, ok := events["ack"]
+	if !ok {
+		ev, ok = events["command"]
+	}
+	if !ok || ev.Command() == "" {
+		return "", false
+	}
+	args := []string{ev.Command()}
+	var keys []string
+	for _, k := range []string{"colour", "level", "temp"} {
+		if ev.IsSet(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, fmt.Sprintf("%s=%v", k, ev.Fields[k]))
+	}
+	return strings.Join(args, " "), true
+}
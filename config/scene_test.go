@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleSceneConf_Commands() {
+	scene := ExampleConfig.Scenes["movie"]
+	for _, ev := range scene.Commands() {
+		fmt.Println(ev.Device(), ev.Command(), ev.Fields["level"])
+	}
+	// Output:
+	// light.glowworm on 20
+	// light.kitchen off <nil>
+}
+
+func TestAddScene(t *testing.T) {
+	data := []byte("# lights\ndevices:\n  light.kitchen:\n    name: Kitchen\n")
+	scene := SceneConf{Name: "Dinner", Devices: map[string]string{"light.kitchen": "on level=50"}}
+	out, err := AddScene(data, "dinner", scene)
+	assert.NoError(t, err)
+	assert.Equal(t, `# lights
+devices:
+  light.kitchen:
+    name: Kitchen
+scenes:
+  dinner:
+    devices:
+      light.kitchen: on level=50
+    name: Dinner
+`, string(out))
+
+	// replaces existing
+	scene.Devices["light.kitchen"] = "off"
+	out, err = AddScene(out, "dinner", scene)
+	assert.NoError(t, err)
+	conf, err := OpenRaw(out)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"light.kitchen": "off"}, conf.Scenes["dinner"].Devices)
+}
+
+func TestCaptureCommand(t *testing.T) {
+	_, ok := CaptureCommand(nil)
+	assert.False(t, ok)
+
+	ack := pubsub.NewEvent("ack", pubsub.Fields{"device": "light.lamp", "command": "on", "level": 20, "colour": "#ff8000"})
+	command, ok := CaptureCommand(map[string]*pubsub.Event{"ack": ack})
+	assert.True(t, ok)
+	assert.Equal(t, "on colour=#ff8000 level=20", command)
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateFormat of heating holidays.
+const DateFormat = "2006-01-02"
+
+var weekdays = map[string]time.Weekday{}
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		weekdays[strings.ToLower(d.String())] = d
+		weekdays[strings.ToLower(d.String()[:3])] = d
+	}
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	if d, ok := weekdays[strings.ToLower(strings.TrimSpace(s))]; ok {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid day '%s'", s)
+}
+
+// ParseDays parses a set of days of a schedule, eg. "Monday,Tuesday",
+// "Mon-Fri", "Weekdays", "Weekends" or "Everyday".
+func ParseDays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		switch strings.ToLower(part) {
+		case "weekdays":
+			days = append(days, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday)
+			continue
+		case "weekends":
+			days = append(days, time.Saturday, time.Sunday)
+			continue
+		case "everyday", "daily":
+			for d := time.Sunday; d <= time.Saturday; d++ {
+				days = append(days, d)
+			}
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := parseWeekday(first)
+		if err != nil {
+			return nil, err
+		}
+		if !isRange {
+			days = append(days, from)
+			continue
+		}
+		to, err := parseWeekday(last)
+		if err != nil {
+			return nil, err
+		}
+		// ranges may wrap, eg. Fri-Mon
+		for d := from; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || len(m) != 2 || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time '%s'", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// ParseScheduleTime parses a time ("7:40") or time range ("17:30-22:15") of a
+// schedule, as minutes of the day. end is -1 for a time.
+func ParseScheduleTime(s string) (start, end int, err error) {
+	from, to, isRange := strings.Cut(s, "-")
+	start, err = parseClock(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return start, -1, nil
+	}
+	end, err = parseClock(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("invalid time range '%s'", s)
+	}
+	return start, end, nil
+}
+
+// ParseTimeBand parses a time range of a tariff band ("23:30-06:30"), as
+// minutes of the day. The range may span midnight.
+func ParseTimeBand(s string) (start, end int, err error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		return 0, 0, fmt.Errorf("invalid time range '%s'", s)
+	}
+	if start, err = parseClock(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseClock(to); err != nil {
+		return 0, 0, err
+	}
+	if end == start {
+		return 0, 0, fmt.Errorf("invalid time range '%s'", s)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,437 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// Problem found validating config, located by yaml path and line.
+type Problem struct {
+	Path    string
+	Line    int
+	Message string
+	// Warnings are reported, but don't invalidate the config.
+	Warning bool
+
+	keys []string
+}
+
+func (p Problem) String() string {
+	s := ""
+	if p.Line > 0 {
+		s += fmt.Sprintf("line %d: ", p.Line)
+	}
+	if p.Path != "" {
+		s += p.Path + ": "
+	}
+	if p.Warning {
+		s += "warning: "
+	}
+	return s + p.Message
+}
+
+type Problems []Problem
+
+// Errors returns the problems that aren't warnings.
+func (ps Problems) Errors() Problems {
+	var ret Problems
+	for _, p := range ps {
+		if !p.Warning {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// Err returns an error listing all the errors, or nil if there are none.
+func (ps Problems) Err() error {
+	errs := ps.Errors()
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (ps Problems) Error() string {
+	var lines []string
+	for _, p := range ps {
+		lines = append(lines, p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (ps *Problems) add(message string, keys ...string) {
+	*ps = append(*ps, Problem{Message: message, keys: keys})
+}
+
+func (ps *Problems) warn(message string, keys ...string) {
+	*ps = append(*ps, Problem{Message: message, keys: keys, Warning: true})
+}
+
+// Caps understood by services, besides device type prefixes.
+var knownCaps = map[string]bool{
+	"ack":        true,
+	"colour":     true,
+	"colourtemp": true,
+	"dimmer":     true,
+	"presence":   true,
+	"report":     true,
+	"reversible": true,
+	"scene":      true,
+	"silent":     true,
+	"switch":     true,
+	"thermostat": true,
+	"washer":     true,
+}
+
+var reDeviceId = regexp.MustCompile(`^[a-z][a-z0-9_]*\.[A-Za-z0-9_][A-Za-z0-9_.\-]*$`)
+
+// presence check method -> whether the argument is a mac address
+var presenceChecks = map[string]bool{
+	"sniff":  true,
+	"lescan": true,
+	"beacon": true,
+	"arping": false,
+}
+
+// Validate checks the config for inconsistencies. Problems are not located
+// by line - see Check.
+func (self *Config) Validate() Problems {
+	var ps Problems
+
+	ids := sortedKeys(self.Devices)
+	types := map[string]bool{}
+	for _, id := range ids {
+		if reDeviceId.MatchString(id) {
+			types[self.Devices[id].Prefix()] = true
+		}
+	}
+	for caps := range self.Caps {
+		types[caps] = true
+	}
+
+	sources := map[string]string{}
+	for _, id := range ids {
+		device := self.Devices[id]
+		if !reDeviceId.MatchString(id) {
+			ps.add(fmt.Sprintf("invalid device id '%s' (expected type.name)", id), "devices", id)
+			continue
+		}
+		// skip caps inherited by type, checked below
+		caps := device.Caps[len(self.Caps[device.Prefix()]):]
+		for _, c := range caps {
+			if !knownCaps[c] && !types[c] {
+				ps.add(fmt.Sprintf("unknown cap '%s'", c), "devices", id, "caps")
+			}
+		}
+		if device.Source != "" {
+			if device.SourceId() == "" || strings.HasPrefix(device.Source, ".") {
+				ps.add(fmt.Sprintf("invalid source '%s' (expected protocol.id)", device.Source), "devices", id, "source")
+			} else if other, ok := sources[device.Source]; ok {
+				ps.add(fmt.Sprintf("source '%s' already mapped to %s", device.Source, other), "devices", id, "source")
+			} else {
+				sources[device.Source] = id
+			}
+		}
+	}
+	for _, k := range sortedKeys(self.Caps) {
+		for _, c := range self.Caps[k] {
+			if !knownCaps[c] && !types[c] {
+				ps.add(fmt.Sprintf("unknown cap '%s'", c), "caps", k)
+			}
+		}
+	}
+
+	// sensors must be configured to map their events. Controlled devices
+	// needn't be, so are only warned about.
+	sensor := func(id string, keys ...string) {
+		if _, ok := self.Devices[id]; id != "" && !ok {
+			ps.add(fmt.Sprintf("device '%s' not found", id), keys...)
+		}
+	}
+	device := func(id string, keys ...string) {
+		if _, ok := self.Devices[id]; id != "" && !ok {
+			ps.warn(fmt.Sprintf("device '%s' not found", id), keys...)
+		}
+	}
+
+	if self.Heating.Device != "auto" {
+		device(self.Heating.Device, "heating", "device")
+	}
+	for _, zone := range sortedKeys(self.Heating.Zones) {
+		z := self.Heating.Zones[zone]
+		sensor(z.Sensor, "heating", "zones", zone)
+		for i, valve := range z.Valves {
+			device(valve, "heating", "zones", zone, "valves", strconv.Itoa(i))
+		}
+		for i, window := range z.Windows {
+			device(window, "heating", "zones", zone, "windows", strconv.Itoa(i))
+		}
+		for _, days := range sortedKeys(z.Schedule) {
+			keys := []string{"heating", "zones", zone, "schedule", days}
+			if _, err := ParseDays(days); err != nil {
+				ps.add(err.Error(), keys...)
+			}
+			for i, points := range z.Schedule[days] {
+				for t := range points {
+					if _, _, err := ParseScheduleTime(t); err != nil {
+						ps.add(err.Error(), append(keys, strconv.Itoa(i))...)
+					}
+				}
+			}
+		}
+	}
+	for i, holiday := range self.Heating.Holidays {
+		keys := []string{"heating", "holidays", strconv.Itoa(i)}
+		from, err1 := time.Parse(DateFormat, holiday.From)
+		to, err2 := time.Parse(DateFormat, holiday.To)
+		if err1 != nil || err2 != nil || to.Before(from) {
+			ps.add(fmt.Sprintf("invalid dates '%s' to '%s' (expected %s)", holiday.From, holiday.To, DateFormat), keys...)
+		}
+		if holiday.Day != "" {
+			if _, err := parseWeekday(holiday.Day); err != nil {
+				ps.add(err.Error(), keys...)
+			}
+		} else if holiday.Temp == 0 {
+			ps.add("day or temp required", keys...)
+		}
+	}
+	device(self.Irrigation.Device, "irrigation", "device")
+	for _, scene := range sortedKeys(self.Scenes) {
+		for _, id := range sortedKeys(self.Scenes[scene].Devices) {
+			device(id, "scenes", scene, "devices", id)
+		}
+	}
+	sensor(self.Presence.Trigger, "presence", "trigger")
+	sensor(self.Weather.Sensors.Temp, "weather", "sensors", "temp")
+	sensor(self.Weather.Sensors.Rain, "weather", "sensors", "rain")
+	sensor(self.Weather.Sensors.Wind, "weather", "sensors", "wind")
+	sensor(self.Weather.Sensors.Pressure, "weather", "sensors", "pressure")
+
+	sensor(self.Bill.Electricity.Meter, "bill", "electricity", "meter")
+	for i, band := range self.Bill.Electricity.Bands {
+		if _, _, err := ParseTimeBand(band.Time); err != nil {
+			ps.add(err.Error(), "bill", "electricity", "bands", strconv.Itoa(i))
+		}
+	}
+
+	if topic := self.Homeassistant.Topic; topic == "gohome" || strings.HasPrefix(topic, "gohome/") {
+		ps.add("topic must be outside gohome/, where events are published", "homeassistant", "topic")
+	}
+
+	for _, protocol := range sortedKeys(self.Tracker.Protocols) {
+		keys := []string{"tracker", "protocols", protocol}
+		if self.Tracker.Protocols[protocol].Timeout.IsZero() {
+			ps.add("timeout required", keys...)
+		}
+		if protocol != "default" && len(self.DevicesByProtocol(protocol)) == 0 {
+			ps.warn(fmt.Sprintf("no devices with protocol '%s'", protocol), keys...)
+		}
+	}
+
+	for _, person := range sortedKeys(self.Presence.People) {
+		device(person, "presence", "people", person)
+		for i, check := range self.Presence.People[person] {
+			keys := []string{"presence", "people", person, strconv.Itoa(i)}
+			args := strings.Split(check, " ")
+			if len(args) != 2 {
+				ps.add(fmt.Sprintf("invalid check '%s' (expected method address)", check), keys...)
+				continue
+			}
+			isMac, ok := presenceChecks[args[0]]
+			if !ok {
+				ps.add(fmt.Sprintf("unknown check method '%s'", args[0]), keys...)
+			} else if _, err := net.ParseMAC(args[1]); isMac && err != nil {
+				ps.add(fmt.Sprintf("invalid mac address '%s'", args[1]), keys...)
+			}
+		}
+	}
+
+	return ps
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	reLine    = regexp.MustCompile(`^\s*line (\d+): (.*)$`)
+	reUnknown = regexp.MustCompile(`^field (\S+) not found in type`)
+)
+
+// Check parses and validates config data, locating problems by yaml path and
+// line. Unknown fields are reported as warnings. The config is nil if the data
+// could not be parsed at all.
+func Check(data []byte) (*Config, Problems) {
+	return DefaultResolver.Check(data)
+}
+
+// Check is Check, resolving extensions with r.
+func (r *Resolver) Check(data []byte) (*Config, Problems) {
+	var ps Problems
+	var root yaml3.Node
+	yaml3.Unmarshal(data, &root)
+
+	resolved, err := r.Resolve(data)
+	if err != nil {
+		return nil, lineProblems(&root, &root, err.Error(), false)
+	}
+	// yaml errors are located by line in the resolved data
+	resolvedRoot := &root
+	if !bytes.Equal(resolved, data) {
+		resolvedRoot = &yaml3.Node{}
+		yaml3.Unmarshal(resolved, resolvedRoot)
+	}
+
+	config, err := parse(resolved)
+	if err != nil {
+		return nil, lineProblems(&root, resolvedRoot, err.Error(), false)
+	}
+
+	// unknown fields
+	var strict Config
+	if err := yaml.UnmarshalStrict(resolved, &strict); err != nil {
+		for _, p := range lineProblems(&root, resolvedRoot, err.Error(), true) {
+			if m := reUnknown.FindStringSubmatch(p.Message); m != nil {
+				p.Message = fmt.Sprintf("unknown field '%s'", m[1])
+				ps = append(ps, p)
+			}
+		}
+	}
+
+	for _, p := range config.Validate() {
+		p.Path, p.Line = locate(&root, p.keys)
+		ps = append(ps, p)
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		return ps[i].Line < ps[j].Line
+	})
+	return config, ps
+}
+
+// lineProblems converts yaml errors ("line N: message") in the resolved data
+// to problems, located in the original.
+func lineProblems(root, resolved *yaml3.Node, msg string, warning bool) Problems {
+	var ps Problems
+	for _, line := range strings.Split(msg, "\n") {
+		if m := reLine.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			p := Problem{Line: n, Message: m[2], Warning: warning}
+			if keys := keysAt(resolved, n); keys != nil {
+				p.Path, p.Line = locate(root, keys)
+			}
+			ps = append(ps, p)
+		}
+	}
+	if len(ps) == 0 {
+		ps = append(ps, Problem{Message: strings.TrimPrefix(msg, "yaml: "), Warning: warning})
+	}
+	return ps
+}
+
+// locate finds the line of the deepest key present on the path, and the path
+// as a string.
+func locate(root *yaml3.Node, keys []string) (string, int) {
+	path := formatPath(keys)
+	node := root
+	if node.Kind == yaml3.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for _, key := range keys {
+		next := child(node, key)
+		if next == nil {
+			break
+		}
+		line = next.key
+		node = next.value
+	}
+	return path, line
+}
+
+type entry struct {
+	key   int
+	value *yaml3.Node
+}
+
+func child(node *yaml3.Node, key string) *entry {
+	switch node.Kind {
+	case yaml3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return &entry{node.Content[i].Line, node.Content[i+1]}
+			}
+		}
+	case yaml3.SequenceNode:
+		if i, err := strconv.Atoi(key); err == nil && i < len(node.Content) {
+			return &entry{node.Content[i].Line, node.Content[i]}
+		}
+	}
+	return nil
+}
+
+// keysAt finds the yaml path of the key or item on line n.
+func keysAt(root *yaml3.Node, n int) []string {
+	var found []string
+	var walk func(node *yaml3.Node, keys []string)
+	walk = func(node *yaml3.Node, keys []string) {
+		if found != nil {
+			return
+		}
+		switch node.Kind {
+		case yaml3.DocumentNode:
+			for _, c := range node.Content {
+				walk(c, keys)
+			}
+		case yaml3.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				k := append(keys[:len(keys):len(keys)], node.Content[i].Value)
+				if node.Content[i].Line == n {
+					found = k
+					return
+				}
+				walk(node.Content[i+1], k)
+			}
+		case yaml3.SequenceNode:
+			for i, c := range node.Content {
+				k := append(keys[:len(keys):len(keys)], strconv.Itoa(i))
+				if c.Line == n && c.Kind == yaml3.ScalarNode {
+					found = k
+					return
+				}
+				walk(c, k)
+			}
+		}
+	}
+	walk(root, nil)
+	return found
+}
+
+// formatPath formats keys as eg. presence.people.person.bob[0]
+func formatPath(keys []string) string {
+	s := ""
+	for _, k := range keys {
+		if _, err := strconv.Atoi(k); err == nil && s != "" {
+			s += "[" + k + "]"
+		} else if s == "" {
+			s = k
+		} else {
+			s += "." + k
+		}
+	}
+	return s
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var invalidYaml = `
+caps:
+  light: [switch, swtich]
+devices:
+  light.kitchen:
+    name: Kitchen
+    source: x10.b06
+    nmae: typo
+  light.hall:
+    source: x10.b06
+  lamp:
+    name: No type
+  temp.hallway:
+    source: oregon
+heating:
+  device: heater.boiler
+  zones:
+    hallway: temp.hallway
+    living: temp.living
+    office:
+      sensor: temp.hallway
+      schedule:
+        Mon-Fri:
+        - '25:00': 18
+        Weekdends:
+        - '9:00': 18
+      valves: [trv.office]
+      windows: [sensor.office]
+presence:
+  people:
+    person.bob:
+    - sniff 00:11:22:33:44:55
+    - lescan 00:11:22:33:44
+    - arping bob-phone
+tracker:
+  protocols:
+    homeeasy:
+      retries: 2
+bill:
+  electricity:
+    bands:
+    - time: '7:00'
+      rate: 10
+`
+
+func ExampleCheck() {
+	_, problems := Check([]byte(invalidYaml))
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	// Output:
+	// line 3: caps.light: unknown cap 'swtich'
+	// line 7: devices.light.kitchen.source: source 'x10.b06' already mapped to light.hall
+	// line 8: devices.light.kitchen.nmae: warning: unknown field 'nmae'
+	// line 11: devices.lamp: invalid device id 'lamp' (expected type.name)
+	// line 14: devices.temp.hallway.source: invalid source 'oregon' (expected protocol.id)
+	// line 16: heating.device: warning: device 'heater.boiler' not found
+	// line 19: heating.zones.living: device 'temp.living' not found
+	// line 24: heating.zones.office.schedule.Mon-Fri[0]: invalid time '25:00'
+	// line 25: heating.zones.office.schedule.Weekdends: invalid day 'Weekdends'
+	// line 27: heating.zones.office.valves[0]: warning: device 'trv.office' not found
+	// line 28: heating.zones.office.windows[0]: warning: device 'sensor.office' not found
+	// line 31: presence.people.person.bob: warning: device 'person.bob' not found
+	// line 33: presence.people.person.bob[1]: invalid mac address '00:11:22:33:44'
+	// line 37: tracker.protocols.homeeasy: timeout required
+	// line 37: tracker.protocols.homeeasy: warning: no devices with protocol 'homeeasy'
+	// line 42: bill.electricity.bands[0]: invalid time range '7:00'
+}
+
+func TestCheckValid(t *testing.T) {
+	config, problems := Check([]byte(ExampleYaml))
+	assert.NotNil(t, config)
+	assert.NoError(t, problems.Err())
+}
+
+func TestCheckUnparseable(t *testing.T) {
+	config, problems := Check([]byte("devices:\n  light.kitchen:\n    caps: 1.5\n"))
+	assert.Nil(t, config)
+	assert.Error(t, problems.Err())
+	assert.Equal(t, 3, problems[0].Line)
+	assert.Equal(t, "devices.light.kitchen.caps", problems[0].Path)
+}
+
+func TestCheckHomeassistantTopic(t *testing.T) {
+	_, problems := Check([]byte("homeassistant:\n  topic: gohome/ha\n"))
+	assert.Error(t, problems.Err())
+	assert.Equal(t, "homeassistant.topic", problems[0].Path)
+	_, problems = Check([]byte("homeassistant:\n  topic: gohome-ha\n"))
+	assert.NoError(t, problems.Err())
+}
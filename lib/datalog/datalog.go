@@ -0,0 +1,123 @@
+// Package datalog reads the event archives written by the datalogger service
+// (one json event per line), plain or gzipped.
+package datalog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"container/heap"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/barnybug/gohome/pubsub"
+)
+
+// Reader of events from a single archive.
+type Reader struct {
+	scanner *bufio.Scanner
+	closers []io.Closer
+}
+
+// Open an archive file, decompressing if it ends in .gz.
+func Open(filename string) (*Reader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	closers := []io.Closer{f}
+	var r io.Reader = f
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		closers = append(closers, gz)
+		r = gz
+	}
+	reader := NewReader(r)
+	reader.closers = closers
+	return reader, nil
+}
+
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &Reader{scanner: scanner}
+}
+
+// Next event, or nil at the end. Unparseable lines are skipped.
+func (r *Reader) Next() *pubsub.Event {
+	for r.scanner.Scan() {
+		if ev := pubsub.Parse(r.scanner.Text(), ""); ev != nil && ev.Format != "raw" {
+			return ev
+		}
+	}
+	return nil
+}
+
+// Err returns the first non-EOF error encountered reading.
+func (r *Reader) Err() error {
+	return r.scanner.Err()
+}
+
+func (r *Reader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if e := r.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type head struct {
+	event  *pubsub.Event
+	reader *Reader
+}
+
+type heads []head
+
+func (h heads) Len() int            { return len(h) }
+func (h heads) Less(i, j int) bool  { return h[i].event.Timestamp.Before(h[j].event.Timestamp) }
+func (h heads) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *heads) Push(x interface{}) { *h = append(*h, x.(head)) }
+func (h *heads) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Merger interleaves events from several readers by timestamp. Each reader
+// is expected to be (mostly) in timestamp order already.
+type Merger struct {
+	heads heads
+}
+
+func Merge(readers ...*Reader) *Merger {
+	m := &Merger{}
+	for _, r := range readers {
+		if ev := r.Next(); ev != nil {
+			m.heads = append(m.heads, head{ev, r})
+		}
+	}
+	heap.Init(&m.heads)
+	return m
+}
+
+// Next event by timestamp across all readers, or nil at the end.
+func (m *Merger) Next() *pubsub.Event {
+	if len(m.heads) == 0 {
+		return nil
+	}
+	h := m.heads[0]
+	if ev := h.reader.Next(); ev != nil {
+		m.heads[0].event = ev
+		heap.Fix(&m.heads, 0)
+	} else {
+		heap.Pop(&m.heads)
+	}
+	return h.event
+}
@@ -0,0 +1,48 @@
+package datalog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var tempLog = `{"topic":"temp","device":"temp.hall","temp":10.1,"timestamp":"2014-01-04 16:00:00.000"}
+{"topic":"temp","device":"temp.hall","temp":12.5,"timestamp":"2014-01-04 16:10:00.000"}
+not an event
+{"topic":"temp","device":"temp.hall","temp":14.2,"timestamp":"2014-01-04 16:20:00.000"}
+`
+
+var ackLog = `{"topic":"ack","device":"light.hall","command":"on","timestamp":"2014-01-04 16:05:00.000"}
+{"topic":"ack","device":"light.hall","command":"off","timestamp":"2014-01-04 16:25:00.000"}
+`
+
+func TestMerge(t *testing.T) {
+	m := Merge(NewReader(strings.NewReader(tempLog)), NewReader(strings.NewReader(ackLog)))
+	var topics []string
+	for ev := m.Next(); ev != nil; ev = m.Next() {
+		topics = append(topics, ev.Topic)
+	}
+	assert.Equal(t, []string{"temp", "ack", "temp", "temp", "ack"}, topics)
+}
+
+func TestOpenGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(ackLog))
+	gz.Close()
+	filename := path.Join(t.TempDir(), "data.log.1.gz")
+	assert.NoError(t, os.WriteFile(filename, buf.Bytes(), 0644))
+
+	r, err := Open(filename)
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, "on", r.Next().Command())
+	assert.Equal(t, "off", r.Next().Command())
+	assert.Nil(t, r.Next())
+	assert.NoError(t, r.Err())
+}
@@ -18,7 +18,7 @@ func (sub *Subscriber) replayEvents() <-chan *pubsub.Event {
 	go func() {
 		for _, ev := range sub.Events {
 			for _, s := range sub.subscriptions {
-				if s.Match(ev.Topic) {
+				if pubsub.Matches(s, ev.Topic, ev) {
 					ch <- ev
 					break
 				}
@@ -0,0 +1,164 @@
+// Package embedded is an in-process implementation of the gohome message bus.
+//
+// It routes events between publishers and subscribers in the same process,
+// with the same topic layout and retained message semantics as an mqtt
+// broker, so a set of services can run with no external daemon. Optionally it
+// also accepts mqtt client connections on a tcp address (see Listen).
+package embedded
+
+import (
+	"log"
+	"sync"
+
+	"github.com/barnybug/gohome/pubsub"
+)
+
+type message struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+// A destination for routed messages - a local subscriber channel or a remote
+// mqtt connection.
+type receiver interface {
+	deliver(msg message, retained bool)
+}
+
+// Broker struct
+type Broker struct {
+	addr      string
+	queue     chan message
+	receivers []receiver
+	retained  map[string]message
+	lock      sync.Mutex
+	flushed   chan chan bool
+	publisher *Publisher
+	sub       *Subscriber
+}
+
+func NewBroker(addr string) *Broker {
+	broker := &Broker{
+		addr:     addr,
+		queue:    make(chan message, 1000),
+		retained: map[string]message{},
+		flushed:  make(chan chan bool),
+	}
+	broker.publisher = &Publisher{broker: broker}
+	broker.sub = NewSubscriber(broker)
+	go broker.loop()
+	return broker
+}
+
+func (self *Broker) Id() string {
+	if self.addr == "" {
+		return "embedded"
+	}
+	return "embedded: " + self.addr
+}
+
+func (self *Broker) Subscriber() pubsub.Subscriber {
+	return self.sub
+}
+
+func (self *Broker) Publisher() *Publisher {
+	return self.publisher
+}
+
+func (self *Broker) loop() {
+	for {
+		select {
+		case msg := <-self.queue:
+			self.route(msg)
+		case done := <-self.flushed:
+			// drain anything queued before the flush request
+			for len(self.queue) > 0 {
+				self.route(<-self.queue)
+			}
+			done <- true
+		}
+	}
+}
+
+func (self *Broker) publish(msg message) bool {
+	// Publishing happens inside subscriber loops, so never block here.
+	select {
+	case self.queue <- msg:
+		return true
+	default:
+		log.Println("Publish queue FULL - dropping message!")
+		return false
+	}
+}
+
+// flush waits until all queued messages have been routed.
+func (self *Broker) flush() {
+	done := make(chan bool)
+	self.flushed <- done
+	<-done
+}
+
+func (self *Broker) route(msg message) {
+	self.lock.Lock()
+	if msg.retained {
+		if len(msg.payload) == 0 {
+			// empty retained message clears the topic
+			delete(self.retained, msg.topic)
+		} else {
+			self.retained[msg.topic] = msg
+		}
+	}
+	receivers := make([]receiver, len(self.receivers))
+	copy(receivers, self.receivers)
+	self.lock.Unlock()
+
+	for _, r := range receivers {
+		// live messages are never flagged retained, as with mqtt
+		r.deliver(msg, false)
+	}
+}
+
+// addReceiver registers r (if not already), and passes the retained messages
+// matching fn to replay. The lock is held during replay so no live message can
+// overtake the retained ones.
+func (self *Broker) addReceiver(r receiver, fn func(topic string) bool, replay func([]message)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.hasReceiver(r) {
+		self.receivers = append(self.receivers, r)
+	}
+	var matches []message
+	for topic, msg := range self.retained {
+		if fn(topic) {
+			matches = append(matches, msg)
+		}
+	}
+	replay(matches)
+}
+
+func (self *Broker) hasReceiver(r receiver) bool {
+	for _, x := range self.receivers {
+		if x == r {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Broker) removeReceiver(r receiver) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, x := range self.receivers {
+		if x == r {
+			self.receivers = append(self.receivers[:i], self.receivers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// matchFilter matches an mqtt topic against a subscription filter, which may
+// contain '+' (single level) and '#' (multi level) wildcards.
+func matchFilter(filter, topic string) bool {
+	return pubsub.Wildcard(filter).Match(topic)
+}
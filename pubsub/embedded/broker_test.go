@@ -0,0 +1,158 @@
+package embedded
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(t *testing.T, ch <-chan *pubsub.Event) *pubsub.Event {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return nil
+}
+
+func TestMatchFilter(t *testing.T) {
+	assert.True(t, matchFilter("gohome/#", "gohome/temp/temp.hall"))
+	assert.True(t, matchFilter("gohome/temp/#", "gohome/temp"))
+	assert.True(t, matchFilter("gohome/+/temp.hall", "gohome/temp/temp.hall"))
+	assert.True(t, matchFilter("gohome/config", "gohome/config"))
+	assert.False(t, matchFilter("gohome/config", "gohome/config/automata"))
+	assert.False(t, matchFilter("gohome/+", "gohome/temp/temp.hall"))
+	assert.False(t, matchFilter("zigbee2mqtt/#", "gohome/temp"))
+}
+
+func TestMultipleSubscribers(t *testing.T) {
+	broker := NewBroker("")
+	sub := broker.Subscriber()
+	temps := sub.Subscribe(pubsub.Prefix("temp"))
+	all := sub.Subscribe(pubsub.All())
+	config := sub.Subscribe(pubsub.Exact("config"))
+
+	pub := broker.Publisher()
+	pub.Emit(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hall", "temp": 20}))
+
+	ev := receive(t, temps)
+	assert.Equal(t, "temp", ev.Topic)
+	assert.Equal(t, 20.0, ev.FloatField("temp"))
+	assert.False(t, ev.Retained)
+	assert.Equal(t, "temp.hall", receive(t, all).Device())
+	assert.Empty(t, config)
+
+	sub.Close(temps)
+	_, ok := <-temps
+	assert.False(t, ok)
+}
+
+func TestRetained(t *testing.T) {
+	broker := NewBroker("")
+	pub := broker.Publisher()
+	ev := pubsub.NewRawEvent("config", []byte("devices: {}\n"))
+	ev.SetRetained(true)
+	pub.Emit(ev)
+	pub.Close() // flush
+
+	ch := broker.Subscriber().Subscribe(pubsub.Exact("config"))
+	ev = receive(t, ch)
+	assert.True(t, ev.Retained)
+	assert.Equal(t, "devices: {}\n", string(ev.Raw))
+}
+
+func TestCloseWhileBlocked(t *testing.T) {
+	broker := NewBroker("")
+	sub := broker.Subscriber()
+	ch := sub.Subscribe(pubsub.All())
+	pub := broker.Publisher()
+	// overflow the channel buffer, so the broker blocks delivering
+	for i := 0; i < 20; i++ {
+		pub.Emit(pubsub.NewEvent("test", pubsub.Fields{}))
+	}
+	time.Sleep(10 * time.Millisecond)
+	sub.Close(ch)
+	pub.Close()
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	broker := NewBroker("")
+	sub := broker.Subscriber()
+	slow := sub.Subscribe(pubsub.All())
+	fast := sub.Subscribe(pubsub.All())
+	pub := broker.Publisher()
+	// slow isn't receiving, but doesn't stall delivery to fast
+	for i := 0; i < queueSize+100; i++ {
+		pub.Emit(pubsub.NewEvent("test", pubsub.Fields{"n": i}))
+		assert.Equal(t, float64(i), receive(t, fast).Fields["n"])
+	}
+	// the oldest are delivered, the newest dropped once the queue is full
+	assert.Equal(t, 0.0, receive(t, slow).Fields["n"])
+	dropped := sub.(pubsub.DropCounter).Dropped()
+	assert.Len(t, dropped, 1)
+	assert.NotZero(t, dropped["[1] gohome/#"])
+	sub.Close(slow)
+	sub.Close(fast)
+	// closed subscriptions are totalled
+	assert.Equal(t, map[string]uint64{pubsub.ClosedSubscriptions: dropped["[1] gohome/#"]}, sub.(pubsub.DropCounter).Dropped())
+}
+
+func TestPublishDropped(t *testing.T) {
+	// a broker not routing, so the queue is full
+	broker := &Broker{queue: make(chan message)}
+	pub := &Publisher{broker: broker}
+	ev := pubsub.NewEvent("test", pubsub.Fields{})
+	pub.Emit(ev)
+	waited := make(chan bool)
+	go func() {
+		ev.Published.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Published not done for dropped message")
+	}
+}
+
+func TestListen(t *testing.T) {
+	broker := NewBroker("")
+	addr, err := broker.Listen("127.0.0.1:0")
+	assert.NoError(t, err)
+
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s", addr))
+	opts.SetClientID("test")
+	client := MQTT.NewClient(opts)
+	token := client.Connect()
+	token.Wait()
+	assert.NoError(t, token.Error())
+	defer client.Disconnect(0)
+
+	// remote -> local
+	ch := broker.Subscriber().Subscribe(pubsub.Prefix("temp"))
+	token = client.Publish("gohome/temp/temp.hall", 1, false, `{"topic":"temp","device":"temp.hall","temp":19.5}`)
+	token.Wait()
+	assert.NoError(t, token.Error())
+	assert.Equal(t, 19.5, receive(t, ch).FloatField("temp"))
+
+	// local -> remote
+	received := make(chan MQTT.Message, 1)
+	token = client.Subscribe("gohome/alert/#", 1, func(client MQTT.Client, msg MQTT.Message) {
+		received <- msg
+	})
+	token.Wait()
+	assert.NoError(t, token.Error())
+	broker.Publisher().Emit(pubsub.NewEvent("alert", pubsub.Fields{"device": "x", "message": "hello"}))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "gohome/alert/x", msg.Topic())
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+}
@@ -0,0 +1,34 @@
+package embedded
+
+import (
+	"github.com/barnybug/gohome/pubsub"
+)
+
+// Publisher for the embedded broker
+type Publisher struct {
+	broker *Broker
+}
+
+// ID of Publisher
+func (pub *Publisher) ID() string {
+	return pub.broker.Id()
+}
+
+// Emit an event
+func (pub *Publisher) Emit(ev *pubsub.Event) {
+	ev.Published.Add(1)
+	// put all topics under gohome/<topic>/<device>, as mqtt does
+	topic := "gohome/" + ev.Topic
+	if ev.Device() != "" {
+		topic += "/" + ev.Device()
+	}
+	msg := message{topic: topic, payload: ev.Bytes(), retained: ev.Retained}
+	// queued messages are always routed, so this is as good as published - and
+	// there's no more to wait for if it was dropped
+	pub.broker.publish(msg)
+	ev.Published.Done()
+}
+
+func (pub *Publisher) Close() {
+	pub.broker.flush()
+}
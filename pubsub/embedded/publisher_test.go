@@ -0,0 +1,9 @@
+package embedded
+
+import "github.com/barnybug/gohome/pubsub"
+
+func ExampleInterfaces() {
+	var _ pubsub.Publisher = (*Publisher)(nil)
+	var _ pubsub.Subscriber = (*Subscriber)(nil)
+	// Output:
+}
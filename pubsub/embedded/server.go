@@ -0,0 +1,176 @@
+package embedded
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Listen accepts mqtt (3.1.1) client connections on addr, so services in
+// other processes - or bridges such as zigbee2mqtt - can share the embedded
+// broker. Messages are delivered to remote clients at QoS 0.
+func (self *Broker) Listen(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Println("Error accepting mqtt connection:", err)
+				return
+			}
+			c := newClient(self, conn)
+			go c.run()
+		}
+	}()
+	return l.Addr(), nil
+}
+
+type client struct {
+	broker  *Broker
+	conn    net.Conn
+	out     chan packets.ControlPacket
+	filters map[string]bool
+	closed  bool
+	lock    sync.Mutex
+}
+
+func newClient(broker *Broker, conn net.Conn) *client {
+	return &client{
+		broker:  broker,
+		conn:    conn,
+		out:     make(chan packets.ControlPacket, 1000),
+		filters: map[string]bool{},
+	}
+}
+
+func (c *client) match(topic string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for filter := range c.filters {
+		if matchFilter(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) send(p packets.ControlPacket) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	// a slow remote client must not stall the broker
+	select {
+	case c.out <- p:
+	default:
+		log.Printf("Client %s send queue FULL - dropping packet", c.conn.RemoteAddr())
+	}
+}
+
+func (c *client) deliver(msg message, retained bool) {
+	if !c.match(msg.topic) {
+		return
+	}
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = msg.topic
+	p.Payload = msg.payload
+	p.Retain = retained
+	c.send(p)
+}
+
+func (c *client) writer() {
+	for p := range c.out {
+		if err := p.Write(c.conn); err != nil {
+			c.conn.Close()
+			break
+		}
+	}
+	// drain, so senders never block
+	for range c.out {
+	}
+}
+
+func (c *client) run() {
+	go c.writer()
+	defer func() {
+		c.broker.removeReceiver(c)
+		c.conn.Close()
+		c.lock.Lock()
+		c.closed = true
+		close(c.out)
+		c.lock.Unlock()
+	}()
+
+	for {
+		cp, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ack.ReturnCode = packets.Accepted
+			c.send(ack)
+			c.broker.addReceiver(c, func(string) bool { return false }, func([]message) {})
+		case *packets.PublishPacket:
+			c.broker.publish(message{topic: p.TopicName, payload: p.Payload, retained: p.Retain})
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				c.send(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				c.send(rec)
+			}
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			c.send(comp)
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			c.lock.Lock()
+			for _, filter := range p.Topics {
+				c.filters[filter] = true
+				ack.GrantedQoss = append(ack.GrantedQoss, 0)
+			}
+			c.lock.Unlock()
+			c.send(ack)
+			// replay retained messages for the new filters only
+			match := func(topic string) bool {
+				for _, filter := range p.Topics {
+					if matchFilter(filter, topic) {
+						return true
+					}
+				}
+				return false
+			}
+			c.broker.addReceiver(c, match, func(retained []message) {
+				for _, msg := range retained {
+					c.deliver(msg, true)
+				}
+			})
+		case *packets.UnsubscribePacket:
+			c.lock.Lock()
+			for _, filter := range p.Topics {
+				delete(c.filters, filter)
+			}
+			c.lock.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			c.send(ack)
+		case *packets.PingreqPacket:
+			c.send(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
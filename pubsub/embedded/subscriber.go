@@ -0,0 +1,193 @@
+package embedded
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/barnybug/gohome/pubsub"
+)
+
+// queueSize of events each subscription can fall behind by, before events are
+// dropped.
+const queueSize = 1000
+
+// eventChannel is a subscription. Events are queued to it by the broker, and
+// forwarded to C, so a slow consumer only holds up itself.
+type eventChannel struct {
+	C       chan *pubsub.Event
+	topics  []pubsub.Topic
+	name    string
+	queue   chan *pubsub.Event
+	done    chan bool
+	dropped uint64 // atomic
+}
+
+// topicNames of a subscription, as mqtt would subscribe to them.
+func topicNames(topics []pubsub.Topic) string {
+	var names []string
+	for _, topic := range topics {
+		if f, ok := topic.(*pubsub.FilterTopic); ok {
+			topic = f.Topic
+		}
+		switch topic := topic.(type) {
+		case *pubsub.AllTopic:
+			names = append(names, "gohome/#")
+		case *pubsub.ExactTopic:
+			names = append(names, "gohome/"+topic.Exact)
+		case *pubsub.PrefixTopic:
+			names = append(names, "gohome/"+topic.Prefix+"/#")
+		case *pubsub.WildcardTopic:
+			names = append(names, "gohome/"+topic.Pattern)
+		default:
+			names = append(names, fmt.Sprint(topic))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// match on topic alone, ahead of parsing the event
+func (ch *eventChannel) match(topic string) bool {
+	if !strings.HasPrefix(topic, "gohome/") {
+		return false
+	}
+	topic = topic[7:] // skip "gohome/"
+	for _, t := range ch.topics {
+		if t.Match(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ch *eventChannel) matchEvent(topic string, event *pubsub.Event) bool {
+	for _, t := range ch.topics {
+		if pubsub.Matches(t, topic[7:], event) {
+			return true
+		}
+	}
+	return false
+}
+
+func parse(msg message, retained bool) *pubsub.Event {
+	// round trip through the wire format, so each subscriber gets its own copy
+	// of the event with the same field types as from mqtt.
+	event := pubsub.Parse(string(msg.payload), msg.topic[7:])
+	if event != nil {
+		event.SetRetained(retained)
+	}
+	return event
+}
+
+func (ch *eventChannel) deliver(msg message, retained bool) {
+	if !ch.match(msg.topic) {
+		return
+	}
+	event := parse(msg, retained)
+	if event == nil || !ch.matchEvent(msg.topic, event) {
+		return
+	}
+	// never block the broker
+	select {
+	case ch.queue <- event:
+	default:
+		n := atomic.AddUint64(&ch.dropped, 1)
+		if n == 1 || n%100 == 0 {
+			log.Printf("Slow subscriber %s: %d events dropped", ch.name, n)
+		}
+	}
+}
+
+// forward queued events to the consumer, until closed.
+func (ch *eventChannel) forward() {
+	defer close(ch.C)
+	for {
+		select {
+		case event := <-ch.queue:
+			select {
+			case ch.C <- event:
+			case <-ch.done:
+				return
+			}
+		case <-ch.done:
+			return
+		}
+	}
+}
+
+// Subscriber struct
+type Subscriber struct {
+	broker        *Broker
+	channels      map[<-chan *pubsub.Event]*eventChannel
+	lock          sync.Mutex
+	subscriptions int
+	closedDropped uint64
+}
+
+func NewSubscriber(broker *Broker) *Subscriber {
+	return &Subscriber{broker: broker, channels: map[<-chan *pubsub.Event]*eventChannel{}}
+}
+
+func (self *Subscriber) ID() string {
+	return self.broker.Id()
+}
+
+func (self *Subscriber) Subscribe(topics ...pubsub.Topic) <-chan *pubsub.Event {
+	ch := &eventChannel{
+		topics: topics,
+		queue:  make(chan *pubsub.Event, queueSize),
+		done:   make(chan bool),
+	}
+	self.broker.addReceiver(ch, ch.match, func(retained []message) {
+		// size the buffer so retained messages can be queued without blocking
+		ch.C = make(chan *pubsub.Event, 16+len(retained))
+		for _, msg := range retained {
+			if event := parse(msg, true); event != nil && ch.matchEvent(msg.topic, event) {
+				ch.C <- event
+			}
+		}
+	})
+	go ch.forward()
+	self.lock.Lock()
+	// numbered, as several subscriptions may share the same topics
+	self.subscriptions++
+	ch.name = fmt.Sprintf("[%d] %s", self.subscriptions, topicNames(topics))
+	self.channels[ch.C] = ch
+	self.lock.Unlock()
+	return ch.C
+}
+
+func (self *Subscriber) Close(channel <-chan *pubsub.Event) {
+	self.lock.Lock()
+	ch, ok := self.channels[channel]
+	delete(self.channels, channel)
+	if ok {
+		self.closedDropped += atomic.LoadUint64(&ch.dropped)
+	}
+	self.lock.Unlock()
+	if !ok {
+		return
+	}
+	self.broker.removeReceiver(ch)
+	// stops forwarding, which closes C
+	close(ch.done)
+}
+
+// Dropped returns the count of events dropped for slow consumers, by
+// subscription.
+func (self *Subscriber) Dropped() map[string]uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ret := map[string]uint64{}
+	for _, ch := range self.channels {
+		if n := atomic.LoadUint64(&ch.dropped); n > 0 {
+			ret[ch.name] = n
+		}
+	}
+	if self.closedDropped > 0 {
+		ret[pubsub.ClosedSubscriptions] = self.closedDropped
+	}
+	return ret
+}
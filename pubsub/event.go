@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/barnybug/gohome/util"
 	"gopkg.in/yaml.v2"
 )
 
@@ -22,7 +23,7 @@ type Event struct {
 }
 
 func NewEvent(topic string, fields Fields) *Event {
-	timestamp := time.Now().UTC()
+	timestamp := util.Now().UTC()
 	if ts, ok := fields["timestamp"].(string); ok {
 		delete(fields, "timestamp")
 		if t, err := time.Parse(TimeFormat, ts); err == nil {
@@ -33,7 +34,7 @@ func NewEvent(topic string, fields Fields) *Event {
 }
 
 func NewRawEvent(topic string, raw []byte) *Event {
-	timestamp := time.Now().UTC()
+	timestamp := util.Now().UTC()
 	return &Event{Topic: topic, Timestamp: timestamp, Fields: nil, Format: "raw", Raw: raw}
 }
 
@@ -1,6 +1,9 @@
 package pubsub
 
-import "strings"
+import (
+	"path"
+	"strings"
+)
 
 type PrefixTopic struct {
 	Prefix string
@@ -35,3 +38,139 @@ func Exact(exact string) *ExactTopic {
 func (t *ExactTopic) Match(topic string) bool {
 	return t.Exact == topic
 }
+
+// WildcardTopic matches topics mqtt style: '+' matches a single level, '#'
+// matches any remaining levels. Events with a device are published under
+// <topic>/<device>, so "+/light.kitchen" matches all events for a device.
+type WildcardTopic struct {
+	Pattern string
+}
+
+func Wildcard(pattern string) *WildcardTopic {
+	return &WildcardTopic{pattern}
+}
+
+func (t *WildcardTopic) Match(topic string) bool {
+	ps := strings.Split(t.Pattern, "/")
+	ts := strings.Split(topic, "/")
+	for i, p := range ps {
+		if p == "#" {
+			return true
+		}
+		if i >= len(ts) || (p != "+" && p != ts[i]) {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
+
+// EventMatcher is implemented by topics that additionally filter on the
+// fields of the event.
+type EventMatcher interface {
+	MatchEvent(ev *Event) bool
+}
+
+// Matches returns whether ev, received on topic, is matched by t.
+func Matches(t Topic, topic string, ev *Event) bool {
+	if !t.Match(topic) {
+		return false
+	}
+	if m, ok := t.(EventMatcher); ok {
+		return m.MatchEvent(ev)
+	}
+	return true
+}
+
+// FilterTopic matches events on Topic that satisfy all Conditions.
+type FilterTopic struct {
+	Topic      Topic
+	Conditions []EventMatcher
+}
+
+func Filter(topic Topic, conditions ...EventMatcher) *FilterTopic {
+	return &FilterTopic{topic, conditions}
+}
+
+func (t *FilterTopic) Match(topic string) bool {
+	return t.Topic.Match(topic)
+}
+
+func (t *FilterTopic) MatchEvent(ev *Event) bool {
+	if m, ok := t.Topic.(EventMatcher); ok && !m.MatchEvent(ev) {
+		return false
+	}
+	for _, c := range t.Conditions {
+		if !c.MatchEvent(ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// DeviceCondition matches the event device against a glob pattern (eg.
+// "light.*").
+type DeviceCondition struct {
+	Pattern string
+}
+
+func Device(pattern string) *DeviceCondition {
+	return &DeviceCondition{pattern}
+}
+
+func (c *DeviceCondition) MatchEvent(ev *Event) bool {
+	matched, _ := path.Match(c.Pattern, ev.Device())
+	return matched
+}
+
+// Exact returns the device name if the pattern contains no glob characters.
+func (c *DeviceCondition) Exact() (string, bool) {
+	if strings.ContainsAny(c.Pattern, `*?[\`) {
+		return "", false
+	}
+	return c.Pattern, true
+}
+
+// SourceCondition matches events with a source beginning with Prefix (eg.
+// "zigbee.").
+type SourceCondition struct {
+	Prefix string
+}
+
+func SourcePrefix(prefix string) *SourceCondition {
+	return &SourceCondition{prefix}
+}
+
+func (c *SourceCondition) MatchEvent(ev *Event) bool {
+	return strings.HasPrefix(ev.Source(), c.Prefix)
+}
+
+// FieldCondition matches events with the named field present.
+type FieldCondition struct {
+	Name string
+}
+
+func HasField(name string) *FieldCondition {
+	return &FieldCondition{name}
+}
+
+func (c *FieldCondition) MatchEvent(ev *Event) bool {
+	return ev.IsSet(c.Name)
+}
+
+// AnyCondition matches events satisfying any of Conditions.
+type AnyCondition struct {
+	Conditions []EventMatcher
+}
+
+func Any(conditions ...EventMatcher) *AnyCondition {
+	return &AnyCondition{conditions}
+}
+
+func (c *AnyCondition) MatchEvent(ev *Event) bool {
+	for _, m := range c.Conditions {
+		if m.MatchEvent(ev) {
+			return true
+		}
+	}
+	return false
+}
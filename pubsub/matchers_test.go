@@ -0,0 +1,36 @@
+package pubsub
+
+import "fmt"
+
+func ExampleWildcard() {
+	fmt.Println(Wildcard("temp/+").Match("temp/temp.hall"))
+	fmt.Println(Wildcard("temp/+").Match("temp"))
+	fmt.Println(Wildcard("+/light.kitchen").Match("ack/light.kitchen"))
+	fmt.Println(Wildcard("config/#").Match("config"))
+	fmt.Println(Wildcard("config/#").Match("config/automata"))
+	fmt.Println(Wildcard("config").Match("config/automata"))
+	// Output:
+	// true
+	// false
+	// true
+	// true
+	// true
+	// false
+}
+
+func ExampleFilter() {
+	ev := NewEvent("temp", Fields{"device": "temp.hall", "source": "zigbee.0x1234", "temp": 19.5})
+	fmt.Println(Matches(Filter(Prefix("temp"), Device("temp.*")), "temp/temp.hall", ev))
+	fmt.Println(Matches(Filter(Prefix("temp"), Device("light.*")), "temp/temp.hall", ev))
+	fmt.Println(Matches(Filter(All(), SourcePrefix("zigbee."), HasField("temp")), "temp/temp.hall", ev))
+	fmt.Println(Matches(Filter(All(), HasField("humidity")), "temp/temp.hall", ev))
+	fmt.Println(Matches(Filter(All(), Any(HasField("humidity"), HasField("temp"))), "temp/temp.hall", ev))
+	fmt.Println(Matches(Filter(Prefix("power"), Device("temp.*")), "temp/temp.hall", ev))
+	// Output:
+	// true
+	// false
+	// true
+	// false
+	// true
+	// false
+}
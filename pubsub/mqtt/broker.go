@@ -73,6 +73,12 @@ func (self *Broker) Subscriber() pubsub.Subscriber {
 	return self.subscriber
 }
 
+// SetQueueOptions sets the default queue size and overflow policy for
+// subscriptions.
+func (self *Broker) SetQueueOptions(opts pubsub.QueueOptions) {
+	self.subscriber.QueueOptions = opts
+}
+
 func (self *Broker) Publisher() *Publisher {
 	publisher := NewPublisher(self.broker, self.client)
 	return publisher
@@ -1,8 +1,11 @@
 package mqtt
 
 import (
+	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/barnybug/gohome/pubsub"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
@@ -13,20 +16,83 @@ type eventFilter func(*pubsub.Event) bool
 type eventChannel struct {
 	C      chan *pubsub.Event
 	topics []pubsub.Topic
+	name   string
+	opts   pubsub.QueueOptions
+	done   chan bool
+	lock   sync.Mutex
+	closed bool
+}
+
+// offer the event to the channel according to the overflow policy, returning
+// false if it was dropped.
+func (ch *eventChannel) offer(event *pubsub.Event) bool {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if ch.closed {
+		return true
+	}
+	select {
+	case ch.C <- event:
+		return true
+	default:
+	}
+
+	switch ch.opts.Policy {
+	case pubsub.DropOldest:
+		select {
+		case <-ch.C:
+		default:
+		}
+		select {
+		case ch.C <- event:
+		default:
+		}
+		return false
+	case pubsub.DropNewest:
+		return false
+	default:
+		if ch.opts.Timeout == 0 {
+			select {
+			case ch.C <- event:
+			case <-ch.done:
+			}
+			return true
+		}
+		timer := time.NewTimer(ch.opts.Timeout)
+		defer timer.Stop()
+		select {
+		case ch.C <- event:
+			return true
+		case <-ch.done:
+			return true
+		case <-timer.C:
+			return false
+		}
+	}
 }
 
 // Subscriber struct
 type Subscriber struct {
 	broker         *Broker
-	channels       []eventChannel
+	channels       []*eventChannel
 	channelsLock   sync.Mutex
+	subscriptions  int
 	topicCount     map[string]int
 	topicCountLock sync.RWMutex
 	persist        bool
+	QueueOptions   pubsub.QueueOptions
+	dropped        map[string]uint64
+	droppedLock    sync.Mutex
 }
 
 func NewSubscriber(broker *Broker, persist bool) *Subscriber {
-	return &Subscriber{broker: broker, topicCount: map[string]int{}, persist: persist}
+	return &Subscriber{
+		broker:       broker,
+		topicCount:   map[string]int{},
+		persist:      persist,
+		QueueOptions: pubsub.DefaultQueueOptions,
+		dropped:      map[string]uint64{},
+	}
 }
 
 func (self *Subscriber) ID() string {
@@ -41,18 +107,45 @@ func (self *Subscriber) publishHandler(client MQTT.Client, msg MQTT.Message) {
 		return
 	}
 	event.SetRetained(msg.Retained())
+	// deliver outside the lock, so a slow consumer cannot block subscribing
 	self.channelsLock.Lock()
-	// fmt.Printf("Event: %+v\n", event)
-	for _, ch := range self.channels {
+	channels := make([]*eventChannel, len(self.channels))
+	copy(channels, self.channels)
+	self.channelsLock.Unlock()
+
+	for _, ch := range channels {
 		for _, t := range ch.topics {
-			if t.Match(topic) {
-				// fmt.Printf("Sending to: %+v\n", ch.topics)
-				ch.C <- event
+			if pubsub.Matches(t, topic, event) {
+				if !ch.offer(event) {
+					self.drop(ch)
+				}
 				break
 			}
 		}
 	}
-	self.channelsLock.Unlock()
+}
+
+func (self *Subscriber) drop(ch *eventChannel) {
+	self.droppedLock.Lock()
+	self.dropped[ch.name] += 1
+	n := self.dropped[ch.name]
+	self.droppedLock.Unlock()
+	// waiting then dropping is unexpected, so always logged
+	if ch.opts.Policy == pubsub.Block || n == 1 || n%100 == 0 {
+		log.Printf("Slow subscriber %s (%s): %d events dropped", ch.name, ch.opts, n)
+	}
+}
+
+// Dropped returns the count of events dropped for slow consumers, by
+// subscription.
+func (self *Subscriber) Dropped() map[string]uint64 {
+	self.droppedLock.Lock()
+	defer self.droppedLock.Unlock()
+	ret := map[string]uint64{}
+	for k, v := range self.dropped {
+		ret[k] = v
+	}
+	return ret
 }
 
 func (self *Subscriber) connectHandler(client MQTT.Client) {
@@ -84,12 +177,39 @@ func topicToMqtt(topic pubsub.Topic) string {
 		return "gohome/" + topic.Exact
 	case *pubsub.PrefixTopic:
 		return "gohome/" + topic.Prefix + "/#"
+	case *pubsub.WildcardTopic:
+		return "gohome/" + topic.Pattern
+	case *pubsub.FilterTopic:
+		return filterToMqtt(topic)
 	default:
 		log.Panicln("Topic type unsupported")
 	}
 	return ""
 }
 
+// filterToMqtt narrows the subscription for a filter on a single device, which
+// is published under gohome/<topic>/<device>. Other conditions can only be
+// checked once received.
+func filterToMqtt(topic *pubsub.FilterTopic) string {
+	device := ""
+	for _, c := range topic.Conditions {
+		if c, ok := c.(*pubsub.DeviceCondition); ok {
+			if exact, ok := c.Exact(); ok {
+				device = exact
+			}
+		}
+	}
+	if device != "" {
+		switch inner := topic.Topic.(type) {
+		case *pubsub.AllTopic:
+			return "gohome/+/" + device
+		case *pubsub.PrefixTopic:
+			return "gohome/" + inner.Prefix + "/" + device
+		}
+	}
+	return topicToMqtt(topic.Topic)
+}
+
 func topicsToMqtt(topics []pubsub.Topic) []string {
 	var ret []string
 	for _, topic := range topics {
@@ -98,7 +218,7 @@ func topicsToMqtt(topics []pubsub.Topic) []string {
 	return ret
 }
 
-func (self *Subscriber) addChannel(topics []pubsub.Topic) eventChannel {
+func (self *Subscriber) addChannel(opts pubsub.QueueOptions, topics []pubsub.Topic) *eventChannel {
 	// subscribe topics not yet subscribed to
 	subs := map[string]byte{}
 	mqttTopics := topicsToMqtt(topics)
@@ -113,11 +233,16 @@ func (self *Subscriber) addChannel(topics []pubsub.Topic) eventChannel {
 	}
 	self.topicCountLock.Unlock()
 
-	ch := eventChannel{
-		C:      make(chan *pubsub.Event, 16),
+	ch := &eventChannel{
+		C:      make(chan *pubsub.Event, opts.Size),
 		topics: topics,
+		opts:   opts,
+		done:   make(chan bool),
 	}
 	self.channelsLock.Lock()
+	// numbered, as several subscriptions may share the same topics
+	self.subscriptions++
+	ch.name = fmt.Sprintf("[%d] %s", self.subscriptions, strings.Join(mqttTopics, ","))
 	self.channels = append(self.channels, ch)
 	self.channelsLock.Unlock()
 
@@ -132,33 +257,57 @@ func (self *Subscriber) addChannel(topics []pubsub.Topic) eventChannel {
 }
 
 func (self *Subscriber) Subscribe(topics ...pubsub.Topic) <-chan *pubsub.Event {
-	ch := self.addChannel(topics)
+	return self.SubscribeQueue(self.QueueOptions, topics...)
+}
+
+// SubscribeQueue subscribes with specific queue size and overflow policy.
+func (self *Subscriber) SubscribeQueue(opts pubsub.QueueOptions, topics ...pubsub.Topic) <-chan *pubsub.Event {
+	ch := self.addChannel(opts, topics)
 	return ch.C
 }
 
 func (self *Subscriber) Close(channel <-chan *pubsub.Event) {
-	var channels []eventChannel
+	var channels []*eventChannel
+	var closing []*eventChannel
+	self.channelsLock.Lock()
 	for _, ch := range self.channels {
 		if channel == chan *pubsub.Event(ch.C) {
-			for _, topic := range ch.topics {
-				t := topicToMqtt(topic)
-				self.topicCountLock.Lock()
-				self.topicCount[t] -= 1
-				current := self.topicCount[t]
-				self.topicCountLock.Unlock()
-				if current == 0 {
-					// fmt.Printf("Unsubscribe: %+v\n", topicName(topic))
-					if token := self.broker.client.Unsubscribe(t); token.Wait() && token.Error() != nil {
-						log.Println("Error unsubscribing:", token.Error())
-					}
-				}
-			}
-			close(ch.C)
+			closing = append(closing, ch)
 		} else {
 			channels = append(channels, ch)
 		}
 	}
-	self.channelsLock.Lock()
 	self.channels = channels
 	self.channelsLock.Unlock()
+
+	for _, ch := range closing {
+		for _, topic := range ch.topics {
+			t := topicToMqtt(topic)
+			self.topicCountLock.Lock()
+			self.topicCount[t] -= 1
+			current := self.topicCount[t]
+			if current == 0 {
+				delete(self.topicCount, t)
+			}
+			self.topicCountLock.Unlock()
+			if current == 0 {
+				// fmt.Printf("Unsubscribe: %+v\n", topicName(topic))
+				if token := self.broker.client.Unsubscribe(t); token.Wait() && token.Error() != nil {
+					log.Println("Error unsubscribing:", token.Error())
+				}
+			}
+		}
+		self.droppedLock.Lock()
+		if n, ok := self.dropped[ch.name]; ok {
+			delete(self.dropped, ch.name)
+			self.dropped[pubsub.ClosedSubscriptions] += n
+		}
+		self.droppedLock.Unlock()
+		// unblock any delivery in progress, then close
+		close(ch.done)
+		ch.lock.Lock()
+		ch.closed = true
+		close(ch.C)
+		ch.lock.Unlock()
+	}
 }
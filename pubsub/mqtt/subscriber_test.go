@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleTopicToMqtt() {
+	fmt.Println(topicToMqtt(pubsub.All()))
+	fmt.Println(topicToMqtt(pubsub.Prefix("temp")))
+	fmt.Println(topicToMqtt(pubsub.Exact("config")))
+	fmt.Println(topicToMqtt(pubsub.Wildcard("+/light.kitchen")))
+	fmt.Println(topicToMqtt(pubsub.Filter(pubsub.Prefix("temp"), pubsub.Device("temp.hall"))))
+	fmt.Println(topicToMqtt(pubsub.Filter(pubsub.All(), pubsub.Device("temp.hall"))))
+	fmt.Println(topicToMqtt(pubsub.Filter(pubsub.Prefix("temp"), pubsub.Device("temp.*"))))
+	fmt.Println(topicToMqtt(pubsub.Filter(pubsub.All(), pubsub.SourcePrefix("zigbee."))))
+	// Output:
+	// gohome/#
+	// gohome/temp/#
+	// gohome/config
+	// gohome/+/light.kitchen
+	// gohome/temp/temp.hall
+	// gohome/+/temp.hall
+	// gohome/temp/#
+	// gohome/#
+}
+
+func newTestChannel(policy pubsub.OverflowPolicy) *eventChannel {
+	return &eventChannel{
+		C:    make(chan *pubsub.Event, 2),
+		opts: pubsub.QueueOptions{Size: 2, Policy: policy, Timeout: 10 * time.Millisecond},
+		done: make(chan bool),
+	}
+}
+
+func testEvent(n int) *pubsub.Event {
+	return pubsub.NewEvent("test", pubsub.Fields{"n": float64(n)})
+}
+
+func TestOfferDropNewest(t *testing.T) {
+	ch := newTestChannel(pubsub.DropNewest)
+	assert.True(t, ch.offer(testEvent(1)))
+	assert.True(t, ch.offer(testEvent(2)))
+	assert.False(t, ch.offer(testEvent(3)))
+	assert.Equal(t, int64(1), (<-ch.C).IntField("n"))
+	assert.Equal(t, int64(2), (<-ch.C).IntField("n"))
+}
+
+func TestOfferDropOldest(t *testing.T) {
+	ch := newTestChannel(pubsub.DropOldest)
+	assert.True(t, ch.offer(testEvent(1)))
+	assert.True(t, ch.offer(testEvent(2)))
+	assert.False(t, ch.offer(testEvent(3)))
+	assert.Equal(t, int64(2), (<-ch.C).IntField("n"))
+	assert.Equal(t, int64(3), (<-ch.C).IntField("n"))
+}
+
+func TestOfferBlockTimeout(t *testing.T) {
+	ch := newTestChannel(pubsub.Block)
+	assert.True(t, ch.offer(testEvent(1)))
+	assert.True(t, ch.offer(testEvent(2)))
+	go func() {
+		time.Sleep(time.Millisecond)
+		<-ch.C
+	}()
+	assert.True(t, ch.offer(testEvent(3)))
+	assert.False(t, ch.offer(testEvent(4)))
+}
+
+func TestOfferBlock(t *testing.T) {
+	ch := newTestChannel(pubsub.Block)
+	ch.opts.Timeout = 0
+	assert.True(t, ch.offer(testEvent(1)))
+	assert.True(t, ch.offer(testEvent(2)))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-ch.C
+	}()
+	// waits as long as it takes
+	assert.True(t, ch.offer(testEvent(3)))
+	assert.Len(t, ch.C, 2)
+}
+
+func TestDropped(t *testing.T) {
+	sub := NewSubscriber(nil, false)
+	// already subscribed with the broker
+	sub.topicCount["gohome/#"] = 1
+	ch1 := sub.addChannel(pubsub.DefaultQueueOptions, []pubsub.Topic{pubsub.All()})
+	ch2 := sub.addChannel(pubsub.DefaultQueueOptions, []pubsub.Topic{pubsub.All()})
+	sub.drop(ch1)
+	sub.drop(ch1)
+	sub.drop(ch2)
+	assert.Equal(t, map[string]uint64{"[1] gohome/#": 2, "[2] gohome/#": 1}, sub.Dropped())
+
+	// closed subscriptions are totalled
+	sub.Close(ch1.C)
+	assert.Equal(t, map[string]uint64{pubsub.ClosedSubscriptions: 2, "[2] gohome/#": 1}, sub.Dropped())
+}
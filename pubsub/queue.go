@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverflowPolicy decides what happens to an event when a subscription's queue
+// is full.
+type OverflowPolicy int
+
+const (
+	// Block waits up to the timeout for space (or indefinitely without one),
+	// then drops the event.
+	Block OverflowPolicy = iota
+	// DropOldest discards the oldest queued event to make space.
+	DropOldest
+	// DropNewest discards the incoming event.
+	DropNewest
+)
+
+var policyNames = map[OverflowPolicy]string{
+	Block:      "block",
+	DropOldest: "drop-oldest",
+	DropNewest: "drop-newest",
+}
+
+func (p OverflowPolicy) String() string {
+	return policyNames[p]
+}
+
+// QueueOptions for a subscription.
+type QueueOptions struct {
+	Size    int
+	Policy  OverflowPolicy
+	Timeout time.Duration
+}
+
+// DefaultQueueOptions blocks delivery for a while for the subscriber to catch
+// up, so one stuck subscriber can't stall the rest indefinitely.
+var DefaultQueueOptions = QueueOptions{Size: 16, Policy: Block, Timeout: 5 * time.Second}
+
+func (o QueueOptions) String() string {
+	if o.Policy == Block && o.Timeout > 0 {
+		return fmt.Sprintf("%s,%d,%s", o.Policy, o.Size, o.Timeout)
+	}
+	return fmt.Sprintf("%s,%d", o.Policy, o.Size)
+}
+
+// ParseQueueOptions parses "policy[,size[,timeout]]", eg. "drop-oldest,64" or
+// "block,16,2s". Omitted values are taken from DefaultQueueOptions.
+func ParseQueueOptions(s string) (QueueOptions, error) {
+	opts := DefaultQueueOptions
+	ps := strings.Split(s, ",")
+	found := false
+	for policy, name := range policyNames {
+		if ps[0] == name {
+			opts.Policy = policy
+			found = true
+		}
+	}
+	if !found {
+		return opts, fmt.Errorf("unknown overflow policy: %s", ps[0])
+	}
+	if len(ps) > 1 {
+		size, err := strconv.Atoi(ps[1])
+		if err != nil || size < 1 {
+			return opts, fmt.Errorf("invalid queue size: %s", ps[1])
+		}
+		opts.Size = size
+	}
+	if len(ps) > 2 {
+		timeout, err := time.ParseDuration(ps[2])
+		if err != nil {
+			return opts, err
+		}
+		opts.Timeout = timeout
+	}
+	return opts, nil
+}
+
+// QueueSubscriber is implemented by subscribers that support per subscription
+// queue options.
+type QueueSubscriber interface {
+	SubscribeQueue(opts QueueOptions, topics ...Topic) <-chan *Event
+}
+
+// DropCounter is implemented by subscribers that count the events dropped by
+// slow consumers, by subscription.
+type DropCounter interface {
+	Dropped() map[string]uint64
+}
+
+// ClosedSubscriptions totals the events dropped by subscriptions since
+// closed, so they aren't kept individually.
+const ClosedSubscriptions = "closed subscriptions"
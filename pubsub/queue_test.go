@@ -0,0 +1,17 @@
+package pubsub
+
+import "fmt"
+
+func ExampleParseQueueOptions() {
+	fmt.Println(ParseQueueOptions("drop-oldest,64"))
+	fmt.Println(ParseQueueOptions("block,16,2s"))
+	fmt.Println(ParseQueueOptions("drop-newest"))
+	fmt.Println(ParseQueueOptions("block"))
+	fmt.Println(ParseQueueOptions("drop-all"))
+	// Output:
+	// drop-oldest,64 <nil>
+	// block,16,2s <nil>
+	// drop-newest,16 <nil>
+	// block,16,5s <nil>
+	// block,16,5s unknown overflow policy: drop-all
+}
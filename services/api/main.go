@@ -8,15 +8,29 @@
 //
 // http://localhost:8723/devices/control?id=device&control=0 - turn a device on or off
 //
+// http://localhost:8723/devices/control?id=group:lights&command=off - command every device in a group (or room:kitchen)
+//
 // http://localhost:8723/devices/<devicename> - single device with events
 //
 // http://localhost:8723/heating/status - get the status of heating
 //
 // http://localhost:8723/heating/set?temp=20&until=1h - set heating to 'temp' until 'until'
 //
+// http://localhost:8723/history/<devicename>?since=24h&until=...&topic=temp&limit=100 - recorded events of a device
+//
+// http://localhost:8723/scenes - configured scenes
+//
+// http://localhost:8723/scenes/<name>/apply - POST to apply a scene
+//
+// http://localhost:8723/scenes/<name>/capture?devices=light.kitchen,light.hall&name=...&location=... - add a scene of the current state of devices to the config
+//
+// http://localhost:8723/automata/<name>/trace - recent transitions of an automaton, with the triggering event, matching condition and actions
+//
 // http://localhost:8723/events/feed - continuous live stream of events (line delimited)
 //
-// http://localhost:8723/query/{query} - query a service, e.g. http://localhost:8723/query/heating/status
+// http://localhost:8723/events/feed?topics=temp,%2B/light.kitchen&device=light.* - stream filtered by topics (mqtt wildcards allowed) and device glob
+//
+// http://localhost:8723/query/{query} - query a service, e.g. http://localhost:8723/query/heating/status (or POST a form, for large arguments)
 //
 // http://localhost:8723/logs - stream logs, until disconnect
 //
@@ -31,6 +45,7 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -64,6 +79,16 @@ func badRequest(w http.ResponseWriter, err error) {
 	http.Error(w, err.Error(), http.StatusBadRequest)
 }
 
+// requirePost of requests that change state, responding with an error if not.
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
 type VarsHandler func(http.ResponseWriter, *http.Request, map[string]string)
 
 func (h VarsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -106,7 +131,12 @@ func query(endpoint string, q string, timeout int64, responses int64, w http.Res
 
 func apiQuery(w http.ResponseWriter, r *http.Request) {
 	endpoint := r.URL.Path[len("/query/"):]
-	qvals := r.URL.Query()
+	// arguments too large for a url (eg. a document) may be POSTed
+	if err := r.ParseForm(); err != nil {
+		badRequest(w, err)
+		return
+	}
+	qvals := r.Form
 	q := qvals.Get("q")
 	timeout, err := strconv.ParseInt(qvals.Get("timeout"), 10, 32)
 	if err != nil {
@@ -198,28 +228,35 @@ func apiDevicesSingle(w http.ResponseWriter, r *http.Request, params map[string]
 
 func apiDevicesControl(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
-	device := q.Get("id")
-	matches := services.MatchDevices(device)
+	target := q.Get("id")
+	matches := services.MatchTarget(target)
 	if len(matches) == 0 {
 		badRequest(w, errors.New("device not found"))
 		return
 	}
-	if len(matches) > 1 {
+	group := services.GroupTarget(target)
+	if len(matches) > 1 && !group {
 		badRequest(w, errors.New("device is ambiguous"))
 		return
 	}
-	device = matches[0]
 
 	// send command
-	fields := pubsub.Fields{
-		"topic":  "command",
-		"device": device,
-	}
-	ev := pubsub.NewEvent("command", fields)
+	fields := pubsub.Fields{}
 	for key, values := range q {
-		ev.SetField(key, util.ParseArg(values[0]))
+		if key != "id" {
+			fields[key] = util.ParseArg(values[0])
+		}
+	}
+	result, err := services.SendCommand(target, fields)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	if group {
+		// per device results
+		jsonResponse(w, result)
+		return
 	}
-	services.Publisher.Emit(ev)
 	jsonResponse(w, true)
 }
 
@@ -244,22 +281,161 @@ func apiHeatingSet(w http.ResponseWriter, r *http.Request) {
 	query("heating/ch", arg, DefaultQueryTimeout, 1, w)
 }
 
-func apiEventsFeed(w http.ResponseWriter, r *http.Request) {
+func apiHistory(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	q := r.URL.Query()
-	topics := q.Get("topics")
-	w.Header().Add("Content-Type", "application/json; boundary=NL")
+	// values are escaped, so can't add arguments
+	args := []string{"device=" + url.PathEscape(params["device"])}
+	for _, name := range []string{"topic", "since", "until", "limit"} {
+		if value := q.Get(name); value != "" {
+			args = append(args, fmt.Sprintf("%s=%s", name, url.PathEscape(value)))
+		}
+	}
+	queryJson(w, "history/history "+strings.Join(args, " "), 5*time.Second, "history")
+}
 
-	var ch <-chan *pubsub.Event
-	if topics != "" {
-		topics := strings.Split(topics, ",")
-		var subs []pubsub.Topic
-		for _, t := range topics {
-			subs = append(subs, pubsub.Prefix(t))
+// queryJson responds with the json of a service's answer to query, or its
+// message as an error if it has none.
+func queryJson(w http.ResponseWriter, query string, timeout time.Duration, what string) {
+	ch := services.QueryChannel(query, timeout)
+	ev, ok := <-ch
+	if !ok {
+		errorResponse(w, fmt.Errorf("timeout waiting for %s", what))
+		return
+	}
+	ret, ok := ev.Fields["json"]
+	if !ok {
+		// error message
+		badRequest(w, errors.New(ev.StringField("message")))
+		return
+	}
+	jsonResponse(w, ret)
+}
+
+func apiAutomataTrace(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	queryJson(w, "automata/trace "+params["name"], 5*time.Second, "automata")
+}
+
+// zigbeeQuery answers with the result of a zigbee bridge operation.
+func zigbeeQuery(w http.ResponseWriter, query string, timeout time.Duration) {
+	queryJson(w, "zigbee/"+query, timeout, "zigbee")
+}
+
+func apiZigbeeJoin(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	zigbeeQuery(w, "join "+r.URL.Query().Get("time"), 15*time.Second)
+}
+
+func apiZigbeeNetworkmap(w http.ResponseWriter, r *http.Request) {
+	zigbeeQuery(w, "networkmap", 90*time.Second)
+}
+
+func apiZigbeeDevice(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	device := params["device"]
+	operation := params["operation"]
+	if operation == "rename" || operation == "remove" || operation == "update" {
+		if !requirePost(w, r) {
+			return
 		}
-		ch = services.Subscriber.Subscribe(subs...)
-	} else {
-		ch = services.Subscriber.Subscribe(pubsub.All())
 	}
+	switch operation {
+	case "rename":
+		to := r.URL.Query().Get("to")
+		if to == "" {
+			badRequest(w, errors.New("to parameter required"))
+			return
+		}
+		zigbeeQuery(w, fmt.Sprintf("rename %s %s", device, to), 15*time.Second)
+	case "remove":
+		query := "remove " + device
+		if r.URL.Query().Get("force") == "true" {
+			query += " force"
+		}
+		zigbeeQuery(w, query, 15*time.Second)
+	case "update":
+		zigbeeQuery(w, "update "+device, 90*time.Second)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func apiScenes(w http.ResponseWriter, r *http.Request) {
+	scenes := services.Config.Scenes
+	if scenes == nil {
+		scenes = map[string]config.SceneConf{}
+	}
+	jsonResponse(w, scenes)
+}
+
+func apiSceneApply(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !requirePost(w, r) {
+		return
+	}
+	if err := services.SendScene(params["name"]); err != nil {
+		badRequest(w, err)
+		return
+	}
+	jsonResponse(w, true)
+}
+
+// apiSceneCapture adds a scene of the current state of devices to the config.
+func apiSceneCapture(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !requirePost(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("devices") == "" {
+		badRequest(w, errors.New("devices parameter required"))
+		return
+	}
+	scene := config.SceneConf{
+		Name:     q.Get("name"),
+		Location: q.Get("location"),
+		Devices:  map[string]string{},
+	}
+	for _, device := range strings.Split(q.Get("devices"), ",") {
+		if _, ok := services.Config.Devices[device]; !ok {
+			badRequest(w, fmt.Errorf("device not found: %s", device))
+			return
+		}
+		command, ok := config.CaptureCommand(DeviceState[device])
+		if !ok {
+			badRequest(w, fmt.Errorf("no state for device: %s", device))
+			return
+		}
+		scene.Devices[device] = command
+	}
+
+	current, ok := configurations["config"]
+	if !ok || len(current) == 0 {
+		errorResponse(w, errors.New("config not yet received"))
+		return
+	}
+	data, err := config.AddScene(current, params["name"], scene)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	// secrets are resolved by each service, so may not be available here
+	resolver := *config.DefaultResolver
+	resolver.Lenient = true
+	if _, problems := resolver.Check(data); problems.Err() != nil {
+		errorResponse(w, problems.Err())
+		return
+	}
+	services.SendConfig("config", data, r.RemoteAddr, "api")
+	log.Printf("Captured scene %s", params["name"])
+	jsonResponse(w, scene)
+}
+
+func apiEventsFeed(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	w.Header().Add("Content-Type", "application/json; boundary=NL")
+
+	// a slow http client should lose events, rather than hold up others
+	opts := pubsub.QueueOptions{Size: 256, Policy: pubsub.DropOldest}
+	ch := services.SubscribeQueue(opts, feedTopics(q.Get("topics"), q.Get("device"))...)
 	defer services.Subscriber.Close(ch)
 
 	for ev := range ch {
@@ -276,6 +452,27 @@ func apiEventsFeed(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func feedTopics(topics string, device string) []pubsub.Topic {
+	var subs []pubsub.Topic
+	if topics != "" {
+		for _, t := range strings.Split(topics, ",") {
+			if strings.ContainsAny(t, "+#") {
+				subs = append(subs, pubsub.Wildcard(t))
+			} else {
+				subs = append(subs, pubsub.Prefix(t))
+			}
+		}
+	} else {
+		subs = append(subs, pubsub.All())
+	}
+	if device != "" {
+		for i, sub := range subs {
+			subs[i] = pubsub.Filter(sub, pubsub.Device(device))
+		}
+	}
+	return subs
+}
+
 func convertJSON(v interface{}) interface{} {
 	// convert json unfriendly types to json friendly.
 	switch t := v.(type) {
@@ -325,15 +522,8 @@ func apiConfig(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		sout := data
-		if string(sout) != string(value) {
-			// emit event
-			fields := pubsub.Fields{
-				"config": sout,
-			}
-			ev := pubsub.NewEvent(path, fields)
-			ev.SetRetained(true) // config messages are retained
-			services.Publisher.Emit(ev)
+		if string(data) != string(value) {
+			services.SendConfig(path, data, r.RemoteAddr, "api")
 			log.Printf("%s changed, emitted config event", path)
 		}
 	}
@@ -342,7 +532,8 @@ func apiConfig(w http.ResponseWriter, r *http.Request) {
 func apiLogs(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json; boundary=NL")
 
-	ch := services.Subscriber.Subscribe(pubsub.Prefix("log"))
+	opts := pubsub.QueueOptions{Size: 256, Policy: pubsub.DropOldest}
+	ch := services.SubscribeQueue(opts, pubsub.Prefix("log"))
 	defer services.Subscriber.Close(ch)
 	for ev := range ch {
 		_, err := fmt.Fprintf(w, "%s\r\n", ev)
@@ -363,6 +554,14 @@ func router() *mux.Router {
 	router.Handle("/devices/{device}", VarsHandler(apiDevicesSingle))
 	router.Path("/heating/status").HandlerFunc(apiHeatingStatus)
 	router.Path("/heating/set").HandlerFunc(apiHeatingSet)
+	router.Handle("/history/{device}", VarsHandler(apiHistory))
+	router.Handle("/automata/{name}/trace", VarsHandler(apiAutomataTrace))
+	router.Path("/scenes").HandlerFunc(apiScenes)
+	router.Handle("/scenes/{name}/apply", VarsHandler(apiSceneApply))
+	router.Handle("/scenes/{name}/capture", VarsHandler(apiSceneCapture))
+	router.Path("/zigbee/join").HandlerFunc(apiZigbeeJoin)
+	router.Path("/zigbee/networkmap").HandlerFunc(apiZigbeeNetworkmap)
+	router.Handle("/zigbee/devices/{device}/{operation}", VarsHandler(apiZigbeeDevice))
 	router.Path("/events/feed").HandlerFunc(apiEventsFeed)
 	router.Path("/config").HandlerFunc(apiConfig)
 	router.Path("/logs").HandlerFunc(apiLogs)
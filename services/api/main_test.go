@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
 	"github.com/barnybug/gohome/pubsub/dummy"
 	"github.com/barnybug/gohome/services"
 )
@@ -70,3 +71,127 @@ func TestDevicesControlMissing(t *testing.T) {
 	apiDevicesControl(rec, &r)
 	assert.Equal(t, rec.Body.String(), "device not found\n")
 }
+
+func TestFeedTopics(t *testing.T) {
+	ev := pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hall"})
+	subs := feedTopics("", "")
+	assert.Equal(t, []pubsub.Topic{pubsub.All()}, subs)
+
+	subs = feedTopics("temp,+/light.kitchen", "")
+	assert.True(t, subs[0].Match("temp/temp.hall"))
+	assert.True(t, subs[1].Match("ack/light.kitchen"))
+	assert.False(t, subs[1].Match("ack/light.hall"))
+
+	subs = feedTopics("", "temp.*")
+	assert.True(t, pubsub.Matches(subs[0], "temp/temp.hall", ev))
+	subs = feedTopics("", "light.*")
+	assert.False(t, pubsub.Matches(subs[0], "temp/temp.hall", ev))
+}
+
+func TestSceneApply(t *testing.T) {
+	services.Config = config.ExampleConfig
+	me := dummy.Publisher{}
+	services.Publisher = &me
+	rec := httptest.NewRecorder()
+	apiSceneApply(rec, &http.Request{Method: "GET"}, map[string]string{"name": "movie"})
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, 0, len(me.Events))
+
+	rec = httptest.NewRecorder()
+	apiSceneApply(rec, &http.Request{Method: "POST"}, map[string]string{"name": "movie"})
+	assert.Equal(t, "true\n", rec.Body.String())
+	assert.Equal(t, 2, len(me.Events))
+
+	rec = httptest.NewRecorder()
+	apiSceneApply(rec, &http.Request{Method: "POST"}, map[string]string{"name": "missing"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestSceneCapture(t *testing.T) {
+	services.Config = config.ExampleConfig
+	me := dummy.Publisher{}
+	services.Publisher = &me
+	configurations["config"] = []byte(config.ExampleYaml)
+	DeviceState["light.glowworm"] = map[string]*pubsub.Event{
+		"ack": pubsub.NewEvent("ack", pubsub.Fields{"device": "light.glowworm", "command": "on", "level": 60}),
+	}
+	rec := httptest.NewRecorder()
+	uri, _ := url.Parse("http://example.com/?devices=light.glowworm&name=Reading")
+	apiSceneCapture(rec, &http.Request{Method: "GET", URL: uri}, map[string]string{"name": "reading"})
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	apiSceneCapture(rec, &http.Request{Method: "POST", URL: uri}, map[string]string{"name": "reading"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"Name":"Reading","Location":"","Devices":{"light.glowworm":"on level=60"}}
+`, rec.Body.String())
+	// configured event, then the updated config
+	assert.Equal(t, 2, len(me.Events))
+	conf, err := config.OpenRaw(me.Events[1].Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, "on level=60", conf.Scenes["reading"].Devices["light.glowworm"])
+	assert.Equal(t, "on level=20", conf.Scenes["movie"].Devices["light.glowworm"])
+}
+
+func TestSceneCaptureInvalid(t *testing.T) {
+	services.Config = config.ExampleConfig
+	me := dummy.Publisher{}
+	services.Publisher = &me
+	DeviceState["light.glowworm"] = map[string]*pubsub.Event{
+		"ack": pubsub.NewEvent("ack", pubsub.Fields{"device": "light.glowworm", "command": "on"}),
+	}
+	uri, _ := url.Parse("http://example.com/?devices=light.glowworm")
+	capture := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		apiSceneCapture(rec, &http.Request{Method: "POST", URL: uri}, map[string]string{"name": "reading"})
+		return rec
+	}
+
+	// nothing to add the scene to
+	delete(configurations, "config")
+	rec := capture()
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "config not yet received\n", rec.Body.String())
+
+	// not publishing invalid config
+	configurations["config"] = []byte("devices:\n  light.glowworm: {}\n  glowworm: {}\n")
+	rec = capture()
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Empty(t, me.Events)
+}
+
+func TestDevicesControlGroup(t *testing.T) {
+	services.Config = config.ExampleConfig
+	me := dummy.Publisher{}
+	services.Publisher = &me
+	rec := httptest.NewRecorder()
+	uri, _ := url.Parse("http://example.com/?id=group:downstairs&command=off")
+	r := http.Request{URL: uri}
+	apiDevicesControl(rec, &r)
+	assert.Equal(t, `{"sent":["light.glowworm","light.kitchen"]}
+`, rec.Body.String())
+	assert.Equal(t, 2, len(me.Events))
+}
+
+func TestZigbeeRenameMissing(t *testing.T) {
+	rec := httptest.NewRecorder()
+	uri, _ := url.Parse("http://example.com/zigbee/devices/sensor.door/rename")
+	r := http.Request{Method: "POST", URL: uri}
+	apiZigbeeDevice(rec, &r, map[string]string{"device": "sensor.door", "operation": "rename"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "to parameter required\n", rec.Body.String())
+}
+
+func TestZigbeeRequirePost(t *testing.T) {
+	uri, _ := url.Parse("http://example.com/zigbee/devices/sensor.door/remove")
+	r := http.Request{Method: "GET", URL: uri}
+	rec := httptest.NewRecorder()
+	apiZigbeeDevice(rec, &r, map[string]string{"device": "sensor.door", "operation": "remove"})
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "POST", rec.Header().Get("Allow"))
+
+	uri, _ = url.Parse("http://example.com/zigbee/join?time=120")
+	r = http.Request{Method: "GET", URL: uri}
+	rec = httptest.NewRecorder()
+	apiZigbeeJoin(rec, &r)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
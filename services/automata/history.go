@@ -0,0 +1,178 @@
+package automata
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/util"
+)
+
+// Bounds of the history kept of each device and topic.
+const (
+	historySize = 256
+	historyAge  = 24 * time.Hour
+)
+
+// eventHistory is a bounded in-memory history of events by device and topic,
+// for the aggregate when functions.
+type eventHistory map[string]map[string][]*pubsub.Event
+
+var history = eventHistory{}
+
+func (self eventHistory) add(ev *pubsub.Event) {
+	topics, ok := self[ev.Device()]
+	if !ok {
+		topics = map[string][]*pubsub.Event{}
+		self[ev.Device()] = topics
+	}
+	cutoff := util.Now().Add(-historyAge)
+	evs := append(topics[ev.Topic], ev)
+	i := 0
+	for i < len(evs)-1 && (len(evs)-i > historySize || evs[i].Timestamp.Before(cutoff)) {
+		i++
+	}
+	topics[ev.Topic] = evs[i:]
+}
+
+// within returns the events of a device (all topics if topic is "") since t,
+// oldest first per topic.
+func (self eventHistory) within(device, topic string, t time.Time) []*pubsub.Event {
+	var ret []*pubsub.Event
+	for tp, evs := range self[device] {
+		if topic != "" && tp != topic {
+			continue
+		}
+		for _, ev := range evs {
+			if !ev.Timestamp.Before(t) {
+				ret = append(ret, ev)
+			}
+		}
+	}
+	return ret
+}
+
+func seconds(f float64) time.Duration {
+	return time.Duration(f * float64(time.Second))
+}
+
+func numeric(ev *pubsub.Event, field string) (float64, bool) {
+	switch v := ev.Fields[field].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// samples of a numeric field of a device since t, oldest first.
+func samples(device, field string, t time.Time) []float64 {
+	var latest []*pubsub.Event
+	for _, ev := range history.within(device, "", t) {
+		if _, ok := numeric(ev, field); ok {
+			latest = append(latest, ev)
+		}
+	}
+	sort.SliceStable(latest, func(i, j int) bool {
+		return latest[i].Timestamp.Before(latest[j].Timestamp)
+	})
+	var ret []float64
+	for _, ev := range latest {
+		v, _ := numeric(ev, field)
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// Since(device, topic) is the seconds since the last event.
+func Since(args ...interface{}) (interface{}, error) {
+	if err := checkArguments(args, "string", "string"); err != nil {
+		return nil, err
+	}
+	device := args[0].(string)
+	topic := args[1].(string)
+	event, ok := deviceState[device][topic]
+	if !ok {
+		return nil, fmt.Errorf("Since(): no event for device '%s' topic '%s' found", device, topic)
+	}
+	return util.Now().Sub(event.Timestamp).Seconds(), nil
+}
+
+// Changed(device, field, seconds) is how much a numeric field has changed
+// over the last seconds, eg. Changed('sensor.bathroom', 'humidity', 600) > 5
+func Changed(args ...interface{}) (interface{}, error) {
+	if err := checkArguments(args, "string", "string", "float64"); err != nil {
+		return nil, err
+	}
+	device := args[0].(string)
+	field := args[1].(string)
+	vs := samples(device, field, util.Now().Add(-seconds(args[2].(float64))))
+	if len(vs) == 0 {
+		return nil, fmt.Errorf("Changed(): no '%s' values for device '%s' found", field, device)
+	}
+	return vs[len(vs)-1] - vs[0], nil
+}
+
+// Average(device, field, seconds) is the mean of a numeric field over the
+// last seconds.
+func Average(args ...interface{}) (interface{}, error) {
+	if err := checkArguments(args, "string", "string", "float64"); err != nil {
+		return nil, err
+	}
+	device := args[0].(string)
+	field := args[1].(string)
+	vs := samples(device, field, util.Now().Add(-seconds(args[2].(float64))))
+	if len(vs) == 0 {
+		return nil, fmt.Errorf("Average(): no '%s' values for device '%s' found", field, device)
+	}
+	total := 0.0
+	for _, v := range vs {
+		total += v
+	}
+	return total / float64(len(vs)), nil
+}
+
+// Count(topic, seconds, [device]) is the number of events of topic over the
+// last seconds, eg. Count('door', 300, 'door.front') >= 3
+func Count(args ...interface{}) (interface{}, error) {
+	if err := checkArguments(args, "string", "float64", "..."); err != nil {
+		return nil, err
+	}
+	topic := args[0].(string)
+	t := util.Now().Add(-seconds(args[1].(float64)))
+	devices := []string{}
+	if len(args) > 2 {
+		device, ok := args[2].(string)
+		if !ok {
+			return nil, fmt.Errorf("Count(): expected string device, but got %v", args[2])
+		}
+		devices = append(devices, device)
+	} else {
+		for device := range history {
+			devices = append(devices, device)
+		}
+	}
+	n := 0
+	for _, device := range devices {
+		n += len(history.within(device, topic, t))
+	}
+	return float64(n), nil
+}
+
+// InState(automaton, state, seconds) is true if the automaton has been in
+// state for at least seconds.
+func InState(args ...interface{}) (interface{}, error) {
+	if err := checkArguments(args, "string", "string", "float64"); err != nil {
+		return nil, err
+	}
+	name := args[0].(string)
+	aut, ok := automata.Automaton[name]
+	if !ok {
+		return nil, fmt.Errorf("InState(): automata '%s' not found", name)
+	}
+	return aut.State.Name == args[1].(string) && util.Now().Sub(aut.Since) >= seconds(args[2].(float64)), nil
+}
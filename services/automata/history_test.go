@@ -0,0 +1,117 @@
+package automata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services/sim"
+	"github.com/barnybug/gohome/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func record(at time.Time, topic string, fields pubsub.Fields) {
+	ev := pubsub.NewEvent(topic, fields)
+	ev.Timestamp = at
+	deviceState[ev.Device()] = map[string]*pubsub.Event{topic: ev}
+	history.add(ev)
+}
+
+func TestAggregateFunctions(t *testing.T) {
+	now := time.Date(2020, 1, 6, 19, 0, 0, 0, time.UTC)
+	defer func(c util.Clock) { util.DefaultClock = c }(util.DefaultClock)
+	util.DefaultClock = util.NewVirtualClock(now)
+	history = eventHistory{}
+
+	for i, humidity := range []float64{60, 62, 65, 70} {
+		record(now.Add(time.Duration(i-3)*5*time.Minute), "humidity", pubsub.Fields{"device": "sensor.bathroom", "humidity": humidity})
+	}
+	for _, ago := range []time.Duration{10 * time.Minute, 4 * time.Minute, 2 * time.Minute, 30 * time.Second} {
+		record(now.Add(-ago), "door", pubsub.Fields{"device": "door.front", "command": "open"})
+	}
+	record(now.Add(-time.Minute), "door", pubsub.Fields{"device": "door.back", "command": "open"})
+
+	v, err := Since("door.back", "door")
+	assert.NoError(t, err)
+	assert.Equal(t, 60.0, v)
+	_, err = Since("door.back", "temp")
+	assert.Error(t, err)
+
+	v, _ = Changed("sensor.bathroom", "humidity", 600)
+	assert.Equal(t, 8.0, v)
+	v, _ = Changed("sensor.bathroom", "humidity", 3600)
+	assert.Equal(t, 10.0, v)
+	_, err = Changed("sensor.bathroom", "temp", 600)
+	assert.Error(t, err)
+
+	v, _ = Average("sensor.bathroom", "humidity", 300)
+	assert.Equal(t, 67.5, v)
+
+	v, _ = Count("door", 300, "door.front")
+	assert.Equal(t, 3.0, v)
+	v, _ = Count("door", 300)
+	assert.Equal(t, 4.0, v)
+	_, err = Count("door", 300, 1)
+	assert.Error(t, err)
+
+	evHumid := NewEventContext(validateService(), pubsub.NewEvent("humidity", pubsub.Fields{"device": "sensor.bathroom"}))
+	assert.True(t, evHumid.Match("Changed('sensor.bathroom', 'humidity', 600) > 4 && Count('door', 300, 'door.front') >= 3"))
+}
+
+func TestHistoryRetained(t *testing.T) {
+	history = eventHistory{}
+	start := time.Date(2020, 1, 6, 19, 0, 0, 0, time.UTC)
+	h := sim.New(start)
+	h.Config("devices:\n  door.front:\n    name: Front\n")
+	h.Retain(pubsub.NewRawEvent("config/automata", []byte(traceYaml)))
+	h.Retain(pubsub.NewEvent("door", pubsub.Fields{"device": "door.front", "command": "open"}))
+	assert.NoError(t, h.Start(&Service{}))
+	defer h.Close()
+	h.Inject(pubsub.NewEvent("door", pubsub.Fields{"device": "door.front", "command": "open"}))
+
+	// the retained event is state, not history
+	v, _ := Count("door", 300)
+	assert.Equal(t, 1.0, v)
+	assert.Equal(t, "open", deviceState["door.front"]["door"].Command())
+}
+
+func TestHistoryBounded(t *testing.T) {
+	now := time.Date(2020, 1, 6, 19, 0, 0, 0, time.UTC)
+	defer func(c util.Clock) { util.DefaultClock = c }(util.DefaultClock)
+	util.DefaultClock = util.NewVirtualClock(now)
+	h := eventHistory{}
+
+	old := pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hall"})
+	old.Timestamp = now.Add(-25 * time.Hour)
+	h.add(old)
+	for i := 0; i < historySize+10; i++ {
+		ev := pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hall", "temp": float64(i)})
+		h.add(ev)
+	}
+	evs := h["temp.hall"]["temp"]
+	assert.Len(t, evs, historySize)
+	assert.Equal(t, 10.0, evs[0].FloatField("temp"))
+}
+
+func TestInState(t *testing.T) {
+	service := validateService()
+	current, _, err := service.compile([]byte(porchYaml))
+	assert.NoError(t, err)
+	running := automata
+	automata = current
+	defer func() { automata = running }()
+
+	now := time.Now()
+	defer func(c util.Clock) { util.DefaultClock = c }(util.DefaultClock)
+	util.DefaultClock = util.NewVirtualClock(now)
+	automata.Automaton["porch"].Since = now.Add(-time.Minute)
+
+	v, _ := InState("porch", "Off", 30)
+	assert.Equal(t, true, v)
+	v, _ = InState("porch", "Off", 120)
+	assert.Equal(t, false, v)
+	v, _ = InState("porch", "On", 0)
+	assert.Equal(t, false, v)
+	_, err = InState("garage", "On", 0)
+	assert.Error(t, err)
+}
@@ -25,13 +25,30 @@
 //
 // An example of the configuration is available in the gohome github repository.
 //
+// Conditions ('when') can use the functions:
+//
+//	State(automaton)                 - current state
+//	Value(device, topic, field)      - field of the last event
+//	Since(device, topic)             - seconds since the last event
+//	Changed(device, field, seconds)  - change in a numeric field over seconds
+//	Average(device, field, seconds)  - mean of a numeric field over seconds
+//	Count(topic, seconds, [device])  - number of events over seconds
+//	InState(automaton, state, seconds) - in state for at least seconds
+//
+// Actions include Command('light.porch on'), Scene('movie'),
+// StartTimer('porch', 300), Alert(...), etc. Command also takes group:<group>
+// and room:<room> targets, eg. Command('room:kitchen off'), to command every
+// device in the group or room.
+//
+// The aggregates use a bounded in-memory history (last day, up to 256 events
+// per device and topic).
+//
 // For more details on the configuration format, see:
 //
 // http://godoc.org/github.com/barnybug/gofsm
 package automata
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"log"
@@ -42,7 +59,6 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/Knetic/govaluate"
@@ -58,13 +74,17 @@ type Functions map[string]govaluate.ExpressionFunction
 
 // Service automata
 type Service struct {
-	timers            map[string]*time.Timer
+	timers            map[string]*pendingTimer
+	fired             chan *pendingTimer
+	trace             *tracer
 	config            *services.ConfigService
 	automataConfig    *services.ConfigWaiter
 	whenFunctions     Functions
 	actionFunctions   Functions
 	restoredAutomaton map[string]bool
 	rand              *rand.Rand
+	restoreTimer      *util.Timer
+	clock             *util.Scheduler
 }
 
 var automata *gofsm.Automata
@@ -78,6 +98,8 @@ func (self *Service) ID() string {
 type EventContext struct {
 	service *Service
 	event   *pubsub.Event
+	// traced transition of the automaton processing the event
+	transition *Transition
 }
 
 func (c EventContext) Get(name string) (interface{}, error) {
@@ -103,7 +125,7 @@ func (c EventContext) Get(name string) (interface{}, error) {
 }
 
 func NewEventContext(service *Service, event *pubsub.Event) EventContext {
-	return EventContext{service, event}
+	return EventContext{service: service, event: event}
 }
 
 func State(args ...interface{}) (interface{}, error) {
@@ -148,8 +170,13 @@ var parsingCache = map[string]*govaluate.EvaluableExpression{}
 func (self *Service) defineFunctions() {
 	// govaluate functions
 	self.whenFunctions = map[string]govaluate.ExpressionFunction{
-		"State": State,
-		"Value": Value,
+		"Average": Average,
+		"Changed": Changed,
+		"Count":   Count,
+		"InState": InState,
+		"Since":   Since,
+		"State":   State,
+		"Value":   Value,
 	}
 	self.actionFunctions = map[string]govaluate.ExpressionFunction{
 		"Alert":       self.Alert,
@@ -160,6 +187,7 @@ func (self *Service) defineFunctions() {
 		"PhotoAlert":  self.PhotoAlert,
 		"Query":       self.Query,
 		"RandomTimer": self.RandomTimer,
+		"Scene":       self.Scene,
 		"Script":      self.Script,
 		"Snapshot":    self.Snapshot,
 		"StartTimer":  self.StartTimer,
@@ -195,38 +223,51 @@ func (self EventContext) Match(when string) bool {
 	if !ok {
 		log.Printf("Expression didn't evaluate to boolean '%s'", when)
 	}
+	if result.(bool) && self.transition != nil {
+		self.transition.When = when
+	}
 	return result.(bool)
 }
 
 func (self EventContext) String() string {
-	s := self.event.Device()
-	for k, v := range self.event.Fields {
-		if k == "device" {
-			continue
+	var keys []string
+	for k := range self.event.Fields {
+		if k != "device" {
+			keys = append(keys, k)
 		}
-		s += fmt.Sprintf(" %s=%v", k, v)
+	}
+	sort.Strings(keys)
+	s := self.event.Device()
+	for _, k := range keys {
+		s += fmt.Sprintf(" %s=%v", k, self.event.Fields[k])
 	}
 	return s
 }
 
 func (self *Service) QueryHandlers() services.QueryHandlers {
 	return services.QueryHandlers{
-		"status": services.TextHandler(self.queryStatus),
-		"switch": services.TextHandler(self.querySwitch),
-		"script": services.TextHandler(self.queryScript),
-		"state":  services.TextHandler(self.queryState),
+		"status":   services.TextHandler(self.queryStatus),
+		"switch":   services.TextHandler(self.querySwitch),
+		"script":   services.TextHandler(self.queryScript),
+		"state":    services.TextHandler(self.queryState),
+		"validate": services.TextHandler(self.queryValidate),
+		"trace":    self.queryTrace,
+		"scene":    services.TextHandler(self.queryScene),
 		"help": services.StaticHandler("" +
 			"status: get status\n" +
 			"switch device on|off: switch device\n" +
 			"logs: get recent event logs\n" +
 			"script: run a script\n" +
-			"state: get or set automaton state"),
+			"state: get or set automaton state\n" +
+			"validate [yaml]: check automata config, showing changes\n" +
+			"trace automaton: recent transitions and why\n" +
+			"scene [name]: list scenes, or apply a scene"),
 	}
 }
 
 func (self *Service) queryStatus(q services.Question) string {
 	var out string
-	now := time.Now()
+	now := util.Now()
 	var keys []string
 	for k := range automata.Automaton {
 		keys = append(keys, k)
@@ -265,7 +306,7 @@ func (self *Service) queryState(q services.Question) string {
 	}
 	if len(args) == 1 {
 		// getting state
-		now := time.Now()
+		now := util.Now()
 		du := util.ShortDuration(now.Sub(aut.Since))
 		return fmt.Sprintf("%s: %s for %s\n", args[0], aut.State.Name, du)
 	} else {
@@ -276,6 +317,8 @@ func (self *Service) queryState(q services.Question) string {
 		}
 		dummy := pubsub.NewEvent("user", pubsub.Fields{})
 		event := NewEventContext(self, dummy)
+		event.transition = &Transition{Time: util.Now(), Automaton: args[0], From: aut.State.Name, To: args[1], Event: "state query from " + q.From}
+		self.trace.add(event.transition)
 		aut.ChangeState(args[1], event)
 		return fmt.Sprintf("Change %s state to %s", args[0], args[1])
 	}
@@ -300,6 +343,15 @@ func (self *Service) querySwitch(q services.Question) string {
 	}
 	args := strings.Split(q.Args, " ")
 	name := args[0]
+	if services.GroupTarget(name) {
+		command, fields := parseArgs(args[1:])
+		fields["command"] = command
+		result, err := services.SendCommand(name, fields)
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("Switched %s %s: %s", name, command, result)
+	}
 	matches := services.MatchDevices(name)
 	if len(matches) == 0 {
 		return fmt.Sprintf("device %s not found", name)
@@ -335,6 +387,47 @@ func sendCommand(args []string) {
 	services.Publisher.Emit(ev)
 }
 
+func (self *Service) queryScene(q services.Question) string {
+	name := strings.TrimSpace(q.Args)
+	if name == "" {
+		scenes := services.Config.Scenes
+		var names []string
+		for name := range scenes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := ""
+		for _, name := range names {
+			out += fmt.Sprintf("%s: %s (%d devices)\n", name, scenes[name].Name, len(scenes[name].Devices))
+		}
+		if out == "" {
+			return "No scenes configured"
+		}
+		return out
+	}
+	if err := services.SendScene(name); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Applied scene %s", name)
+}
+
+func (self *Service) queryTrace(q services.Question) services.Answer {
+	name := strings.TrimSpace(q.Args)
+	if _, ok := automata.Automaton[name]; !ok {
+		return services.Answer{Text: fmt.Sprintf("automata: '%s' not found", name)}
+	}
+	transitions := self.trace.get(name)
+	text := fmt.Sprintf("%s: %d transitions", name, len(transitions))
+	for _, t := range transitions {
+		text += "\n" + t.String()
+	}
+	return services.Answer{Text: text, Json: transitions}
+}
+
+func (self *Service) queryValidate(q services.Question) string {
+	return self.validate([]byte(q.Args))
+}
+
 func (self *Service) queryScript(q services.Question) string {
 	output, err := script(q.Args)
 	if err != nil {
@@ -362,67 +455,11 @@ func (m MultiError) Error() string {
 }
 
 func (self *Service) loadAutomata() error {
-	value := string(self.automataConfig.Value)
-	tmpl := template.New("Automata")
-	tmpl, err := tmpl.Parse(value)
-	if err != nil {
-		return err
-	}
-	context := map[string]interface{}{
-		"devices": self.config.Value.Devices,
-	}
-
-	wr := new(bytes.Buffer)
-	err = tmpl.Execute(wr, context)
+	updated, cache, err := self.compile(self.automataConfig.Value)
 	if err != nil {
 		return err
 	}
-	generated := wr.Bytes()
-	updated, err := gofsm.Load(generated)
-	if err != nil {
-		return err
-	}
-
-	// precompile expressions
-	errors := MultiError{}
-	parsingCache = map[string]*govaluate.EvaluableExpression{}
-	for _, aut := range updated.Automaton {
-		for _, transition := range aut.Transitions {
-			for _, t := range transition {
-				_, err := self.ParseCached(t.When, self.whenFunctions)
-				if err != nil {
-					errors = append(errors, err)
-				}
-
-				for _, action := range t.Actions {
-					_, err := self.ParseCached(action, self.actionFunctions)
-					if err != nil {
-						errors = append(errors, err)
-					}
-				}
-			}
-		}
-
-		for _, state := range aut.States {
-			for _, action := range state.Entering {
-				_, err := self.ParseCached(action, self.actionFunctions)
-				if err != nil {
-					errors = append(errors, err)
-				}
-			}
-			for _, action := range state.Leaving {
-				_, err := self.ParseCached(action, self.actionFunctions)
-				if err != nil {
-					errors = append(errors, err)
-				}
-			}
-		}
-	}
-
-	if len(errors) > 0 {
-		return errors
-	}
-
+	parsingCache = cache
 	automata = updated
 	return nil
 }
@@ -472,13 +509,14 @@ func (self *Service) performAction(action gofsm.Action) {
 	// rewrite expressions to add implicit 'context' first parameter
 	// Might do away with this.
 	code = strings.Replace(code, "(", "(context, ", 1)
+	e := action.Trigger.(EventContext)
 	expr, err := self.ParseCached(code, self.actionFunctions)
 	if err != nil {
 		log.Println("Error parsing action:", err)
+		self.trace.action(e.transition, action.Name, err)
 		return
 	}
 
-	e := action.Trigger.(EventContext)
 	params := map[string]interface{}{
 		"context": ChangeContext{e.event, action.Change},
 	}
@@ -487,6 +525,7 @@ func (self *Service) performAction(action gofsm.Action) {
 	if err != nil {
 		log.Printf("Error action '%s': %s", action.Name, err)
 	}
+	self.trace.action(e.transition, action.Name, err)
 }
 
 func (self *Service) stateRestored() {
@@ -501,6 +540,10 @@ func (self *Service) stateRestored() {
 }
 
 func changeState(change gofsm.Change) {
+	if aut, ok := automata.Automaton[change.Automaton]; ok && aut.State.Name == change.New {
+		// gofsm stamps with the wall clock
+		aut.Since = util.Now()
+	}
 	s := fmt.Sprintf("%-17s %s->%s", "["+change.Automaton+"]", change.Old, change.New)
 	log.Printf("%-40s (event: %s)", s, change.Trigger)
 	// emit event
@@ -520,66 +563,125 @@ func publishState(device, state, trigger string) {
 
 func (self *Service) Init() error {
 	self.defineFunctions()
+	self.timers = map[string]*pendingTimer{}
+	self.fired = make(chan *pendingTimer, 32)
+	self.trace = newTracer()
+	self.restoredAutomaton = map[string]bool{}
+	self.rand = rand.New(rand.NewSource(util.Now().UnixNano()))
 	self.config = services.WaitForConfig()
 	self.automataConfig = services.NewConfigWaiter(pubsub.Exact("config/automata"))
 	// wait for first automata config
 	self.automataConfig.Wait()
 	// watch for further changes
 	go self.automataConfig.Watch()
+	self.restoreTimer = util.NewTimer(time.Second * 5)
+	self.clock = util.NewScheduler(time.Duration(0), time.Minute)
 	// load templated automata
 	return self.loadAutomata()
 }
 
+func (self *Service) Topics() []pubsub.Topic {
+	return []pubsub.Topic{pubsub.All()}
+}
+
+// HandleEvent sends relevant events to the automata.
+func (self *Service) HandleEvent(ev *pubsub.Event) {
+	if ev.Topic == "pending" {
+		if ev.Retained {
+			self.restorePending(ev)
+		}
+		return
+	}
+	if strings.HasPrefix(ev.Topic, "pending/") {
+		// cleared pending timer
+		return
+	}
+	if ev.Topic == "command" {
+		handleCommand(ev)
+		// ignore direct commands - ack/homeeasy events indicate commands completing.
+		return
+	}
+
+	if ev.Device() == "" {
+		// For dumb devices only emitting "source"
+		services.Config.AddDeviceToEvent(ev)
+	}
+
+	// keep event values for reference in other conditions
+	if ev.Device() != "" {
+		if _, ok := deviceState[ev.Device()]; !ok {
+			deviceState[ev.Device()] = make(map[string]*pubsub.Event)
+		}
+		deviceState[ev.Device()][ev.Topic] = ev
+		if !ev.Retained {
+			// replayed on every reconnect, so would be counted again
+			history.add(ev)
+		}
+	}
+
+	if ev.Retained {
+		if ev.Topic == "state" {
+			self.restoreState(ev)
+		}
+		// ignore retained events from reconnecting
+		return
+	}
+	if ev.Topic == "state" && ev.StringField("trigger") == "initial" {
+		// ignore initial state events
+		return
+	}
+
+	// each automaton gets its own context, to trace the transition
+	for name, aut := range automata.Automaton {
+		event := NewEventContext(self, ev)
+		event.transition = &Transition{Automaton: name, From: aut.State.Name, Event: event.String()}
+		aut.Process(event)
+		if event.transition.When != "" {
+			event.transition.Time = util.Now()
+			event.transition.To = aut.State.Name
+			self.trace.add(event.transition)
+		}
+	}
+}
+
+// Tick handles any pending changes, actions and timers, without blocking.
+func (self *Service) Tick() {
+	for {
+		select {
+		case change := <-automata.Changes:
+			changeState(change)
+		case action := <-automata.Actions:
+			self.performAction(action)
+		case p := <-self.fired:
+			self.timerFired(p)
+		case <-self.restoreTimer.C:
+			self.stateRestored()
+		case tick := <-self.clock.C:
+			emitClock(tick)
+		default:
+			return
+		}
+	}
+}
+
+func emitClock(tick time.Time) {
+	fields := pubsub.Fields{"device": "clock"}
+	ev := pubsub.NewEvent("clock", fields)
+	ev.Timestamp = tick.UTC()
+	services.Publisher.Emit(ev)
+}
+
 // Run the service
 func (self *Service) Run() error {
-	self.timers = map[string]*time.Timer{}
-	self.restoredAutomaton = map[string]bool{}
-	self.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
-
 	// setup channels
-	ch := services.Subscriber.Subscribe(pubsub.All())
+	ch := services.Subscriber.Subscribe(self.Topics()...)
 	defer services.Subscriber.Close(ch)
-	stateRestored := time.NewTimer(time.Second * 5)
 	earth := earthChannel()
-	clock := util.NewScheduler(time.Duration(0), time.Minute)
 
 	for {
 		select {
 		case ev := <-ch:
-			if ev.Topic == "command" {
-				handleCommand(ev)
-				// ignore direct commands - ack/homeeasy events indicate commands completing.
-				continue
-			}
-
-			if ev.Device() == "" {
-				// For dumb devices only emitting "source"
-				services.Config.AddDeviceToEvent(ev)
-			}
-
-			// keep event values for reference in other conditions
-			if ev.Device() != "" {
-				if _, ok := deviceState[ev.Device()]; !ok {
-					deviceState[ev.Device()] = make(map[string]*pubsub.Event)
-				}
-				deviceState[ev.Device()][ev.Topic] = ev
-			}
-
-			if ev.Retained {
-				if ev.Topic == "state" {
-					self.restoreState(ev)
-				}
-				// ignore retained events from reconnecting
-				continue
-			}
-			if ev.Topic == "state" && ev.StringField("trigger") == "initial" {
-				// ignore initial state events
-				continue
-			}
-
-			// send relevant events to the automata
-			event := NewEventContext(self, ev)
-			automata.Process(event)
+			self.HandleEvent(ev)
 
 		case change := <-automata.Changes:
 			changeState(change)
@@ -587,6 +689,9 @@ func (self *Service) Run() error {
 		case action := <-automata.Actions:
 			self.performAction(action)
 
+		case p := <-self.fired:
+			self.timerFired(p)
+
 		case <-self.automataConfig.Updated:
 			// template changed
 			self.reloadAutomata()
@@ -595,7 +700,7 @@ func (self *Service) Run() error {
 			// template results potentially changed
 			self.reloadAutomata()
 
-		case <-stateRestored.C:
+		case <-self.restoreTimer.C:
 			// all retained State has been restored. Persist any missing State initial states.
 			self.stateRestored()
 
@@ -604,11 +709,8 @@ func (self *Service) Run() error {
 			ev := pubsub.NewEvent("earth",
 				pubsub.Fields{"device": "earth", "command": tev.Event})
 			services.Publisher.Emit(ev)
-		case tick := <-clock.C:
-			fields := pubsub.Fields{"device": "clock"}
-			ev := pubsub.NewEvent("clock", fields)
-			ev.Timestamp = tick.UTC()
-			services.Publisher.Emit(ev)
+		case tick := <-self.clock.C:
+			emitClock(tick)
 		}
 	}
 }
@@ -630,7 +732,7 @@ type ChangeContext struct {
 func (c ChangeContext) Get(name string) (interface{}, bool) {
 	device := c.event.Device()
 	d := services.Config.Devices[device]
-	now := time.Now()
+	now := util.Now()
 	switch name {
 	case "id":
 		return d.Id, true
@@ -833,6 +935,18 @@ func (self *Service) Command(args ...interface{}) (interface{}, error) {
 	text := args[1].(string)
 	text = context.Format(text)
 	argv := strings.Split(text, " ")
+	if services.GroupTarget(argv[0]) {
+		command, fields := parseArgs(argv[1:])
+		fields["command"] = command
+		result, err := services.SendCommand(argv[0], fields)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Failed) > 0 {
+			return nil, fmt.Errorf("Command(): %s", result)
+		}
+		return nil, nil
+	}
 	sendCommand(argv)
 	return nil, nil
 }
@@ -872,17 +986,8 @@ func (self *Service) Snapshot(args ...interface{}) (interface{}, error) {
 
 func (self *Service) startTimerEvent(name string, d float64, ev *pubsub.Event) {
 	// log.Printf("Starting timer: %s for %.1fs", name, d)
-	duration := time.Duration(d) * time.Second
-	if timer, ok := self.timers[name]; ok {
-		// cancel any existing
-		timer.Stop()
-	}
-
-	timer := time.AfterFunc(duration, func() {
-		ev.Timestamp = time.Now().UTC()
-		services.Publisher.Emit(ev)
-	})
-	self.timers[name] = timer
+	deadline := util.Now().Add(time.Duration(d) * time.Second)
+	publishPending(self.armTimer(name, deadline, ev))
 }
 
 func (self *Service) startTimer(name string, d float64) {
@@ -910,9 +1015,7 @@ func (self *Service) StopTimer(args ...interface{}) (interface{}, error) {
 		return nil, err
 	}
 	name := args[1].(string)
-	if timer, ok := self.timers[name]; ok {
-		timer.Stop()
-	}
+	self.stopTimer(name)
 	return nil, nil
 }
 
@@ -931,6 +1034,14 @@ func (self *Service) RandomTimer(args ...interface{}) (interface{}, error) {
 	return nil, nil
 }
 
+func (self *Service) Scene(args ...interface{}) (interface{}, error) {
+	if err := checkArguments(args, "", "string"); err != nil {
+		return nil, err
+	}
+	name := args[1].(string)
+	return nil, services.SendScene(name)
+}
+
 func (self *Service) Flux(args ...interface{}) (interface{}, error) {
 	if err := checkArguments(args, "", "string", "..."); err != nil {
 		return nil, err
@@ -9,6 +9,7 @@ import (
 	"github.com/barnybug/gohome/pubsub"
 	"github.com/barnybug/gohome/pubsub/dummy"
 	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/services/sim"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,6 +23,7 @@ var (
 
 func ExampleInterfaces() {
 	var _ services.Service = (*Service)(nil)
+	var _ sim.Service = (*Service)(nil)
 	var _ services.Queryable = (*Service)(nil)
 	// Output:
 }
@@ -129,7 +131,8 @@ func TestCommand(t *testing.T) {
 
 func TestStartTimer(t *testing.T) {
 	services.Publisher = &dummy.Publisher{}
-	service.timers = map[string]*time.Timer{}
+	service.timers = map[string]*pendingTimer{}
+	service.fired = make(chan *pendingTimer, 32)
 	context := testChangeContext()
 
 	_, err := service.StartTimer(context, "command", "a")
@@ -0,0 +1,109 @@
+package automata
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
+)
+
+// Pending timers (StartTimer, RandomTimer, Delay) are persisted as retained
+// events, like automaton states, so they survive restarts:
+//
+//	gohome/pending/timer.porch {"deadline": "...", "event": {...}}
+//
+// They're re-armed on startup, firing straight away if the deadline passed
+// while the service was down.
+type pendingTimer struct {
+	name     string
+	deadline time.Time
+	event    *pubsub.Event
+	timer    *util.Timer
+}
+
+func pendingTopic(name string) string {
+	return "pending/timer." + name
+}
+
+func publishPending(p *pendingTimer) {
+	fields := pubsub.Fields{
+		"device":   "timer." + p.name,
+		"deadline": p.deadline.UTC().Format(pubsub.TimeFormat),
+		"event":    p.event.Map(),
+	}
+	ev := pubsub.NewEvent("pending", fields)
+	ev.SetRetained(true)
+	services.Publisher.Emit(ev)
+}
+
+func clearPending(name string) {
+	// an empty retained message clears the topic
+	ev := pubsub.NewRawEvent(pendingTopic(name), []byte{})
+	ev.SetRetained(true)
+	services.Publisher.Emit(ev)
+}
+
+// armTimer fires the event at the deadline, through the service loop.
+func (self *Service) armTimer(name string, deadline time.Time, ev *pubsub.Event) *pendingTimer {
+	if p, ok := self.timers[name]; ok {
+		// cancel any existing
+		p.timer.Stop()
+	}
+	d := deadline.Sub(util.Now())
+	if d < 0 {
+		d = 0
+	}
+	p := &pendingTimer{name: name, deadline: deadline, event: ev}
+	p.timer = util.AfterFunc(d, func() {
+		self.fired <- p
+	})
+	self.timers[name] = p
+	return p
+}
+
+func (self *Service) timerFired(p *pendingTimer) {
+	if self.timers[p.name] != p {
+		// stopped or restarted since
+		return
+	}
+	delete(self.timers, p.name)
+	clearPending(p.name)
+	p.event.Timestamp = util.Now().UTC()
+	services.Publisher.Emit(p.event)
+}
+
+func (self *Service) stopTimer(name string) {
+	if p, ok := self.timers[name]; ok {
+		p.timer.Stop()
+		delete(self.timers, name)
+		clearPending(name)
+	}
+}
+
+// restorePending re-arms a retained pending timer, unless it's been started
+// again since.
+func (self *Service) restorePending(ev *pubsub.Event) {
+	name := strings.TrimPrefix(ev.Device(), "timer.")
+	if _, ok := self.timers[name]; ok {
+		return
+	}
+	deadline, err := time.Parse(pubsub.TimeFormat, ev.StringField("deadline"))
+	fields, ok := ev.Fields["event"].(map[string]interface{})
+	if err != nil || !ok {
+		log.Printf("Invalid pending timer %s: %s", name, ev)
+		clearPending(name)
+		return
+	}
+	topic, _ := fields["topic"].(string)
+	payload := pubsub.Fields{}
+	for k, v := range fields {
+		if k != "topic" {
+			payload[k] = v
+		}
+	}
+	self.armTimer(name, deadline, pubsub.NewEvent(topic, payload))
+	log.Printf("Restored timer %s: due %s", name, deadline.Local().Format(time.RFC3339))
+}
@@ -0,0 +1,87 @@
+package automata
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// transitions kept per automaton
+const traceSize = 20
+
+// Transition of an automaton, with why it happened and what it did.
+type Transition struct {
+	Time      time.Time      `json:"time"`
+	Automaton string         `json:"automaton"`
+	From      string         `json:"from"`
+	To        string         `json:"to"`
+	Event     string         `json:"event"`
+	When      string         `json:"when,omitempty"`
+	Actions   []TracedAction `json:"actions"`
+}
+
+type TracedAction struct {
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (t Transition) String() string {
+	s := fmt.Sprintf("%s %s->%s: %s", t.Time.Local().Format("Jan _2 15:04:05"), t.From, t.To, t.Event)
+	if t.When != "" {
+		s += "\n  when: " + t.When
+	}
+	for _, a := range t.Actions {
+		s += "\n  action: " + a.Action
+		if a.Error != "" {
+			s += " error: " + a.Error
+		}
+	}
+	return s
+}
+
+// tracer keeps a ring buffer of recent transitions of each automaton. Actions
+// are added as they're performed, after the transition.
+type tracer struct {
+	lock        sync.Mutex
+	transitions map[string][]*Transition
+}
+
+func newTracer() *tracer {
+	return &tracer{transitions: map[string][]*Transition{}}
+}
+
+func (self *tracer) add(t *Transition) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ts := append(self.transitions[t.Automaton], t)
+	if len(ts) > traceSize {
+		ts = ts[len(ts)-traceSize:]
+	}
+	self.transitions[t.Automaton] = ts
+}
+
+func (self *tracer) action(t *Transition, action string, err error) {
+	if t == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	a := TracedAction{Action: action}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	t.Actions = append(t.Actions, a)
+}
+
+// get a copy of the transitions of an automaton, oldest first.
+func (self *tracer) get(name string) []Transition {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var ret []Transition
+	for _, t := range self.transitions[name] {
+		c := *t
+		c.Actions = append([]TracedAction{}, t.Actions...)
+		ret = append(ret, c)
+	}
+	return ret
+}
@@ -0,0 +1,56 @@
+package automata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/services/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+var traceYaml = `
+porch:
+  start: Off
+  states:
+    Off:
+      entering:
+      - Command('light.porch off')
+    On:
+      entering:
+      - Command('light.porch on')
+  transitions:
+    Off->On:
+    - when: device=='pir.hall' && command=='on'
+      actions:
+      - StartTimer('porch', 300)
+    On->Off:
+    - when: device=='timer.porch'
+`
+
+func TestTrace(t *testing.T) {
+	start := time.Date(2020, 1, 6, 19, 0, 30, 0, time.UTC)
+	h := sim.New(start)
+	h.Config("devices:\n  light.porch:\n    name: Porch\n  pir.hall:\n    name: Hall\n")
+	h.Retain(pubsub.NewRawEvent("config/automata", []byte(traceYaml)))
+	service := &Service{}
+	assert.NoError(t, h.Start(service))
+	defer h.Close()
+
+	h.Inject(pubsub.NewEvent("pir", pubsub.Fields{"device": "pir.hall", "command": "on"}))
+	h.Advance(5 * time.Minute)
+
+	answer := service.QueryHandlers()["trace"](services.Question{Args: "porch"})
+	stamp := func(d time.Duration) string {
+		return start.Add(d).Local().Format("Jan _2 15:04:05")
+	}
+	assert.Equal(t, "porch: 2 transitions\n"+
+		stamp(0)+" Off->On: pir.hall command=on\n"+
+		"  when: device=='pir.hall' && command=='on'\n"+
+		"  action: StartTimer('porch', 300)\n"+
+		"  action: Command('light.porch on')\n"+
+		stamp(5*time.Minute)+" On->Off: timer.porch command=on\n"+
+		"  when: device=='timer.porch'\n"+
+		"  action: Command('light.porch off')", answer.Text)
+}
@@ -0,0 +1,324 @@
+package automata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/Knetic/govaluate"
+	"github.com/barnybug/gofsm"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// compile the automata config template, and parse every expression with the
+// service's functions. Nothing is changed in the running service. Errors are
+// located by line in the template, not the yaml generated.
+func (self *Service) compile(value []byte) (*gofsm.Automata, map[string]*govaluate.EvaluableExpression, error) {
+	tmpl, err := template.New("Automata").Parse(string(value))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range tmpl.Templates() {
+		markLines(t.Tree.Root, string(value))
+	}
+	context := map[string]interface{}{
+		"devices": self.config.Value.Devices,
+	}
+	wr := new(bytes.Buffer)
+	err = tmpl.Execute(wr, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	generated, lines := unmarkLines(wr.Bytes())
+	updated, err := gofsm.Load(generated)
+	if err != nil {
+		return nil, nil, lines.error(err)
+	}
+
+	// precompile expressions, located by line
+	var root yaml3.Node
+	if err := yaml3.Unmarshal(generated, &root); err != nil {
+		return nil, nil, lines.error(err)
+	}
+	errors := MultiError{}
+	cache := map[string]*govaluate.EvaluableExpression{}
+	failed := map[string]bool{}
+	parse := func(node *yaml3.Node, path string, functions Functions) {
+		if _, ok := cache[node.Value]; ok || failed[node.Value] {
+			// seen, perhaps by an alias
+			return
+		}
+		expr, err := govaluate.NewEvaluableExpressionWithFunctions(node.Value, functions)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("line %d: %s: Bad expression '%s': %s", lines.source(node.Line), path, node.Value, err))
+			failed[node.Value] = true
+			return
+		}
+		cache[node.Value] = expr
+	}
+	forEach(&root, func(name string, aut *yaml3.Node) {
+		forEach(mapValue(aut, "states"), func(state string, s *yaml3.Node) {
+			for _, kind := range []string{"entering", "leaving"} {
+				for i, action := range items(mapValue(s, kind)) {
+					parse(action, fmt.Sprintf("%s.states.%s.%s[%d]", name, state, kind, i), self.actionFunctions)
+				}
+			}
+		})
+		forEach(mapValue(aut, "transitions"), func(trans string, t *yaml3.Node) {
+			for i, step := range items(t) {
+				path := fmt.Sprintf("%s.transitions.%s[%d]", name, trans, i)
+				if when := mapValue(step, "when"); when != nil {
+					parse(when, path+".when", self.whenFunctions)
+				}
+				for j, action := range items(mapValue(step, "actions")) {
+					parse(action, fmt.Sprintf("%s.actions[%d]", path, j), self.actionFunctions)
+				}
+			}
+		})
+	})
+	if len(errors) > 0 {
+		return nil, nil, errors
+	}
+	return updated, cache, nil
+}
+
+// lineMark delimits a source line number marked in the generated yaml.
+const lineMark = "\x00"
+
+var lineMarkRe = regexp.MustCompile(lineMark + `(\d+)` + lineMark)
+
+// markLines of the template text with their line in the source, so the yaml
+// generated can be traced back to it, even through ranges.
+func markLines(node parse.Node, source string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			markLines(c, source)
+		}
+	case *parse.TextNode:
+		line := 1 + strings.Count(source[:n.Pos], "\n")
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%s%d%s", lineMark, line, lineMark)
+		for _, l := range bytes.SplitAfter(n.Text, []byte("\n")) {
+			b.Write(l)
+			if bytes.HasSuffix(l, []byte("\n")) {
+				line++
+				fmt.Fprintf(&b, "%s%d%s", lineMark, line, lineMark)
+			}
+		}
+		n.Text = b.Bytes()
+	case *parse.IfNode:
+		markLines(n.List, source)
+		markLines(n.ElseList, source)
+	case *parse.RangeNode:
+		markLines(n.List, source)
+		markLines(n.ElseList, source)
+	case *parse.WithNode:
+		markLines(n.List, source)
+		markLines(n.ElseList, source)
+	}
+}
+
+// sourceLines maps lines of the generated yaml to the template's.
+type sourceLines []int
+
+// unmarkLines strips the line marks from the yaml generated, returning the
+// source line of each line.
+func unmarkLines(marked []byte) ([]byte, sourceLines) {
+	var out bytes.Buffer
+	var lines sourceLines
+	current := 0
+	for _, l := range bytes.SplitAfter(marked, []byte("\n")) {
+		line := current
+		for i, m := range lineMarkRe.FindAllSubmatch(l, -1) {
+			current, _ = strconv.Atoi(string(m[1]))
+			if i == 0 {
+				line = current
+			}
+		}
+		out.Write(lineMarkRe.ReplaceAll(l, nil))
+		lines = append(lines, line)
+	}
+	return out.Bytes(), lines
+}
+
+// source line of a line of the generated yaml.
+func (self sourceLines) source(line int) int {
+	if line < 1 || line > len(self) || self[line-1] == 0 {
+		return line
+	}
+	return self[line-1]
+}
+
+var yamlLineRe = regexp.MustCompile(`line (\d+)`)
+
+// error with any yaml line numbers mapped to the source.
+func (self sourceLines) error(err error) error {
+	msg := yamlLineRe.ReplaceAllStringFunc(err.Error(), func(s string) string {
+		line, _ := strconv.Atoi(s[len("line "):])
+		return fmt.Sprintf("line %d", self.source(line))
+	})
+	return errors.New(msg)
+}
+
+// resolve aliases to the node they refer to.
+func resolve(node *yaml3.Node) *yaml3.Node {
+	for node != nil && node.Kind == yaml3.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// forEach key and value of a mapping, including merged (<<) mappings, with
+// aliases resolved.
+func forEach(node *yaml3.Node, fn func(key string, value *yaml3.Node)) {
+	if node != nil && node.Kind == yaml3.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	node = resolve(node)
+	if node == nil || node.Kind != yaml3.MappingNode {
+		return
+	}
+	// merged first, so overridden by the mapping's own keys
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].ShortTag() == "!!merge" {
+			merge := resolve(node.Content[i+1])
+			if merge.Kind == yaml3.SequenceNode {
+				for _, m := range merge.Content {
+					forEach(m, fn)
+				}
+			} else {
+				forEach(merge, fn)
+			}
+		}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].ShortTag() != "!!merge" {
+			fn(node.Content[i].Value, resolve(node.Content[i+1]))
+		}
+	}
+}
+
+func mapValue(node *yaml3.Node, key string) *yaml3.Node {
+	var found *yaml3.Node
+	forEach(node, func(k string, v *yaml3.Node) {
+		if k == key {
+			found = v
+		}
+	})
+	return found
+}
+
+func items(node *yaml3.Node) []*yaml3.Node {
+	node = resolve(node)
+	if node == nil || node.Kind != yaml3.SequenceNode {
+		return nil
+	}
+	var ret []*yaml3.Node
+	for _, item := range node.Content {
+		ret = append(ret, resolve(item))
+	}
+	return ret
+}
+
+// diffAutomata lists the automata, states and transitions added (+), removed
+// (-) or changed (~).
+func diffAutomata(old, updated *gofsm.Automata) []string {
+	var changes []string
+	names := map[string]bool{}
+	if old != nil {
+		for name := range old.Automaton {
+			names[name] = true
+		}
+	}
+	for name := range updated.Automaton {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		var a *gofsm.Automaton
+		if old != nil {
+			a = old.Automaton[name]
+		}
+		b := updated.Automaton[name]
+		switch {
+		case a == nil:
+			changes = append(changes, "+ "+name)
+		case b == nil:
+			changes = append(changes, "- "+name)
+		default:
+			if a.Start != b.Start {
+				changes = append(changes, fmt.Sprintf("~ %s start: %s -> %s", name, a.Start, b.Start))
+			}
+			changes = append(changes, diffKeys(name+" state", a.States, b.States)...)
+			changes = append(changes, diffKeys(name+" transition", a.Transitions, b.Transitions)...)
+		}
+	}
+	return changes
+}
+
+func diffKeys[V any](prefix string, a, b map[string]V) []string {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	var changes []string
+	for k := range keys {
+		va, inA := a[k]
+		vb, inB := b[k]
+		switch {
+		case !inA:
+			changes = append(changes, fmt.Sprintf("+ %s %s", prefix, k))
+		case !inB:
+			changes = append(changes, fmt.Sprintf("- %s %s", prefix, k))
+		case !reflect.DeepEqual(va, vb):
+			changes = append(changes, fmt.Sprintf("~ %s %s", prefix, k))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// validate proposed automata config (or the current config if empty),
+// describing the changes from the running automata.
+func (self *Service) validate(value []byte) string {
+	if len(bytes.TrimSpace(value)) == 0 {
+		value = self.automataConfig.Value
+	}
+	updated, _, err := self.compile(value)
+	if err != nil {
+		msg := "Invalid automata:"
+		if errs, ok := err.(MultiError); ok {
+			for _, e := range errs {
+				msg += "\n" + e.Error()
+			}
+		} else {
+			msg += "\n" + err.Error()
+		}
+		return msg
+	}
+	msg := fmt.Sprintf("Valid: %d automata", len(updated.Automaton))
+	changes := diffAutomata(automata, updated)
+	if len(changes) == 0 {
+		return msg + ", no changes"
+	}
+	return msg + ", changes:\n" + strings.Join(changes, "\n")
+}
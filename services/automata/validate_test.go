@@ -0,0 +1,146 @@
+package automata
+
+import (
+	"testing"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/services"
+	"github.com/stretchr/testify/assert"
+)
+
+var porchYaml = `
+porch:
+  start: Off
+  states:
+    Off: {}
+    On:
+      entering:
+      - StartTimer('porch', 300)
+  transitions:
+    Off->On:
+    - when: device=='door.front' && command=='open'
+    On->Off:
+    - when: device=='timer.porch'
+`
+
+var porchUpdated = `
+porch:
+  start: Off
+  states:
+    Off: {}
+    On:
+      entering:
+      - StartTimer('porch', 600)
+  transitions:
+    Off->On:
+    - when: device=='door.front' && command=='open'
+    - when: device=='pir.porch'
+hall:
+  start: Off
+  states:
+    Off: {}
+  transitions:
+    Off:
+    - when: device=='pir.hall'
+`
+
+func validateService() *Service {
+	service := &Service{config: &services.ConfigService{Value: &config.Config{}}}
+	service.defineFunctions()
+	return service
+}
+
+func TestValidate(t *testing.T) {
+	service := validateService()
+	current, _, err := service.compile([]byte(porchYaml))
+	assert.NoError(t, err)
+	running := automata
+	automata = current
+	defer func() { automata = running }()
+
+	assert.Equal(t, "Valid: 2 automata, changes:\n"+
+		"+ hall\n"+
+		"~ porch state On\n"+
+		"- porch transition On->Off\n"+
+		"~ porch transition Off->On", service.validate([]byte(porchUpdated)))
+	assert.Equal(t, "Valid: 1 automata, no changes", service.validate([]byte(porchYaml)))
+}
+
+func TestValidateErrors(t *testing.T) {
+	service := validateService()
+	bad := `
+porch:
+  start: Off
+  states:
+    Off:
+      leaving:
+      - Unknown('x')
+  transitions:
+    Off:
+    - when: device=='door.front' &&
+`
+	assert.Equal(t, "Invalid automata:\n"+
+		"line 7: porch.states.Off.leaving[0]: Bad expression 'Unknown('x')': Undefined function Unknown\n"+
+		"line 10: porch.transitions.Off[0].when: Bad expression 'device=='door.front' &&': Unexpected end of expression",
+		service.validate([]byte(bad)))
+
+	assert.Contains(t, service.validate([]byte("porch:\n  start: Missing\n  states:\n    Off: {}\n  transitions:\n    Off: []\n")), "starting State invalid")
+}
+
+func TestValidateTemplateLines(t *testing.T) {
+	service := validateService()
+	service.config.Value.Devices = map[string]config.DeviceConf{
+		"light.hall":    {Id: "light.hall"},
+		"light.kitchen": {Id: "light.kitchen"},
+		"light.porch":   {Id: "light.porch"},
+		"light.study":   {Id: "light.study"},
+	}
+	// errors are located in the template, not the yaml generated
+	bad := `
+lights:
+  start: Off
+  states:
+    Off: {}
+    On: {}
+  transitions:
+    Off->On:
+{{- range $id, $dev := .devices }}
+    - when: device=='{{ $id }}'
+{{- end }}
+    On->Off:
+    - when: device=='timer.lights' &&
+`
+	assert.Equal(t, "Invalid automata:\n"+
+		"line 13: lights.transitions.On->Off[0].when: Bad expression 'device=='timer.lights' &&': Unexpected end of expression",
+		service.validate([]byte(bad)))
+
+	assert.Contains(t, service.validate([]byte("{{ if true }}\n\nporch:\n  start: Off\n  states: [\n{{ end }}")), "line 5:")
+}
+
+func TestValidateAliases(t *testing.T) {
+	service := validateService()
+	// expressions only reached through aliases are checked
+	bad := `
+porch:
+  start: Off
+  common:
+    timer: &timer
+      entering:
+      - Unknown('x')
+    door: &door
+      when: device=='door.front' &&
+  states:
+    Off: {}
+    On:
+      <<: *timer
+  transitions:
+    Off->On:
+    - *door
+    On->Off:
+    - *door
+`
+	assert.Equal(t, "Invalid automata:\n"+
+		"line 7: porch.states.On.entering[0]: Bad expression 'Unknown('x')': Undefined function Unknown\n"+
+		"line 9: porch.transitions.Off->On[0].when: Bad expression 'device=='door.front' &&': Unexpected end of expression",
+		service.validate([]byte(bad)))
+}
@@ -249,7 +249,7 @@ func (self *Service) handleThermostat(ev *pubsub.Event) {
 func (self *Service) queueRequest(sensorId uint32, request SensorRequest) {
 	// check if already queued - avoid filling logs with duplicate
 	for _, r := range self.queue[sensorId] {
-		if r.Action == request.Action && r.Temperature == request.Temperature {
+		if r == request {
 			return
 		}
 	}
@@ -288,6 +288,17 @@ func (self *Service) handleCommand(ev *pubsub.Event) {
 		} else {
 			log.Printf("Valve state: %s not understood", ev.StringField("state"))
 		}
+	case "valve":
+		// no proportional control: closed, open, or left to the trv at
+		// part demand
+		state := ener314.VALVE_STATE_AUTO
+		switch level := ev.IntField("level"); {
+		case level <= 0:
+			state = ener314.VALVE_STATE_CLOSED
+		case level >= 100:
+			state = ener314.VALVE_STATE_OPEN
+		}
+		self.queueRequest(sensorId, SensorRequest{Action: ValveState, ValveState: state})
 	case "powermode":
 		if mode, ok := powerModes[ev.StringField("mode")]; ok {
 			self.queueRequest(sensorId, SensorRequest{Action: PowerMode, Mode: mode})
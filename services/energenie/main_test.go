@@ -87,3 +87,33 @@ func TestSending(t *testing.T) {
 	assert.Equal(t, TargetTemperature, sent[3].Action)
 	assert.Equal(t, 17.0, sent[3].Temperature)
 }
+
+func TestValve(t *testing.T) {
+	services.Config = config.ExampleConfig
+	services.Publisher = &dummy.Publisher{}
+	service := &Service{}
+	service.Initialize()
+	var sent []SensorRequest
+	service.sender = func(sensorId uint32, request SensorRequest) {
+		sent = append(sent, request)
+	}
+
+	msg := ener314.Message{
+		SensorId: 0x00097f,
+		Records:  []ener314.Record{ener314.Temperature{Value: 16}},
+	}
+	for _, level := range []float64{100, 0, 50} {
+		ev := pubsub.NewEvent("command", pubsub.Fields{
+			"device":  "trv.living",
+			"command": "valve",
+			"level":   level,
+		})
+		service.handleCommand(ev)
+		service.handleMessage(&msg)
+	}
+	assert.Len(t, sent, 3)
+	assert.Equal(t, ValveState, sent[0].Action)
+	assert.Equal(t, ener314.VALVE_STATE_OPEN, sent[0].ValveState)
+	assert.Equal(t, ener314.VALVE_STATE_CLOSED, sent[1].ValveState)
+	assert.Equal(t, ener314.VALVE_STATE_AUTO, sent[2].ValveState)
+}
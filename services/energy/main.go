@@ -0,0 +1,401 @@
+// Service to account for electricity usage and cost, by integrating power
+// readings (from currentcost, tasmota, solaredge, esphome, etc.) into kWh per
+// device and for the whole house, and applying the tariff in bill:
+//
+//	bill:
+//	  electricity:
+//	    primary_rate: 24.5
+//	    standing_charge: 53.4
+//	    export_rate: 15
+//	    bands:
+//	    - time: 00:30-07:30
+//	      rate: 7.5
+//	    meter: meter.grid
+//	  vat: 5
+//	  currency: £
+//
+// Negative power (eg. from a grid meter) is export. Today's and this month's
+// totals are published to the retained energy topic every 5 minutes, with
+// today's usage, and the previous days' usage is published to
+// energy/energy.history at the end of each day. Both restore usage on restart.
+package energy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
+)
+
+const (
+	// power readings further apart aren't integrated (eg. a device offline)
+	maxGap = 15 * time.Minute
+	// days of usage kept, for the week and month queries
+	historyDays = 62
+)
+
+// Usage is energy imported and exported (kWh), and its cost and credit
+// before VAT (pence).
+type Usage struct {
+	Import float64 `json:"import"`
+	Export float64 `json:"export"`
+	Cost   float64 `json:"cost"`
+	Credit float64 `json:"credit"`
+}
+
+func (self *Usage) add(u Usage) {
+	self.Import += u.Import
+	self.Export += u.Export
+	self.Cost += u.Cost
+	self.Credit += u.Credit
+}
+
+// Day of usage, for the whole house and by device.
+type Day struct {
+	House   Usage             `json:"house"`
+	Devices map[string]*Usage `json:"devices"`
+}
+
+func (self *Day) copy() *Day {
+	d := &Day{House: self.House, Devices: map[string]*Usage{}}
+	for device, u := range self.Devices {
+		c := *u
+		d.Devices[device] = &c
+	}
+	return d
+}
+
+// Summary of usage over a period, with the cost in currency including
+// standing charges and VAT, less export credit.
+type Summary struct {
+	Import float64 `json:"import"`
+	Export float64 `json:"export"`
+	Cost   float64 `json:"cost"`
+	Days   int     `json:"days"`
+}
+
+type reading struct {
+	power float64
+	at    time.Time
+}
+
+// band of the tariff, as minutes of the day.
+type band struct {
+	start, end int
+	rate       float64
+}
+
+// Service energy
+type Service struct {
+	config *services.ConfigService
+	Days   map[string]*Day // date -> usage
+	last   map[string]reading
+	bands  []band
+	saved  string // date the history was last published
+	ticker *util.Scheduler
+	lock   sync.Mutex
+}
+
+func (self *Service) ID() string {
+	return "energy"
+}
+
+func date(t time.Time) string {
+	return t.Local().Format(config.DateFormat)
+}
+
+func (self *Service) day(t time.Time) *Day {
+	key := date(t)
+	d, ok := self.Days[key]
+	if !ok {
+		d = &Day{Devices: map[string]*Usage{}}
+		self.Days[key] = d
+	}
+	return d
+}
+
+// rate of the tariff at t (pence/kWh).
+func (self *Service) rate(t time.Time) float64 {
+	t = t.Local()
+	minute := t.Hour()*60 + t.Minute()
+	for _, b := range self.bands {
+		if (b.start < b.end && minute >= b.start && minute < b.end) ||
+			(b.start > b.end && (minute >= b.start || minute < b.end)) {
+			return b.rate
+		}
+	}
+	return self.config.Value.Bill.Electricity.Primary_Rate
+}
+
+// usage of power (W) from at for d.
+func (self *Service) usage(power float64, at time.Time, d time.Duration) Usage {
+	kwh := power * d.Hours() / 1000
+	if kwh < 0 {
+		return Usage{Export: -kwh, Credit: -kwh * self.config.Value.Bill.Electricity.Export_Rate}
+	}
+	return Usage{Import: kwh, Cost: kwh * self.rate(at)}
+}
+
+// reading of a device's power, integrating the previous reading up to it.
+func (self *Service) reading(device string, power float64, at time.Time) {
+	last, ok := self.last[device]
+	self.last[device] = reading{power, at}
+	if !ok {
+		return
+	}
+	gap := at.Sub(last.at)
+	if gap <= 0 || gap > maxGap {
+		return
+	}
+	u := self.usage(last.power, last.at, gap)
+	day := self.day(last.at)
+	meter := self.config.Value.Bill.Electricity.Meter
+	if device == meter || meter == "" {
+		day.House.add(u)
+	}
+	if device != meter {
+		if _, ok := day.Devices[device]; !ok {
+			day.Devices[device] = &Usage{}
+		}
+		day.Devices[device].add(u)
+	}
+}
+
+// Summary of usage of the whole house (or device, if given) over the days
+// from (inclusive) to to.
+func (self *Service) Summary(from, to time.Time, device string) Summary {
+	bill := self.config.Value.Bill
+	vat := 1 + bill.Vat/100
+	var s Summary
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		day, ok := self.Days[date(d)]
+		if !ok {
+			continue
+		}
+		u := day.House
+		if device != "" {
+			if du, ok := day.Devices[device]; ok {
+				u = *du
+			} else {
+				u = Usage{}
+			}
+		} else {
+			u.Cost += bill.Electricity.Standing_Charge
+		}
+		s.Import += u.Import
+		s.Export += u.Export
+		s.Cost += (u.Cost*vat - u.Credit) / 100
+		s.Days++
+	}
+	return s
+}
+
+func midnight(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// period returns the first day of a period ending today.
+func period(name string, now time.Time) (time.Time, error) {
+	today := midnight(now)
+	switch name {
+	case "today":
+		return today, nil
+	case "week":
+		return today.AddDate(0, 0, -6), nil
+	case "month":
+		return today.AddDate(0, 0, 1-today.Day()), nil
+	}
+	return time.Time{}, fmt.Errorf("Expected today, week or month")
+}
+
+// trim days older than the history kept.
+func (self *Service) trim(now time.Time) {
+	oldest := date(midnight(now).AddDate(0, 0, -historyDays))
+	for key := range self.Days {
+		if key < oldest {
+			delete(self.Days, key)
+		}
+	}
+}
+
+// publish totals to the retained energy topic, and the previous days once
+// a day to energy.history.
+func (self *Service) publish() {
+	now := util.Now()
+	key := date(now)
+	self.lock.Lock()
+	self.trim(now)
+	today, _ := period("today", now)
+	month, _ := period("month", now)
+	fields := pubsub.Fields{
+		"device": "energy",
+		"today":  self.Summary(today, now, ""),
+		"month":  self.Summary(month, now, ""),
+		"date":   key,
+		"day":    self.day(now).copy(),
+	}
+	var history *pubsub.Event
+	if self.saved != key {
+		days := map[string]*Day{}
+		for k, day := range self.Days {
+			if k != key {
+				days[k] = day.copy()
+			}
+		}
+		history = pubsub.NewEvent("energy", pubsub.Fields{"device": "energy.history", "days": days})
+		self.saved = key
+	}
+	self.lock.Unlock()
+
+	ev := pubsub.NewEvent("energy", fields)
+	ev.SetRetained(true)
+	services.Publisher.Emit(ev)
+	if history != nil {
+		history.SetRetained(true)
+		services.Publisher.Emit(history)
+	}
+}
+
+// restoreState restores today's usage from the totals, or the previous
+// days' from the history (or totals published before there was one).
+func (self *Service) restoreState(ev *pubsub.Event) {
+	days := map[string]*Day{}
+	if _, ok := ev.Fields["days"]; ok {
+		data, _ := json.Marshal(ev.Fields["days"])
+		if err := json.Unmarshal(data, &days); err != nil {
+			log.Printf("Failed to unmarshal state: %s", err)
+			return
+		}
+	} else if key, ok := ev.Fields["date"].(string); ok {
+		day := &Day{}
+		data, _ := json.Marshal(ev.Fields["day"])
+		if err := json.Unmarshal(data, day); err != nil {
+			log.Printf("Failed to unmarshal state: %s", err)
+			return
+		}
+		days[key] = day
+	}
+	for key, day := range days {
+		if day.Devices == nil {
+			day.Devices = map[string]*Usage{}
+		}
+		self.Days[key] = day
+	}
+	log.Printf("Restored %d days of usage", len(days))
+}
+
+func (self *Service) Init() error {
+	self.config = services.WaitForConfig()
+	self.Days = map[string]*Day{}
+	self.last = map[string]reading{}
+	// the retained history is kept until the end of the day
+	self.saved = date(util.Now())
+	self.configUpdated()
+	self.ticker = util.NewScheduler(0, 5*time.Minute)
+	return nil
+}
+
+// configUpdated parses the tariff bands.
+func (self *Service) configUpdated() {
+	var bands []band
+	for _, b := range self.config.Value.Bill.Electricity.Bands {
+		start, end, err := config.ParseTimeBand(b.Time)
+		if err != nil {
+			log.Printf("Invalid tariff band: %s", err)
+			continue
+		}
+		bands = append(bands, band{start, end, b.Rate})
+	}
+	self.lock.Lock()
+	self.bands = bands
+	self.lock.Unlock()
+}
+
+func (self *Service) Topics() []pubsub.Topic {
+	return []pubsub.Topic{pubsub.Prefix("power"), pubsub.Prefix("energy")}
+}
+
+// HandleEvent handles a power reading, or the retained energy totals.
+func (self *Service) HandleEvent(ev *pubsub.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	switch ev.Topic {
+	case "energy":
+		if ev.Retained {
+			self.restoreState(ev)
+		}
+	case "power":
+		power, ok := ev.Fields["power"].(float64)
+		if ev.Retained || !ok || ev.Device() == "" {
+			return
+		}
+		self.reading(ev.Device(), power, ev.Timestamp)
+	}
+}
+
+// Tick publishes the totals if due.
+func (self *Service) Tick() {
+	select {
+	case <-self.ticker.C:
+		self.publish()
+	default:
+	}
+}
+
+func (self *Service) Run() error {
+	events := services.Subscriber.Subscribe(self.Topics()...)
+	for {
+		select {
+		case ev := <-events:
+			self.HandleEvent(ev)
+		case <-self.ticker.C:
+			self.publish()
+		case <-self.config.Updated:
+			self.configUpdated()
+		}
+	}
+}
+
+func (self *Service) QueryHandlers() services.QueryHandlers {
+	return services.QueryHandlers{
+		"energy": self.queryEnergy,
+		"help": services.StaticHandler("" +
+			"energy [today|week|month] [device]: get usage and cost\n"),
+	}
+}
+
+func (self *Service) queryEnergy(q services.Question) services.Answer {
+	args := strings.Fields(q.Args)
+	name, device := "today", ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if len(args) > 1 {
+		device = args[1]
+	}
+	now := util.Now()
+	from, err := period(name, now)
+	if err != nil {
+		return services.Answer{Text: err.Error()}
+	}
+	self.lock.Lock()
+	s := self.Summary(from, now, device)
+	self.lock.Unlock()
+	what := "House"
+	if device != "" {
+		what = device
+	}
+	text := fmt.Sprintf("%s %s: %.2f kWh, %s%.2f", what, name, s.Import, self.config.Value.Bill.Currency, s.Cost)
+	if s.Export > 0 {
+		text += fmt.Sprintf(" (exported %.2f kWh)", s.Export)
+	}
+	return services.Answer{Text: text, Json: s}
+}
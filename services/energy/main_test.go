@@ -0,0 +1,182 @@
+package energy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/services/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleInterfaces() {
+	var _ services.Service = (*Service)(nil)
+	var _ services.Queryable = (*Service)(nil)
+	var _ sim.Service = (*Service)(nil)
+	// Output:
+}
+
+var start = time.Date(2024, 1, 15, 6, 0, 0, 0, time.Local)
+
+const energyYaml = `
+devices:
+  meter.grid:
+    source: currentcost.cc01
+  kettle.kitchen:
+    source: tasmota.kettle
+bill:
+  electricity:
+    primary_rate: 20
+    standing_charge: 40
+    export_rate: 10
+    bands:
+    - time: 23:00-07:00
+      rate: 10
+    meter: meter.grid
+  vat: 5
+  currency: £
+`
+
+func setup(t *testing.T, at time.Time) (*sim.Harness, *Service) {
+	h := sim.New(at)
+	h.Config(energyYaml)
+	service := &Service{}
+	assert.NoError(t, h.Start(service))
+	return h, service
+}
+
+func power(device string, watts float64) *pubsub.Event {
+	return pubsub.NewEvent("power", pubsub.Fields{"device": device, "power": watts})
+}
+
+func query(service *Service, args string) services.Answer {
+	return service.queryEnergy(services.Question{Verb: "energy", Args: args})
+}
+
+// hold readings of power every 5 minutes for d.
+func hold(h *sim.Harness, device string, watts float64, d time.Duration) {
+	for end := h.Now().Add(d); h.Now().Before(end); h.Advance(5 * time.Minute) {
+		h.Inject(power(device, watts))
+	}
+}
+
+func usage(h *sim.Harness) {
+	// 2kWh at the night rate, then 1kWh exported, 0.5kWh by the kettle
+	hold(h, "meter.grid", 2000, time.Hour)
+	h.Inject(power("kettle.kitchen", 3000))
+	hold(h, "meter.grid", -1000, 10*time.Minute)
+	h.Inject(power("kettle.kitchen", 0))
+	hold(h, "meter.grid", -1000, 50*time.Minute)
+	h.Inject(power("meter.grid", 0))
+}
+
+func TestUsage(t *testing.T) {
+	h, service := setup(t, start)
+	defer h.Close()
+	usage(h)
+
+	// (2kWh*10p + 40p standing) + 5% VAT - 1kWh*10p
+	answer := query(service, "")
+	assert.Equal(t, "House today: 2.00 kWh, £0.53 (exported 1.00 kWh)", answer.Text)
+	s := answer.Json.(Summary)
+	assert.InDelta(t, 0.53, s.Cost, 0.0001)
+	assert.Equal(t, 1.0, s.Export)
+
+	// 0.5kWh at the day rate
+	s = query(service, "today kettle.kitchen").Json.(Summary)
+	assert.Equal(t, 0.5, s.Import)
+	assert.InDelta(t, 0.105, s.Cost, 0.0001)
+
+	assert.Equal(t, "Expected today, week or month", query(service, "year").Text)
+}
+
+func TestGap(t *testing.T) {
+	h, service := setup(t, start)
+	defer h.Close()
+
+	// device offline in between
+	h.Inject(power("kettle.kitchen", 3000))
+	h.Advance(maxGap + time.Minute)
+	h.Inject(power("kettle.kitchen", 3000))
+	s := query(service, "today kettle.kitchen").Json.(Summary)
+	assert.Equal(t, 0.0, s.Import)
+}
+
+func TestPeriods(t *testing.T) {
+	h, service := setup(t, start)
+	defer h.Close()
+	usage(h)
+	h.AdvanceTo(start.AddDate(0, 0, 1))
+	usage(h)
+
+	assert.Equal(t, 2.0, query(service, "today").Json.(Summary).Import)
+	week := query(service, "week").Json.(Summary)
+	assert.Equal(t, 4.0, week.Import)
+	assert.Equal(t, 2, week.Days)
+	assert.Equal(t, 4.0, query(service, "month").Json.(Summary).Import)
+
+	// into next month
+	h.AdvanceTo(time.Date(2024, 2, 1, 6, 0, 0, 0, time.Local))
+	usage(h)
+	assert.Equal(t, 2.0, query(service, "month").Json.(Summary).Import)
+	assert.Equal(t, 2.0, query(service, "week").Json.(Summary).Import)
+}
+
+func TestRetained(t *testing.T) {
+	h, _ := setup(t, start)
+	usage(h)
+	h.Advance(5 * time.Minute)
+	published := h.Emitted("energy")
+	assert.NotEmpty(t, published)
+	last := published[len(published)-1]
+	assert.True(t, last.Retained)
+	today := last.Fields["today"].(Summary)
+	assert.Equal(t, 2.0, today.Import)
+	assert.NotContains(t, last.Fields, "days")
+	h.Close()
+
+	// restored on restart
+	h = sim.New(start.Add(3 * time.Hour))
+	defer h.Close()
+	h.Config(energyYaml)
+	h.Retain(last)
+	service := &Service{}
+	assert.NoError(t, h.Start(service))
+	assert.Equal(t, 2.0, query(service, "today").Json.(Summary).Import)
+	assert.Equal(t, 0.5, query(service, "today kettle.kitchen").Json.(Summary).Import)
+}
+
+func TestHistory(t *testing.T) {
+	h, _ := setup(t, start)
+	usage(h)
+	h.AdvanceTo(start.AddDate(0, 0, 1))
+	usage(h)
+	h.Advance(5 * time.Minute)
+
+	// published once, at the end of the day
+	var history, last *pubsub.Event
+	for _, ev := range h.Emitted("energy") {
+		if ev.Device() == "energy.history" {
+			assert.Nil(t, history)
+			history = ev
+		} else {
+			last = ev
+		}
+	}
+	assert.NotNil(t, history)
+	assert.True(t, history.Retained)
+	assert.Len(t, history.Fields["days"], 1)
+	h.Close()
+
+	// restored on restart
+	h = sim.New(start.AddDate(0, 0, 1).Add(3 * time.Hour))
+	defer h.Close()
+	h.Config(energyYaml)
+	h.Retain(last)
+	h.Retain(history)
+	service := &Service{}
+	assert.NoError(t, h.Start(service))
+	assert.Equal(t, 2.0, query(service, "today").Json.(Summary).Import)
+	assert.Equal(t, 4.0, query(service, "week").Json.(Summary).Import)
+}
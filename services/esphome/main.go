@@ -22,6 +22,9 @@ func (self *Service) ID() string {
 	return "esphome"
 }
 
+// MqttBridge marks the service as using mqtt.Client directly.
+func (self *Service) MqttBridge() {}
+
 func announce(source string) {
 	fields := pubsub.Fields{"source": source}
 	ev := pubsub.NewEvent("announce", fields)
@@ -20,6 +20,9 @@ func (self *Service) ID() string {
 	return "frigate"
 }
 
+// MqttBridge marks the service as using mqtt.Client directly.
+func (self *Service) MqttBridge() {}
+
 // {"before": {"id": "1688400328.42808-weawsp", "camera": "front", "frame_time": 1688453551.154563, "snapshot_time": 1688400330.671039, "label": "car", "sub_label": null, "top_score": 0.998046875, "false_positive": false, "start_time": 1688400328.42808, "end_time": null, "score": 0.97412109375, "box": [184, 96, 381, 246], "area": 29550, "ratio": 1.3133333333333332, "region": [81, 0, 433, 352], "stationary": true, "motionless_count": 198274, "position_changes": 2, "current_zones": [], "entered_zones": [], "has_clip": true, "has_snapshot": false}, "after": {"id": "1688400328.42808-weawsp", "camera": "front", "frame_time": 1688453611.450034, "snapshot_time": 1688400330.671039, "label": "car", "sub_label": null, "top_score": 0.998046875, "false_positive": false, "start_time": 1688400328.42808, "end_time": null, "score": 0.97412109375, "box": [184, 96, 381, 246], "area": 29550, "ratio": 1.3133333333333332, "region": [81, 0, 433, 352], "stationary": true, "motionless_count": 198515, "position_changes": 2, "current_zones": [], "entered_zones": [], "has_clip": true, "has_snapshot": false}, "type": "update"}
 type EventDetails struct {
 	Id              string   `json:"id"`
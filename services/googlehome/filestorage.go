@@ -4,6 +4,11 @@ import (
 	"encoding/gob"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/RangelReale/osin"
 )
@@ -15,15 +20,62 @@ func init() {
 	gob.Register(osin.AccessData{})
 }
 
+// DefaultStorageFile is where tokens are persisted.
+const DefaultStorageFile = "oauth.data"
+
+// RefreshExpiration is how long a refresh token lasts unused. Refreshing
+// replaces it, so only abandoned grants expire.
+const RefreshExpiration = 90 * 24 * time.Hour
+
+// shortToken is the length of tokens as shown, enough to identify them.
+const shortToken = 8
+
+// Storage of the OAuth clients and tokens, persisted across restarts.
+type Storage interface {
+	osin.Storage
+	SetClient(id string, client osin.Client) error
+	// Restore the tokens persisted.
+	Restore() error
+	// Sweep expired tokens, returning the number removed.
+	Sweep(now time.Time) int
+	// Revoke the grants matching a token (or its prefix), or all, returning
+	// the number revoked.
+	Revoke(token string) int
+	// Grants active at now.
+	Grants(now time.Time) []Grant
+}
+
+// Grant is an access token issued to a client.
+type Grant struct {
+	Client    string
+	Token     string // shortened
+	Refresh   bool
+	Scope     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func short(token string) string {
+	if len(token) > shortToken {
+		return token[:shortToken]
+	}
+	return token
+}
+
+// FileStorage implements Storage, persisted to a gob encoded file.
 type FileStorage struct {
+	path      string
+	lock      sync.Mutex
 	clients   map[string]osin.Client
 	Authorize map[string]*osin.AuthorizeData
 	Access    map[string]*osin.AccessData
 	Refresh   map[string]string
 }
 
-func NewFileStorage() *FileStorage {
+// NewFileStorage creates a FileStorage persisting to path.
+func NewFileStorage(path string) *FileStorage {
 	r := &FileStorage{
+		path:      path,
 		clients:   make(map[string]osin.Client),
 		Authorize: make(map[string]*osin.AuthorizeData),
 		Access:    make(map[string]*osin.AccessData),
@@ -42,6 +94,8 @@ func (s *FileStorage) Close() {
 
 func (s *FileStorage) GetClient(id string) (osin.Client, error) {
 	log.Printf("GetClient: %s\n", id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if c, ok := s.clients[id]; ok {
 		return c, nil
 	}
@@ -50,19 +104,24 @@ func (s *FileStorage) GetClient(id string) (osin.Client, error) {
 
 func (s *FileStorage) SetClient(id string, client osin.Client) error {
 	log.Printf("SetClient: %s\n", id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.clients[id] = client
 	return nil
 }
 
 func (s *FileStorage) SaveAuthorize(data *osin.AuthorizeData) error {
-	log.Printf("SaveAuthorize: %s\n", data.Code)
+	log.Printf("SaveAuthorize: %s\n", short(data.Code))
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.Authorize[data.Code] = data
-	s.Persist()
-	return nil
+	return s.persist()
 }
 
 func (s *FileStorage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
-	log.Printf("LoadAuthorize: %s\n", code)
+	log.Printf("LoadAuthorize: %s\n", short(code))
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if d, ok := s.Authorize[code]; ok {
 		return d, nil
 	}
@@ -70,24 +129,32 @@ func (s *FileStorage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
 }
 
 func (s *FileStorage) RemoveAuthorize(code string) error {
-	log.Printf("RemoveAuthorize: %s\n", code)
+	log.Printf("RemoveAuthorize: %s\n", short(code))
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	delete(s.Authorize, code)
-	s.Persist()
-	return nil
+	return s.persist()
 }
 
 func (s *FileStorage) SaveAccess(data *osin.AccessData) error {
-	log.Printf("SaveAccess: %s\n", data.AccessToken)
-	s.Access[data.AccessToken] = data
-	if data.RefreshToken != "" {
-		s.Refresh[data.RefreshToken] = data.AccessToken
+	log.Printf("SaveAccess: %s\n", short(data.AccessToken))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// the previous grant isn't kept, else every refresh would nest another
+	d := *data
+	d.AuthorizeData = nil
+	d.AccessData = nil
+	s.Access[d.AccessToken] = &d
+	if d.RefreshToken != "" {
+		s.Refresh[d.RefreshToken] = d.AccessToken
 	}
-	s.Persist()
-	return nil
+	return s.persist()
 }
 
 func (s *FileStorage) LoadAccess(code string) (*osin.AccessData, error) {
-	log.Printf("LoadAccess: %s\n", code)
+	log.Printf("LoadAccess: %s\n", short(code))
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if d, ok := s.Access[code]; ok {
 		return d, nil
 	}
@@ -95,43 +162,161 @@ func (s *FileStorage) LoadAccess(code string) (*osin.AccessData, error) {
 }
 
 func (s *FileStorage) RemoveAccess(code string) error {
-	log.Printf("RemoveAccess: %s\n", code)
+	log.Printf("RemoveAccess: %s\n", short(code))
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	delete(s.Access, code)
-	s.Persist()
-	return nil
+	return s.persist()
 }
 
 func (s *FileStorage) LoadRefresh(code string) (*osin.AccessData, error) {
-	log.Printf("LoadRefresh: %s\n", code)
-	if d, ok := s.Refresh[code]; ok {
-		return s.LoadAccess(d)
+	log.Printf("LoadRefresh: %s\n", short(code))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if token, ok := s.Refresh[code]; ok {
+		if d, ok := s.Access[token]; ok && !refreshExpired(d, time.Now()) {
+			return d, nil
+		}
 	}
 	return nil, osin.ErrNotFound
 }
 
 func (s *FileStorage) RemoveRefresh(code string) error {
-	log.Printf("RemoveRefresh: %s\n", code)
+	log.Printf("RemoveRefresh: %s\n", short(code))
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	delete(s.Refresh, code)
-	s.Persist()
-	return nil
+	return s.persist()
+}
+
+func refreshExpired(d *osin.AccessData, now time.Time) bool {
+	return d.CreatedAt.Add(RefreshExpiration).Before(now)
+}
+
+// expired is true if the access token and any refresh token have expired.
+func expired(d *osin.AccessData, now time.Time) bool {
+	if !d.IsExpiredAt(now) {
+		return false
+	}
+	return d.RefreshToken == "" || refreshExpired(d, now)
 }
 
-func (s *FileStorage) Persist() {
-	w, err := os.Create("oauth.data")
+func (s *FileStorage) removeAccess(d *osin.AccessData) {
+	delete(s.Access, d.AccessToken)
+	if d.RefreshToken != "" {
+		delete(s.Refresh, d.RefreshToken)
+	}
+}
+
+func (s *FileStorage) Sweep(now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for code, d := range s.Authorize {
+		if d.IsExpiredAt(now) {
+			delete(s.Authorize, code)
+			n++
+		}
+	}
+	for _, d := range s.Access {
+		if expired(d, now) {
+			s.removeAccess(d)
+			n++
+		}
+	}
+	for refresh, token := range s.Refresh {
+		if _, ok := s.Access[token]; !ok {
+			delete(s.Refresh, refresh)
+		}
+	}
+	if n > 0 {
+		s.persist()
+	}
+	return n
+}
+
+func (s *FileStorage) Revoke(token string) int {
+	if token == "" {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for _, d := range s.Access {
+		if token == "all" || strings.HasPrefix(d.AccessToken, token) ||
+			(d.RefreshToken != "" && strings.HasPrefix(d.RefreshToken, token)) {
+			s.removeAccess(d)
+			n++
+		}
+	}
+	if n > 0 {
+		s.persist()
+	}
+	return n
+}
+
+func (s *FileStorage) Grants(now time.Time) []Grant {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var grants []Grant
+	for _, d := range s.Access {
+		if expired(d, now) {
+			continue
+		}
+		g := Grant{
+			Token:     short(d.AccessToken),
+			Refresh:   d.RefreshToken != "",
+			Scope:     d.Scope,
+			CreatedAt: d.CreatedAt,
+			ExpiresAt: d.ExpireAt(),
+		}
+		if d.Client != nil {
+			g.Client = d.Client.GetId()
+		}
+		grants = append(grants, g)
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].CreatedAt.Before(grants[j].CreatedAt)
+	})
+	return grants
+}
+
+// Persist the tokens.
+func (s *FileStorage) Persist() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.persist()
+}
+
+// persist writes to a temporary file, renamed over the previous, so it's
+// never left partially written.
+func (s *FileStorage) persist() error {
+	w, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
 	if err != nil {
 		log.Printf("Error persisting: %s", err)
-		return
+		return err
+	}
+	err = gob.NewEncoder(w).Encode(s)
+	if err == nil {
+		err = w.Sync()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
 	}
-	defer w.Close()
-	if err := gob.NewEncoder(w).Encode(s); err != nil {
+	if err == nil {
+		err = os.Rename(w.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(w.Name())
 		log.Printf("Error persisting: %s", err)
-		return
 	}
-	return
+	return err
 }
 
 func (s *FileStorage) Restore() error {
-	r, err := os.Open("oauth.data")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, err := os.Open(s.path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -142,5 +327,10 @@ func (s *FileStorage) Restore() error {
 	if err := gob.NewDecoder(r).Decode(s); err != nil {
 		return err
 	}
+	// from before grants were stored without their previous
+	for _, d := range s.Access {
+		d.AuthorizeData = nil
+		d.AccessData = nil
+	}
 	return nil
 }
@@ -0,0 +1,131 @@
+package googlehome
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RangelReale/osin"
+	"github.com/barnybug/gohome/services"
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleStorage() {
+	var _ Storage = (*FileStorage)(nil)
+	// Output:
+}
+
+var client = &osin.DefaultClient{Id: "google", Secret: "secret", RedirectUri: "https://google.com"}
+
+func access(token, refresh string, created time.Time) *osin.AccessData {
+	return &osin.AccessData{
+		Client:       client,
+		AccessToken:  token,
+		RefreshToken: refresh,
+		ExpiresIn:    7 * 86400,
+		CreatedAt:    created,
+	}
+}
+
+func TestFileStoragePersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oauth.data")
+	s := NewFileStorage(path)
+	first := access("access1", "refresh1", time.Now())
+	assert.NoError(t, s.SaveAccess(first))
+	// refreshed
+	second := access("access2", "refresh2", time.Now())
+	second.AccessData = first
+	assert.NoError(t, s.SaveAccess(second))
+	assert.NoError(t, s.RemoveRefresh("refresh1"))
+	assert.NoError(t, s.RemoveAccess("access1"))
+	// osin's copy is untouched
+	assert.Equal(t, first, second.AccessData)
+
+	files, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, files, 1)
+
+	restored := NewFileStorage(path)
+	assert.NoError(t, restored.Restore())
+	assert.Len(t, restored.Access, 1)
+	d, err := restored.LoadRefresh("refresh2")
+	assert.NoError(t, err)
+	assert.Equal(t, "access2", d.AccessToken)
+	assert.Nil(t, d.AccessData)
+	_, err = restored.LoadAccess("access1")
+	assert.Equal(t, osin.ErrNotFound, err)
+}
+
+func TestFileStorageSweep(t *testing.T) {
+	now := time.Now()
+	s := NewFileStorage(filepath.Join(t.TempDir(), "oauth.data"))
+	s.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: "code1", ExpiresIn: 250, CreatedAt: now.Add(-time.Hour)})
+	s.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: "code2", ExpiresIn: 250, CreatedAt: now})
+	s.SaveAccess(access("current", "", now))
+	s.SaveAccess(access("expired", "", now.Add(-8*24*time.Hour)))
+	s.SaveAccess(access("refreshable", "refresh1", now.Add(-8*24*time.Hour)))
+	s.SaveAccess(access("abandoned", "refresh2", now.Add(-RefreshExpiration-time.Hour)))
+
+	_, err := s.LoadRefresh("refresh2")
+	assert.Equal(t, osin.ErrNotFound, err)
+
+	assert.Equal(t, 3, s.Sweep(now))
+	assert.Len(t, s.Authorize, 1)
+	assert.Len(t, s.Access, 2)
+	assert.Equal(t, map[string]string{"refresh1": "refreshable"}, s.Refresh)
+	assert.Equal(t, 0, s.Sweep(now))
+}
+
+func TestFileStorageRevoke(t *testing.T) {
+	now := time.Now()
+	s := NewFileStorage(filepath.Join(t.TempDir(), "oauth.data"))
+	s.SaveAccess(access("a1b2c3d4e5f6", "r1", now.Add(-time.Hour)))
+	s.SaveAccess(access("f6e5d4c3b2a1", "r2", now))
+
+	grants := s.Grants(now)
+	assert.Len(t, grants, 2)
+	assert.Equal(t, Grant{
+		Client:    "google",
+		Token:     "a1b2c3d4",
+		Refresh:   true,
+		CreatedAt: now.Add(-time.Hour),
+		ExpiresAt: now.Add(-time.Hour + 7*24*time.Hour),
+	}, grants[0])
+
+	assert.Equal(t, 0, s.Revoke("xyz"))
+	assert.Equal(t, 1, s.Revoke("a1b2c3d4"))
+	_, err := s.LoadRefresh("r1")
+	assert.Equal(t, osin.ErrNotFound, err)
+	assert.Len(t, s.Grants(now), 1)
+	assert.Equal(t, 1, s.Revoke("all"))
+	assert.Empty(t, s.Grants(now))
+}
+
+func TestRevokeQuery(t *testing.T) {
+	s := NewFileStorage(filepath.Join(t.TempDir(), "oauth.data"))
+	s.SaveAccess(access("a1b2c3d4e5f6", "", time.Now()))
+	Tokens = s
+	t.Cleanup(func() { Tokens = nil })
+
+	authorized := func(token string) int {
+		req, _ := http.NewRequest("POST", "/actions", nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(actionsEndpoint).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, authorized("xyz"))
+	assert.NotEqual(t, http.StatusUnauthorized, authorized("a1b2c3d4e5f6"))
+
+	service := &Service{}
+	handlers := service.QueryHandlers()
+	answer := handlers["grants"](services.Question{Verb: "grants"})
+	assert.Contains(t, answer.Text, "a1b2c3d4 google created ")
+	answer = handlers["revoke"](services.Question{Verb: "revoke", Args: "a1b2"})
+	assert.Equal(t, "Revoked 1 grants", answer.Text)
+	assert.Equal(t, http.StatusUnauthorized, authorized("a1b2c3d4e5f6"))
+	answer = handlers["grants"](services.Question{Verb: "grants"})
+	assert.Equal(t, "No grants", answer.Text)
+}
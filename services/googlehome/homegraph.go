@@ -0,0 +1,196 @@
+package googlehome
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HomeGraphUrl is Google's HomeGraph API.
+const HomeGraphUrl = "https://homegraph.googleapis.com/v1"
+
+const homeGraphScope = "https://www.googleapis.com/auth/homegraph"
+
+// HomeGraph is the client of the HomeGraph API, to push state to Google.
+type HomeGraph interface {
+	// ReportState of devices, by id.
+	ReportState(states map[string]DeviceState) error
+	// RequestSync asks Google to resync the devices.
+	RequestSync() error
+}
+
+// ServiceAccountKey is a Google service account's key file, authorizing
+// calls to HomeGraph.
+type ServiceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenUri    string `json:"token_uri"`
+}
+
+// homeGraphClient calls the HomeGraph API, with an access token for the
+// service account.
+type homeGraphClient struct {
+	url    string
+	key    ServiceAccountKey
+	signer *rsa.PrivateKey
+	client *http.Client
+
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewHomeGraph creates a HomeGraph client from a service account key file,
+// calling the API at apiUrl.
+func NewHomeGraph(keyFile string, apiUrl string) (HomeGraph, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var key ServiceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return newHomeGraphClient(key, apiUrl)
+}
+
+func newHomeGraphClient(key ServiceAccountKey, apiUrl string) (*homeGraphClient, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("service account private key invalid")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key not RSA")
+	}
+	return &homeGraphClient{
+		url:    apiUrl,
+		key:    key,
+		signer: signer,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// assertion is a signed JWT, exchanged for an access token.
+func (self *homeGraphClient) assertion(now time.Time) (string, error) {
+	header := encodeSegment(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims := encodeSegment(map[string]interface{}{
+		"iss":   self.key.ClientEmail,
+		"scope": homeGraphScope,
+		"aud":   self.key.TokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := header + "." + claims
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, self.signer, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// accessToken returns a current access token, fetching a new one as needed.
+func (self *homeGraphClient) accessToken() (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	if self.token != "" && now.Before(self.expiry) {
+		return self.token, nil
+	}
+	assertion, err := self.assertion(now)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	resp, err := self.client.PostForm(self.key.TokenUri, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	self.token = token.AccessToken
+	// refresh a minute early
+	self.expiry = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return self.token, nil
+}
+
+func (self *homeGraphClient) post(method string, body interface{}) error {
+	token, err := self.accessToken()
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest("POST", self.url+"/devices:"+method, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ApplicationJson)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s failed: %s %s", method, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (self *homeGraphClient) ReportState(states map[string]DeviceState) error {
+	body := map[string]interface{}{
+		"requestId":   fmt.Sprint(time.Now().UnixNano()),
+		"agentUserId": agentUserId,
+		"payload": map[string]interface{}{
+			"devices": map[string]interface{}{
+				"states": states,
+			},
+		},
+	}
+	return self.post("reportStateAndNotification", body)
+}
+
+func (self *homeGraphClient) RequestSync() error {
+	body := map[string]interface{}{
+		"agentUserId": agentUserId,
+		"async":       true,
+	}
+	return self.post("requestSync", body)
+}
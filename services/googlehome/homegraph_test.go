@@ -0,0 +1,147 @@
+package googlehome
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeHomeGraph struct {
+	states []map[string]DeviceState
+	syncs  int
+}
+
+func (self *fakeHomeGraph) ReportState(states map[string]DeviceState) error {
+	self.states = append(self.states, states)
+	return nil
+}
+
+func (self *fakeHomeGraph) RequestSync() error {
+	self.syncs++
+	return nil
+}
+
+func setupHomeGraph(t *testing.T) *fakeHomeGraph {
+	services.Config = config.ExampleConfig
+	DeviceEvents = map[string]map[string]*pubsub.Event{}
+	reports = newReporter()
+	fake := &fakeHomeGraph{}
+	Homegraph = fake
+	t.Cleanup(func() {
+		Homegraph = nil
+		DeviceEvents = map[string]map[string]*pubsub.Event{}
+	})
+	return fake
+}
+
+func TestReportState(t *testing.T) {
+	fake := setupHomeGraph(t)
+
+	recordEvent(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}))
+	assert.Len(t, fake.states, 0)
+	reports.flush()
+	assert.Len(t, fake.states, 1)
+	assert.Equal(t, true, *fake.states[0]["light.kitchen"].On)
+
+	// unchanged, commands and unsynced devices aren't reported
+	recordEvent(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}))
+	recordEvent(pubsub.NewCommand("light.kitchen", "off"))
+	recordEvent(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.living", "temp": 19.0}))
+	reports.flush()
+	assert.Len(t, fake.states, 1)
+
+	recordEvent(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.glowworm", "command": "on", "level": 40.0}))
+	reports.flush()
+	assert.Len(t, fake.states, 2)
+	assert.Equal(t, 40, fake.states[1]["light.glowworm"].Brightness)
+
+	recordEvent(pubsub.NewEvent("thermostat", pubsub.Fields{"device": "thermostat.living", "target": 18.0}))
+	recordEvent(pubsub.NewEvent("temp", pubsub.Fields{"device": "trv.living", "temp": 16.5}))
+	reports.flush()
+	assert.Len(t, fake.states, 3)
+	state := fake.states[2]["thermostat.living"]
+	assert.Equal(t, 18.0, *state.ThermostatTemperatureSetpoint)
+	assert.Equal(t, 16.5, *state.ThermostatTemperatureAmbient)
+}
+
+func TestReportStateBatched(t *testing.T) {
+	fake := setupHomeGraph(t)
+
+	// changes in the meantime are reported together, and only the latest
+	recordEvent(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}))
+	recordEvent(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.glowworm", "command": "on", "level": 40.0}))
+	recordEvent(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "off"}))
+	reports.flush()
+	assert.Len(t, fake.states, 1)
+	assert.Len(t, fake.states[0], 2)
+	assert.Equal(t, false, *fake.states[0]["light.kitchen"].On)
+}
+
+func TestRequestSync(t *testing.T) {
+	fake := setupHomeGraph(t)
+
+	retained := pubsub.NewRawEvent("config", []byte("devices: {}"))
+	retained.SetRetained(true)
+	recordEvent(retained)
+	assert.Equal(t, 0, fake.syncs)
+	recordEvent(pubsub.NewRawEvent("config", []byte("devices: {}")))
+	assert.Equal(t, 0, fake.syncs)
+	reports.flush()
+	assert.Equal(t, 1, fake.syncs)
+	reports.flush()
+	assert.Equal(t, 1, fake.syncs)
+
+	payload, _ := syncRequest()
+	assert.True(t, payload.Devices[0].WillReportState)
+}
+
+func TestHomeGraphClient(t *testing.T) {
+	signer, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	der, _ := x509.MarshalPKCS8PrivateKey(signer)
+	var requests []string
+	tokens := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokens++
+			assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.FormValue("grant_type"))
+			assert.Len(t, strings.Split(r.FormValue("assertion"), "."), 3)
+			w.Write([]byte(`{"access_token":"secret","expires_in":3600}`))
+		default:
+			assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "gohome", body["agentUserId"])
+			requests = append(requests, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	key := ServiceAccountKey{
+		ClientEmail: "gohome@example.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenUri:    server.URL + "/token",
+	}
+	client, err := newHomeGraphClient(key, server.URL+"/v1")
+	assert.NoError(t, err)
+	assert.NoError(t, client.ReportState(map[string]DeviceState{"light.kitchen": {Online: true, On: pbool(true)}}))
+	assert.NoError(t, client.RequestSync())
+	assert.Equal(t, []string{"/v1/devices:reportStateAndNotification", "/v1/devices:requestSync"}, requests)
+	// token reused until it expires
+	assert.Equal(t, 1, tokens)
+
+	_, err = newHomeGraphClient(ServiceAccountKey{PrivateKey: "invalid"}, server.URL)
+	assert.Error(t, err)
+}
@@ -7,9 +7,13 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/RangelReale/osin"
+	"github.com/barnybug/gohome/config"
 	"github.com/barnybug/gohome/pubsub"
 	"github.com/barnybug/gohome/services"
 )
@@ -161,80 +165,116 @@ var types = map[string]string{
 	"switch": "action.devices.types.OUTLET",
 }
 
-func syncRequest() (*SyncResponsePayload, error) {
-	log.Println("Received sync request")
-	out := []Device{}
-	for _, device := range services.Config.Devices {
-		if device.Group == "" {
-			continue
-		}
-		if device.Location == "" {
-			continue
-		}
+// configured scenes are exposed as scene devices with this prefix
+const scenePrefix = "scene."
+
+func sortedScenes() []string {
+	var ids []string
+	for id := range services.Config.Scenes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
 
-		typ := "action.devices.types.SWITCH"
-		traits := []string{}
-		attributes := map[string]interface{}{}
+// the agent's user, of the devices synced
+const agentUserId = "gohome"
 
-		if contains(device.Caps, "presence") {
-			continue
-		}
-		if contains(device.Caps, "switch") {
-			traits = append(traits, "action.devices.traits.OnOff")
-		}
-		if contains(device.Caps, "dimmer") {
-			typ = "action.devices.types.LIGHT"
-			traits = append(traits, "action.devices.traits.Brightness")
+// syncDevice returns the device to sync to Google, if it's exposed.
+func syncDevice(device config.DeviceConf) (Device, bool) {
+	if device.Group == "" || device.Location == "" {
+		return Device{}, false
+	}
+
+	typ := "action.devices.types.SWITCH"
+	traits := []string{}
+	attributes := map[string]interface{}{}
+
+	if contains(device.Caps, "presence") {
+		return Device{}, false
+	}
+	if contains(device.Caps, "switch") {
+		traits = append(traits, "action.devices.traits.OnOff")
+	}
+	if contains(device.Caps, "dimmer") {
+		typ = "action.devices.types.LIGHT"
+		traits = append(traits, "action.devices.traits.Brightness")
+	}
+	if contains(device.Caps, "colourtemp") || contains(device.Caps, "colour") {
+		typ = "action.devices.types.LIGHT"
+		traits = append(traits, "action.devices.traits.ColorSetting")
+		if contains(device.Caps, "colour") {
+			attributes["colorModel"] = "rgb"
 		}
-		if contains(device.Caps, "colourtemp") || contains(device.Caps, "colour") {
-			typ = "action.devices.types.LIGHT"
-			traits = append(traits, "action.devices.traits.ColorSetting")
-			if contains(device.Caps, "colour") {
-				attributes["colorModel"] = "rgb"
+		if contains(device.Caps, "colourtemp") {
+			attributes["colorTemperatureRange"] = map[string]interface{}{
+				"temperatureMinK": 2200,
+				"temperatureMaxK": 6700,
 			}
-			if contains(device.Caps, "colourtemp") {
-				attributes["colorTemperatureRange"] = map[string]interface{}{
-					"temperatureMinK": 2200,
-					"temperatureMaxK": 6700,
-				}
-			}
-		}
-		if contains(device.Caps, "scene") {
-			typ = "action.devices.types.SCENE"
-			traits = append(traits, "action.devices.traits.Scene")
-			attributes["sceneReversible"] = contains(device.Caps, "reversible")
-		}
-		if contains(device.Caps, "thermostat") {
-			typ = "action.devices.types.THERMOSTAT"
-			traits = append(traits, "action.devices.traits.TemperatureSetting")
-			attributes["availableThermostatModes"] = "heat"
-			attributes["thermostatTemperatureUnit"] = "C"
-		}
-		if contains(device.Caps, "washer") {
-			typ = "action.devices.types.WASHER"
-		}
-		if len(traits) == 0 {
-			continue
 		}
+	}
+	if contains(device.Caps, "scene") {
+		typ = "action.devices.types.SCENE"
+		traits = append(traits, "action.devices.traits.Scene")
+		attributes["sceneReversible"] = contains(device.Caps, "reversible")
+	}
+	if contains(device.Caps, "thermostat") {
+		typ = "action.devices.types.THERMOSTAT"
+		traits = append(traits, "action.devices.traits.TemperatureSetting")
+		attributes["availableThermostatModes"] = "heat"
+		attributes["thermostatTemperatureUnit"] = "C"
+	}
+	if contains(device.Caps, "washer") {
+		typ = "action.devices.types.WASHER"
+	}
+	if len(traits) == 0 {
+		return Device{}, false
+	}
 
-		ps := strings.SplitN(device.Id, ".", 2)
-		if _, ok := types[ps[0]]; ok {
-			typ = types[ps[0]]
+	ps := strings.SplitN(device.Id, ".", 2)
+	if _, ok := types[ps[0]]; ok {
+		typ = types[ps[0]]
+	}
+	nicknames := append([]string{device.Name}, device.Aliases...)
+	o := Device{
+		Id:              device.Id,
+		Type:            typ,
+		Traits:          traits,
+		Attributes:      attributes,
+		Name:            DeviceName{Name: device.Name, Nicknames: nicknames},
+		RoomHint:        device.Location,
+		WillReportState: Homegraph != nil,
+	}
+	return o, true
+}
+
+func syncRequest() (*SyncResponsePayload, error) {
+	log.Println("Received sync request")
+	out := []Device{}
+	for _, device := range services.Config.Devices {
+		if o, ok := syncDevice(device); ok {
+			out = append(out, o)
+		}
+	}
+	for _, id := range sortedScenes() {
+		scene := services.Config.Scenes[id]
+		name := scene.Name
+		if name == "" {
+			name = id
 		}
-		nicknames := append([]string{device.Name}, device.Aliases...)
 		o := Device{
-			Id:              device.Id,
-			Type:            typ,
-			Traits:          traits,
-			Attributes:      attributes,
-			Name:            DeviceName{Name: device.Name, Nicknames: nicknames},
-			RoomHint:        device.Location,
+			Id:              scenePrefix + id,
+			Type:            "action.devices.types.SCENE",
+			Traits:          []string{"action.devices.traits.Scene"},
+			Attributes:      map[string]interface{}{"sceneReversible": false},
+			Name:            DeviceName{Name: name, Nicknames: []string{name}},
+			RoomHint:        scene.Location,
 			WillReportState: false,
 		}
 		out = append(out, o)
 	}
 	payload := SyncResponsePayload{
-		AgentUserId: "gohome",
+		AgentUserId: agentUserId,
 		Devices:     out,
 	}
 	return &payload, nil
@@ -263,10 +303,15 @@ func checkAuthorization(r *http.Request) error {
 		return errors.New("Authorization header invalid")
 	}
 	token := auth[7:]
-	// TODO check token
 	if token == "" {
 		return errors.New("Authorization token invalid")
 	}
+	if Tokens != nil {
+		d, err := Tokens.LoadAccess(token)
+		if err != nil || d.IsExpired() {
+			return errors.New("Authorization token invalid")
+		}
+	}
 	return nil
 }
 
@@ -278,66 +323,106 @@ func pstring(s string) *string {
 	return &s
 }
 
-func queryRequest(request QueryRequestPayload) (*QueryResponsePayload, error) {
-	log.Println("Received query request")
-	result := QueryResponsePayload{
-		Devices: map[string]DeviceState{},
+// deviceState returns the device's state, from the events recorded.
+func deviceState(device config.DeviceConf) DeviceState {
+	events := DeviceEvents[device.Id]
+	m := DeviceState{
+		Online: true,
 	}
-	for _, q := range request.Devices {
-		id := q.Id
-		if device, ok := services.Config.Devices[id]; ok {
-			events := DeviceEvents[id]
-			m := DeviceState{
-				Online: true,
+	if contains(device.Caps, "switch") {
+		if state, ok := events["state"]; ok {
+			switch state.StringField("state") {
+			case "On":
+				m.On = pbool(true)
+			case "Off":
+				m.On = pbool(false)
 			}
-			if contains(device.Caps, "switch") {
-				if state, ok := events["state"]; ok {
-					switch state.StringField("state") {
-					case "On":
-						m.On = pbool(true)
-					case "Off":
-						m.On = pbool(false)
-					}
-				}
+		} else if ack, ok := events["ack"]; ok {
+			switch ack.Command() {
+			case "on":
+				m.On = pbool(true)
+			case "off":
+				m.On = pbool(false)
 			}
-			if ack, ok := events["ack"]; ok {
-				if contains(device.Caps, "dimmer") && ack.IsSet("level") {
-					level := ack.FloatField("level")
-					m.Brightness = int(level)
-				}
-				if contains(device.Caps, "temp") && ack.IsSet("temp") {
-					temp := ack.FloatField("temp")
-					m.Color = &ColorState{
-						Temperature: int(temp),
-					}
-				}
+		}
+	}
+	if ack, ok := events["ack"]; ok {
+		if contains(device.Caps, "dimmer") && ack.IsSet("level") {
+			level := ack.FloatField("level")
+			m.Brightness = int(level)
+		}
+		if (contains(device.Caps, "colourtemp") || contains(device.Caps, "temp")) && ack.IsSet("temp") {
+			temp := ack.FloatField("temp")
+			m.Color = &ColorState{
+				Temperature: int(temp),
 			}
-			if contains(device.Caps, "thermostat") {
-				target := 0.0
-				ambient := 0.0
-				if thermostat, ok := events["thermostat"]; ok {
-					target = thermostat.FloatField("target")
-					// find equivalent trv device
-					trvname := strings.Replace(device.Id, "thermostat.", "trv.", 1)
-					if trv, ok := DeviceEvents[trvname]; ok {
-						if event, ok := trv["temp"]; ok {
-							ambient = event.FloatField("temp")
-						}
-					}
+		}
+	}
+	if contains(device.Caps, "thermostat") {
+		target := 0.0
+		ambient := 0.0
+		if thermostat, ok := events["thermostat"]; ok {
+			target = thermostat.FloatField("target")
+			// find equivalent trv device
+			trvname := strings.Replace(device.Id, "thermostat.", "trv.", 1)
+			if trv, ok := DeviceEvents[trvname]; ok {
+				if event, ok := trv["temp"]; ok {
+					ambient = event.FloatField("temp")
 				}
-				mode := "heat"
-				m.ThermostatMode = &mode
-				m.ThermostatTemperatureSetpoint = &target
-				m.ThermostatTemperatureAmbient = &ambient
 			}
-			result.Devices[device.Id] = m
+		}
+		mode := "heat"
+		m.ThermostatMode = &mode
+		m.ThermostatTemperatureSetpoint = &target
+		m.ThermostatTemperatureAmbient = &ambient
+	}
+	return m
+}
+
+func queryRequest(request QueryRequestPayload) (*QueryResponsePayload, error) {
+	log.Println("Received query request")
+	result := QueryResponsePayload{
+		Devices: map[string]DeviceState{},
+	}
+	for _, q := range request.Devices {
+		if device, ok := services.Config.Devices[q.Id]; ok {
+			result.Devices[device.Id] = deviceState(device)
 		}
 	}
 
 	return &result, nil
 }
 
+func executeScene(id string, executions []Execution) ExecuteResult {
+	result := ExecuteResult{
+		Ids: []string{scenePrefix + id},
+	}
+	for _, execution := range executions {
+		if execution.Command != "action.devices.commands.ActivateScene" {
+			continue
+		}
+		if execution.Params.Deactivate != nil && *execution.Params.Deactivate {
+			// scenes are not reversible
+			continue
+		}
+		if err := services.SendScene(id); err != nil {
+			log.Println("Error:", err)
+			result.Status = "ERROR"
+			result.Errorcode = "hardError"
+			return result
+		}
+	}
+	result.Status = "SUCCESS"
+	return result
+}
+
 func executeCommands(device string, executions []Execution) ExecuteResult {
+	if _, ok := services.Config.Devices[device]; !ok && strings.HasPrefix(device, scenePrefix) {
+		id := strings.TrimPrefix(device, scenePrefix)
+		if _, ok := services.Config.Scenes[id]; ok {
+			return executeScene(id, executions)
+		}
+	}
 	result := ExecuteResult{
 		Ids: []string{device},
 	}
@@ -502,23 +587,164 @@ func (self *Service) ID() string {
 	return "googlehome"
 }
 
+// Tokens issued to Google, checked on actions.
+var Tokens Storage
+
+// Homegraph reports state to Google, if configured with a service account.
+var Homegraph HomeGraph
+
+// reportDelay debounces reports to Google, batching the changes within it.
+const reportDelay = 2 * time.Second
+
+// reporter queues device states to report to Google (and requests to sync),
+// so the event loop never waits on HomeGraph.
+type reporter struct {
+	lock     sync.Mutex
+	pending  map[string]DeviceState
+	resync   bool
+	kick     chan bool
+	reported map[string]string // the state last reported of each device
+}
+
+func newReporter() *reporter {
+	return &reporter{
+		pending:  map[string]DeviceState{},
+		kick:     make(chan bool, 1),
+		reported: map[string]string{},
+	}
+}
+
+var reports = newReporter()
+
+// queue the state of a device to report, replacing any pending.
+func (self *reporter) queue(id string, state DeviceState) {
+	self.lock.Lock()
+	self.pending[id] = state
+	self.lock.Unlock()
+	self.wake()
+}
+
+// requestSync of the devices with Google.
+func (self *reporter) requestSync() {
+	self.lock.Lock()
+	self.resync = true
+	self.lock.Unlock()
+	self.wake()
+}
+
+func (self *reporter) wake() {
+	select {
+	case self.kick <- true:
+	default:
+	}
+}
+
+// flush any request to sync, and the pending states that changed to Google,
+// in one request.
+func (self *reporter) flush() {
+	self.lock.Lock()
+	pending, resync := self.pending, self.resync
+	self.pending = map[string]DeviceState{}
+	self.resync = false
+	self.lock.Unlock()
+
+	if resync {
+		if err := Homegraph.RequestSync(); err != nil {
+			log.Println("Failed to request sync:", err)
+		}
+	}
+
+	states := map[string]DeviceState{}
+	for id, state := range pending {
+		data, _ := json.Marshal(state)
+		if self.reported[id] != string(data) {
+			states[id] = state
+		}
+	}
+	if len(states) == 0 {
+		return
+	}
+	if err := Homegraph.ReportState(states); err != nil {
+		log.Printf("Failed to report state of %d devices: %s", len(states), err)
+		return
+	}
+	for id, state := range states {
+		data, _ := json.Marshal(state)
+		self.reported[id] = string(data)
+	}
+}
+
+func (self *reporter) run() {
+	for range self.kick {
+		time.Sleep(reportDelay)
+		self.flush()
+	}
+}
+
+// reportState of a device to Google, if synced.
+func reportState(id string) {
+	device, ok := services.Config.Devices[id]
+	if !ok {
+		return
+	}
+	if _, ok := syncDevice(device); !ok {
+		return
+	}
+	reports.queue(id, deviceState(device))
+}
+
+func recordEvent(ev *pubsub.Event) {
+	if ev.Topic == "config" {
+		if Homegraph != nil && !ev.Retained {
+			// devices changed
+			reports.requestSync()
+		}
+		return
+	}
+	if ev.Device() == "" {
+		return
+	}
+	if _, ok := DeviceEvents[ev.Device()]; !ok {
+		DeviceEvents[ev.Device()] = make(map[string]*pubsub.Event)
+	}
+	DeviceEvents[ev.Device()][ev.Topic] = ev
+	if Homegraph == nil || ev.Topic == "command" {
+		return
+	}
+	reportState(ev.Device())
+	if strings.HasPrefix(ev.Device(), "trv.") {
+		// a trv's temperature is its thermostat's ambient
+		reportState(strings.Replace(ev.Device(), "trv.", "thermostat.", 1))
+	}
+}
+
 func recordEvents() {
 	for ev := range services.Subscriber.Subscribe(pubsub.All()) {
-		if ev.Device() == "" {
-			continue
-		}
-		if _, ok := DeviceEvents[ev.Device()]; !ok {
-			DeviceEvents[ev.Device()] = make(map[string]*pubsub.Event)
+		recordEvent(ev)
+	}
+}
+
+// sweep expired tokens hourly.
+func sweep(storage Storage) {
+	for now := range time.Tick(time.Hour) {
+		if n := storage.Sweep(now); n > 0 {
+			log.Printf("Swept %d expired tokens", n)
 		}
-		DeviceEvents[ev.Device()][ev.Topic] = ev
 	}
 }
 
 // Run the service
 func (self *Service) Run() error {
+	if c := services.Config.Googlehome; c.Service_Account != "" {
+		homegraph, err := NewHomeGraph(c.Service_Account, HomeGraphUrl)
+		if err != nil {
+			log.Fatalf("HomeGraph service account: %s", err)
+		}
+		Homegraph = homegraph
+		go reports.run()
+	}
 	go recordEvents()
-	// FileStorage implements the "osin.Storage" interface, persists to gob encoded file
-	storage := NewFileStorage()
+	storage := NewFileStorage(DefaultStorageFile)
 	c := services.Config.Googlehome
 	storage.SetClient(c.Id, &osin.DefaultClient{
 		Id:          c.Id,
@@ -530,7 +756,12 @@ func (self *Service) Run() error {
 		log.Fatalf("Restoring storage: %+v", err)
 	}
 	log.Printf("Restored tokens: %d authorize, %d access, %d refresh", len(storage.Authorize), len(storage.Access), len(storage.Refresh))
+	if n := storage.Sweep(time.Now()); n > 0 {
+		log.Printf("Swept %d expired tokens", n)
+	}
 	storage.Persist()
+	Tokens = storage
+	go sweep(storage)
 	config := osin.NewServerConfig()
 	config.AllowClientSecretInParams = true
 	config.AllowedAccessTypes = osin.AllowedAccessType{
@@ -572,3 +803,48 @@ func (self *Service) Run() error {
 	http.ListenAndServe(":8085", loggingHandler{http.DefaultServeMux})
 	return nil
 }
+
+func (self *Service) QueryHandlers() services.QueryHandlers {
+	return services.QueryHandlers{
+		"grants": services.TextHandler(queryGrants),
+		"revoke": services.TextHandler(queryRevoke),
+		"help": services.StaticHandler("" +
+			"grants: list tokens granted to Google\n" +
+			"revoke token|all: revoke tokens granted\n"),
+	}
+}
+
+func queryGrants(q services.Question) string {
+	if Tokens == nil {
+		return "Not running"
+	}
+	grants := Tokens.Grants(time.Now())
+	if len(grants) == 0 {
+		return "No grants"
+	}
+	var lines []string
+	for _, g := range grants {
+		line := fmt.Sprintf("%s %s created %s, expires %s", g.Token, g.Client,
+			g.CreatedAt.Format(time.Stamp), g.ExpiresAt.Format(time.Stamp))
+		if g.Refresh {
+			line += " (refreshable)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func queryRevoke(q services.Question) string {
+	if Tokens == nil {
+		return "Not running"
+	}
+	token := strings.TrimSpace(q.Args)
+	if token == "" {
+		return "Usage: revoke token|all"
+	}
+	n := Tokens.Revoke(token)
+	if n == 0 {
+		return "No grants matching " + token
+	}
+	return fmt.Sprintf("Revoked %d grants", n)
+}
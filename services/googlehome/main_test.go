@@ -8,6 +8,7 @@ import (
 
 	"github.com/barnybug/gohome/config"
 	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
 	"github.com/barnybug/gohome/services"
 	"github.com/stretchr/testify/assert"
 )
@@ -85,3 +86,35 @@ func TestQueryThermostat(t *testing.T) {
 	assert.Equal(t, `{"requestId":"123","payload":{"devices":{"thermostat.living":{"online":true,"thermostatMode":"heat","thermostatTemperatureSetpoint":17,"thermostatTemperatureAmbient":19.5}}}}
 `, rr.Body.String())
 }
+
+func TestSyncScenes(t *testing.T) {
+	services.Config = config.ExampleConfig
+
+	body := `{"inputs":[{"intent":"action.devices.SYNC"}],"requestId":"1"}`
+	req, _ := http.NewRequest("POST", "/actions", strings.NewReader(body))
+	req.Header.Add("Authorization", "Bearer xyz")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(actionsEndpoint)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `{"id":"scene.movie","type":"action.devices.types.SCENE","traits":["action.devices.traits.Scene"],"name":{"name":"Movie time","nicknames":["Movie time"]},"willReportState":false,"attributes":{"sceneReversible":false},"roomHint":"Living Room"}`)
+}
+
+func TestExecuteScene(t *testing.T) {
+	services.Config = config.ExampleConfig
+	me := dummy.Publisher{}
+	services.Publisher = &me
+
+	body := `{"inputs":[{"intent":"action.devices.EXECUTE","payload":{"commands":[{"devices":[{"id":"scene.movie"}],"execution":[{"command":"action.devices.commands.ActivateScene","params":{"deactivate":false}}]}]}}],"requestId":"1"}`
+	req, _ := http.NewRequest("POST", "/actions", strings.NewReader(body))
+	req.Header.Add("Authorization", "Bearer xyz")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(actionsEndpoint)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"ids":["scene.movie"],"status":"SUCCESS"`)
+	assert.Equal(t, 2, len(me.Events))
+	assert.Equal(t, "light.glowworm", me.Events[0].Device())
+}
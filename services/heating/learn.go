@@ -0,0 +1,128 @@
+package heating
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// forgetting factor per sample, so the model follows seasonal changes
+	rateDecay = 0.995
+	// samples before the model's used
+	rateMinSamples = 10
+	// outside temperature spread (variance) needed to fit the slope
+	rateMinVariance = 1.0
+	// heating on this long before samples are taken, to ignore warm up of
+	// the boiler and radiators
+	rateWarmup = 10 * time.Minute
+	// readings further apart aren't used
+	rateMaxGap = 30 * time.Minute
+	// outside temperature readings older aren't used
+	maxOutsideAge = time.Hour
+	// slowest rate worth starting early for, °C/hr
+	minPreheatRate = 0.1
+)
+
+// HeatingRate learns a zone's rate of heating (°C/hr) as a linear function
+// of the outside temperature, by exponentially weighted least squares.
+type HeatingRate struct {
+	N   float64 `json:"n"`
+	Sx  float64 `json:"sx"`
+	Sy  float64 `json:"sy"`
+	Sxx float64 `json:"sxx"`
+	Sxy float64 `json:"sxy"`
+}
+
+// Add a sample of the heating rate at an outside temperature.
+func (self *HeatingRate) Add(outside, rate float64) {
+	self.N = self.N*rateDecay + 1
+	self.Sx = self.Sx*rateDecay + outside
+	self.Sy = self.Sy*rateDecay + rate
+	self.Sxx = self.Sxx*rateDecay + outside*outside
+	self.Sxy = self.Sxy*rateDecay + outside*rate
+}
+
+// Fit returns the rate at 0°C outside, and change per °C outside. The slope
+// is 0 until there's enough spread of outside temperatures.
+func (self *HeatingRate) Fit() (intercept, slope float64, ok bool) {
+	if self.N < rateMinSamples {
+		return 0, 0, false
+	}
+	mx := self.Sx / self.N
+	my := self.Sy / self.N
+	variance := self.Sxx/self.N - mx*mx
+	if variance < rateMinVariance {
+		return my, 0, true
+	}
+	slope = (self.Sxy/self.N - mx*my) / variance
+	return my - slope*mx, slope, true
+}
+
+// Predict the heating rate at an outside temperature.
+func (self *HeatingRate) Predict(outside float64) (float64, bool) {
+	intercept, slope, ok := self.Fit()
+	if !ok {
+		return 0, false
+	}
+	return intercept + slope*outside, true
+}
+
+// outside temperature, if a recent reading's known.
+func (self *Service) outside(now time.Time) (float64, bool) {
+	if self.OutsideAt.IsZero() || now.Sub(self.OutsideAt) > maxOutsideAge {
+		return 0, false
+	}
+	return self.Outside, true
+}
+
+// learn the zone's heating rate from a new reading, if it's been heating
+// steadily since the previous reading.
+func (self *Service) learn(zone *Zone, temp float64, at time.Time) {
+	if zone.At.IsZero() || !self.State || zone.At.Sub(self.StateChanged) < rateWarmup {
+		return
+	}
+	gap := at.Sub(zone.At)
+	if gap < time.Minute || gap > rateMaxGap {
+		return
+	}
+	if zone.Temp >= self.Target(zone, zone.At) {
+		// not calling for heat
+		return
+	}
+	outside, ok := self.outside(at)
+	if !ok {
+		return
+	}
+	rate := (temp - zone.Temp) / gap.Hours()
+	// bound outliers (eg. a sensor in sunlight)
+	rate = math.Max(-5, math.Min(rate, 10))
+	zone.Learned.Add(outside, rate)
+}
+
+// preheat returns the zone's next scheduled setpoint if it's time to start
+// heating early to reach it on time (optimum start).
+func (self *Service) preheat(zone *Zone, now time.Time, current float64) (float64, bool) {
+	if self.Preheat == 0 || zone.At.IsZero() {
+		return 0, false
+	}
+	at, next, ok := self.Next(zone, now)
+	if !ok || next <= current || zone.Temp >= next {
+		return 0, false
+	}
+	outside, ok := self.outside(now)
+	if !ok {
+		return 0, false
+	}
+	rate, ok := zone.Learned.Predict(outside)
+	if !ok || rate < minPreheatRate {
+		return 0, false
+	}
+	lead := time.Duration((next - zone.Temp) / rate * float64(time.Hour))
+	if lead > self.Preheat {
+		lead = self.Preheat
+	}
+	if now.Before(at.Add(-lead)) {
+		return 0, false
+	}
+	return next, true
+}
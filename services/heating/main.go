@@ -1,6 +1,33 @@
 // Service to thermostatically control central heating by schedule and zone.
 // Supports multiple temperature points on a daily schedule, temporary
 // override ('party mode'), hibernation when the house is empty.
+//
+// Zones with a weekly schedule are set by it, otherwise by the target set by
+// thermostat events. In order of precedence, a zone's setpoint is:
+//
+//	window   - the minimum, while a window's open
+//	party    - party temperature, until it ends
+//	away     - heating.away when everyone's away, if set (scheduled zones)
+//	holiday  - a holiday's temperature, or schedule of its day
+//	preheat  - the next scheduled setpoint, starting early to reach it on time
+//	schedule - the zone's weekly schedule (at least the minimum)
+//	target   - the target set for the zone
+//
+// Optimum start learns each zone's heating rate against the outside
+// temperature (heating.outside, or weather.sensors.temp), and starts heating up
+// to heating.preheat early. What's learned is kept in the retained heating
+// status.
+//
+// Zones with radiator valves (heating.zones.<zone>.valves) have them opened in
+// proportion to how far they're below their setpoint, fully open a band
+// (heating.band, default 1°C) below. The boiler fires when the zones' total
+// demand reaches heating.demand (default 25%), and stays on or off for at least
+// heating.min_on/min_off to prevent short cycling.
+//
+// A zone's heating is suspended while any of its window contact sensors
+// (heating.zones.<zone>.windows) are open, or for heating.window.suspend
+// (default 30m) when its temperature falls faster than heating.window.drop
+// °C/hr, with an alert to heating.window.alert.
 package heating
 
 import (
@@ -8,6 +35,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -18,10 +46,6 @@ import (
 	"github.com/barnybug/gohome/util"
 )
 
-var Clock = func() time.Time {
-	return time.Now()
-}
-
 var maxTempAge, _ = time.ParseDuration("6m")
 
 const (
@@ -31,15 +55,31 @@ const (
 
 const Midnight = 24 * 60
 
+const (
+	DefaultBand   = 1.0
+	DefaultDemand = 25.0
+	// valve positions are sent in steps of this (%)
+	valveStep = 10
+)
+
 type Zone struct {
-	Thermostat string    `json:"thermostat"`
-	Temp       float64   `json:"temp"`
-	Target     float64   `json:"target"`
-	Rate       float64   `json:"rate"`
-	At         time.Time `json:"at"`
-	PartyTemp  float64   `json:"party_temp"`
-	PartyUntil time.Time `json:"party_until"`
-	Sensor     string    `json:"sensor"`
+	Thermostat     string      `json:"thermostat"`
+	Temp           float64     `json:"temp"`
+	Target         float64     `json:"target"`
+	Rate           float64     `json:"rate"`
+	At             time.Time   `json:"at"`
+	PartyTemp      float64     `json:"party_temp"`
+	PartyUntil     time.Time   `json:"party_until"`
+	Sensor         string      `json:"sensor"`
+	Learned        HeatingRate `json:"learned"`
+	Valves         []string    `json:"valves,omitempty"`
+	Demand         float64     `json:"demand"`
+	Valve          int         `json:"valve"`
+	WindowOpen     bool        `json:"window_open"`
+	SuspendedUntil time.Time   `json:"suspended_until"`
+	schedule       *Schedule
+	valveSent      bool
+	windows        map[string]bool // contact sensor -> open
 }
 
 func (self *Zone) Update(temp float64, at time.Time) {
@@ -61,6 +101,21 @@ func (self *Zone) Check(now time.Time, target float64) bool {
 	return (self.Temp < target)
 }
 
+// demand for heat (%) to reach target. Zones with valves demand in proportion
+// within band below target, others all or nothing.
+func (self *Zone) demand(now time.Time, target, band float64) float64 {
+	if len(self.Valves) == 0 {
+		if self.Check(now, target) {
+			return 100
+		}
+		return 0
+	}
+	if now.Sub(self.At) >= maxTempAge {
+		return 0
+	}
+	return math.Max(0, math.Min((target-self.Temp)/band*100, 100))
+}
+
 func (self *Zone) setParty(temp float64, duration time.Duration, at time.Time) {
 	self.PartyTemp = temp
 	self.PartyUntil = at.Add(duration)
@@ -76,7 +131,23 @@ type Service struct {
 	State         bool
 	StateChanged  time.Time
 	Minimum       float64
+	Band          float64
+	Demand        float64 // total demand to fire the boiler
+	MinOn         time.Duration
+	MinOff        time.Duration
+	WindowDrop    float64
+	WindowSuspend time.Duration
+	WindowAlert   string
+	AwayTemp      float64
+	Away          bool
+	Preheat       time.Duration
+	OutsideSensor string
+	Outside       float64
+	OutsideAt     time.Time
+	People        map[string]bool // person -> present
+	holidays      []holiday
 	Publisher     pubsub.Publisher
+	ticker        *util.Scheduler
 }
 
 func (self *Service) Heartbeat() {
@@ -86,7 +157,7 @@ func (self *Service) Heartbeat() {
 	fields := pubsub.Fields{
 		"device":  "heating",
 		"heating": self.State,
-		"status":  self.Json(Clock()),
+		"status":  self.Json(util.Now()),
 	}
 	ev := pubsub.NewEvent("heating", fields)
 	ev.SetRetained(true)
@@ -109,6 +180,9 @@ func (self *Service) restoreState(ev *pubsub.Event) {
 			return
 		}
 
+		if away, ok := state["away"].(bool); ok {
+			self.Away = away
+		}
 		for zone, z := range self.Zones {
 			if old, ok := zones[zone]; ok {
 				z.Temp = old.Temp
@@ -117,14 +191,23 @@ func (self *Service) restoreState(ev *pubsub.Event) {
 				z.At = old.At
 				z.PartyTemp = old.PartyTemp
 				z.PartyUntil = old.PartyUntil
+				z.Learned = old.Learned
+				z.SuspendedUntil = old.SuspendedUntil
 				log.Printf("Restored zone '%s' temp: %v target: %v", zone, z.Temp, z.Target)
 			}
 		}
 	}
 }
 
-func (self *Service) handleEvent(ev *pubsub.Event) {
+// HandleEvent handles a temp, heating, presence or (window) sensor event.
+func (self *Service) HandleEvent(ev *pubsub.Event) {
 	switch ev.Topic {
+	case "presence":
+		self.presence(ev.Device(), ev.Command() == "on")
+
+	case "sensor":
+		self.window(ev.Device(), ev.Command() == "on", ev.Retained)
+
 	case "heating":
 		if ev.Retained {
 			// restore heating state on restart
@@ -134,15 +217,33 @@ func (self *Service) handleEvent(ev *pubsub.Event) {
 	case "temp":
 		// temperature device update
 		device := ev.Device()
+		temp, _ := ev.Fields["temp"].(float64)
+		timestamp := ev.Timestamp.Local() // must use Local time, as schedule is in local
+		if device == self.OutsideSensor {
+			self.Outside = temp
+			self.OutsideAt = timestamp
+		}
 		if zone, ok := self.Sensors[device]; ok {
-			temp, _ := ev.Fields["temp"].(float64)
-			timestamp := ev.Timestamp.Local() // must use Local time, as schedule is in local
+			if self.windowDrop(zone, temp, timestamp) {
+				self.suspend(self.zoneName(zone), zone, timestamp)
+			} else {
+				self.learn(zone, temp, timestamp)
+			}
 			zone.Update(temp, timestamp)
 			self.Check(false)
 		}
 	}
 }
 
+func (self *Service) zoneName(zone *Zone) string {
+	for name, z := range self.Zones {
+		if z == zone {
+			return name
+		}
+	}
+	return ""
+}
+
 func (self *Service) setParty(name string, temp float64, duration time.Duration, at time.Time) error {
 	if name == "all" {
 		for _, zone := range self.Zones {
@@ -157,24 +258,119 @@ func (self *Service) setParty(name string, temp float64, duration time.Duration,
 	}
 }
 
-func (self *Service) Target(zone *Zone, now time.Time) float64 {
+// presence of people, from the presence service. If heating.away is set,
+// heating goes into away when everyone's left, and out when anyone's back.
+func (self *Service) presence(person string, present bool) {
+	if _, ok := self.People[person]; !ok {
+		return
+	}
+	self.People[person] = present
+	if self.AwayTemp == 0 {
+		// not opted in
+		return
+	}
+	away := true
+	for _, p := range self.People {
+		away = away && !p
+	}
+	if away != self.Away {
+		log.Printf("Away: %v", away)
+		self.Away = away
+		self.Check(true)
+	}
+}
+
+// weekday of the schedule to use on a date.
+func (self *Service) weekday(t time.Time) time.Weekday {
+	for _, h := range self.holidays {
+		if h.useDay && h.covers(t) {
+			return h.day
+		}
+	}
+	return t.Weekday()
+}
+
+// scheduled returns the zone's setpoint by holidays and schedule, if any.
+func (self *Service) scheduled(zone *Zone, t time.Time) (float64, string, bool) {
+	t = t.Local() // schedule is in local time
+	for _, h := range self.holidays {
+		if !h.useDay && h.covers(t) {
+			return h.temp, "holiday", true
+		}
+	}
+	if zone.schedule == nil {
+		return 0, "", false
+	}
+	temp, ok := zone.schedule.At(t, self.weekday)
+	if !ok {
+		return 0, "", false
+	}
+	if temp < self.Minimum {
+		temp = self.Minimum
+	}
+	mode := "schedule"
+	if self.weekday(t) != t.Weekday() {
+		mode = "holiday"
+	}
+	return temp, mode, true
+}
+
+// Setpoint returns the zone's target temperature at now, and what set it.
+func (self *Service) Setpoint(zone *Zone, now time.Time) (float64, string) {
+	if zone.suspended(now) {
+		return self.Minimum, "window"
+	}
 	if now.Before(zone.PartyUntil) {
-		return zone.PartyTemp
-	} else {
-		return zone.Target
+		return zone.PartyTemp, "party"
 	}
+	if self.Away && zone.schedule != nil {
+		// zones without a schedule follow their target
+		if self.AwayTemp != 0 {
+			return self.AwayTemp, "away"
+		}
+		return self.Minimum, "away"
+	}
+	if temp, mode, ok := self.scheduled(zone, now); ok {
+		if next, ok := self.preheat(zone, now, temp); ok {
+			return next, "preheat"
+		}
+		return temp, mode
+	}
+	return zone.Target, "target"
+}
+
+func (self *Service) Target(zone *Zone, now time.Time) float64 {
+	target, _ := self.Setpoint(zone, now)
+	return target
+}
+
+// Next returns the next change of the zone's scheduled setpoint after now.
+func (self *Service) Next(zone *Zone, now time.Time) (time.Time, float64, bool) {
+	current, _, ok := self.scheduled(zone, now)
+	if !ok && len(self.holidays) == 0 {
+		return time.Time{}, 0, false
+	}
+	for _, t := range zone.schedule.changes(now.Local(), self.weekday) {
+		temp, _, ok := self.scheduled(zone, t)
+		if ok && temp != current {
+			return t, temp, true
+		}
+	}
+	return time.Time{}, 0, false
 }
 
 func (self *Service) Check(emitEvents bool) {
-	now := Clock()
-	state := false
+	now := util.Now()
+	total := 0.0
 	trigger := ""
 	for id, zone := range self.Zones {
 		target := self.Target(zone, now)
-		if zone.Check(now, target) {
-			state = true
+		zone.Demand = zone.demand(now, target, self.Band)
+		if zone.Demand > 0 && (trigger == "" || zone.Demand > self.Zones[trigger].Demand) {
 			trigger = id
 		}
+		total += zone.Demand
+		self.valves(zone, emitEvents)
 		if emitEvents {
 			// emit target event
 			fields := pubsub.Fields{
@@ -192,6 +388,16 @@ func (self *Service) Check(emitEvents bool) {
 	if self.HeatingDevice == "auto" {
 		return
 	}
+	state := total > 0 && total >= self.Demand
+	if state != self.State && !self.StateChanged.IsZero() {
+		// prevent short cycling
+		if self.State && now.Sub(self.StateChanged) < self.MinOn {
+			return
+		}
+		if !self.State && now.Sub(self.StateChanged) < self.MinOff {
+			return
+		}
+	}
 	if !self.State && state {
 		log.Println("Turning on heating for:", trigger)
 	} else if self.State && !state {
@@ -206,6 +412,25 @@ func (self *Service) Check(emitEvents bool) {
 
 }
 
+// valves sends the zone's valves their position for its demand, when it
+// changes, or on the heartbeat.
+func (self *Service) valves(zone *Zone, resend bool) {
+	if len(zone.Valves) == 0 {
+		return
+	}
+	level := int(math.Round(zone.Demand/valveStep)) * valveStep
+	if level == zone.Valve && zone.valveSent && !resend {
+		return
+	}
+	zone.Valve = level
+	zone.valveSent = true
+	for _, valve := range zone.Valves {
+		ev := pubsub.NewCommand(valve, "valve")
+		ev.Fields["level"] = level
+		self.Publisher.Emit(ev)
+	}
+}
+
 func (self *Service) Command() {
 	command := "off"
 	if self.State {
@@ -251,6 +476,23 @@ func (self *Service) Status(now time.Time) string {
 			// pad names to same length
 			msg += fmt.Sprintf(f+" %.1f°C %+.1f°C/hr at %s [%.1f°C]%s", name, zone.Temp, zone.Rate*3600, zone.At.Format(time.Stamp), target, star)
 		}
+		if at, temp, ok := self.Next(zone, now); ok {
+			msg += fmt.Sprintf(" next %.1f°C at %s", temp, at.Local().Format("Mon 15:04"))
+		}
+		if intercept, slope, ok := zone.Learned.Fit(); ok {
+			msg += fmt.Sprintf(" heats %.1f°C/hr %+.2f/°C outside", intercept, slope)
+		}
+		if len(zone.Valves) > 0 {
+			msg += fmt.Sprintf(" demand %.0f%%", zone.Demand)
+		}
+		if zone.WindowOpen {
+			msg += " window open"
+		} else if zone.suspended(now) {
+			msg += fmt.Sprintf(" suspended until %s", zone.SuspendedUntil.Local().Format("15:04"))
+		}
+	}
+	if self.Away {
+		msg += "\nAway"
 	}
 
 	return msg
@@ -261,7 +503,29 @@ func (self *Service) Json(now time.Time) interface{} {
 	zones := map[string]interface{}{}
 	zoneJson, _ := json.Marshal(self.Zones)
 	json.Unmarshal(zoneJson, &zones)
+	for name, zone := range self.Zones {
+		z, _ := zones[name].(map[string]interface{})
+		setpoint, mode := self.Setpoint(zone, now)
+		z["setpoint"] = setpoint
+		z["mode"] = mode
+		z["suspended"] = zone.suspended(now)
+		if at, temp, ok := self.Next(zone, now); ok {
+			z["next"] = map[string]interface{}{
+				"at":   at,
+				"temp": temp,
+			}
+		}
+	}
 	data["zones"] = zones
+	data["away"] = self.Away
+	total := 0.0
+	for _, zone := range self.Zones {
+		total += zone.Demand
+	}
+	data["demand"] = total
+	if outside, ok := self.outside(now); ok {
+		data["outside"] = outside
+	}
 	return data
 }
 
@@ -278,19 +542,32 @@ func (self *Service) Init() error {
 		self.config = services.WaitForConfig()
 	}
 	self.configUpdated()
+	// Run at 2s past the minute to give automata time to send targets
+	self.ticker = util.NewScheduler(time.Duration(2), time.Minute)
 	return nil
 }
 
+func (self *Service) Topics() []pubsub.Topic {
+	return []pubsub.Topic{pubsub.Prefix("temp"), pubsub.Prefix("heating"), pubsub.Prefix("presence"), pubsub.Prefix("sensor")}
+}
+
+// Tick runs the heartbeat if due.
+func (self *Service) Tick() {
+	select {
+	case <-self.ticker.C:
+		self.Heartbeat()
+	default:
+	}
+}
+
 // Run the service
 func (self *Service) Run() error {
-	// Run at 2s past the minute to give automata time to send targets
-	ticker := util.NewScheduler(time.Duration(2), time.Minute)
-	events := services.Subscriber.Subscribe(pubsub.Prefix("temp"), pubsub.Prefix("heating"))
+	events := services.Subscriber.Subscribe(self.Topics()...)
 	for {
 		select {
 		case ev := <-events:
-			self.handleEvent(ev)
-		case <-ticker.C:
+			self.HandleEvent(ev)
+		case <-self.ticker.C:
 			self.Heartbeat()
 		case <-self.config.Updated:
 			self.configUpdated()
@@ -302,12 +579,22 @@ func (self *Service) configUpdated() {
 	conf := self.config.Value.Heating
 	zones := map[string]*Zone{}
 	sensors := map[string]*Zone{}
-	for zone, sensor := range conf.Zones {
+	for zone, zc := range conf.Zones {
 		thermostat := "thermostat." + zone
+		schedule, err := NewSchedule(zc.Schedule, conf.Minimum)
+		if err != nil {
+			log.Printf("Invalid schedule for zone '%s': %s", zone, err)
+		}
 		z := &Zone{
-			Sensor:     sensor,
+			Sensor:     zc.Sensor,
 			Thermostat: thermostat,
 			Target:     conf.Minimum,
+			Valves:     zc.Valves,
+			schedule:   schedule,
+			windows:    map[string]bool{},
+		}
+		for _, window := range zc.Windows {
+			z.windows[window] = false
 		}
 		if old, ok := self.Zones[zone]; ok {
 			// preserve temp/party when live reloading
@@ -317,15 +604,54 @@ func (self *Service) configUpdated() {
 			z.At = old.At
 			z.PartyTemp = old.PartyTemp
 			z.PartyUntil = old.PartyUntil
+			z.Learned = old.Learned
+			z.Demand = old.Demand
+			z.SuspendedUntil = old.SuspendedUntil
+			for window := range z.windows {
+				z.windows[window] = old.windows[window]
+				z.WindowOpen = z.WindowOpen || old.windows[window]
+			}
 		}
 		zones[zone] = z
-		sensors[sensor] = z
+		sensors[zc.Sensor] = z
+	}
+	people := map[string]bool{}
+	for person := range self.config.Value.Presence.People {
+		// assume present until told otherwise
+		people[person] = !self.Away
+		if old, ok := self.People[person]; ok {
+			people[person] = old
+		}
+	}
+	self.People = people
+	self.AwayTemp = conf.Away
+	self.Preheat = conf.Preheat.Duration
+	self.OutsideSensor = conf.Outside
+	if self.OutsideSensor == "" {
+		self.OutsideSensor = self.config.Value.Weather.Sensors.Temp
 	}
+	self.holidays = newHolidays(conf.Holidays)
 	self.HeatingDevice = conf.Device
 	self.Slop = conf.Slop
 	self.Zones = zones
 	self.Sensors = sensors
 	self.Minimum = conf.Minimum
+	self.Band = conf.Band
+	if self.Band <= 0 {
+		self.Band = DefaultBand
+	}
+	self.Demand = conf.Demand
+	if self.Demand <= 0 {
+		self.Demand = DefaultDemand
+	}
+	self.MinOn = conf.Min_On.Duration
+	self.MinOff = conf.Min_Off.Duration
+	self.WindowDrop = conf.Window.Drop
+	self.WindowSuspend = conf.Window.Suspend.Duration
+	if self.WindowSuspend == 0 {
+		self.WindowSuspend = DefaultSuspend
+	}
+	self.WindowAlert = conf.Window.Alert
 	log.Printf("%d zones configured", len(self.Zones))
 }
 
@@ -335,14 +661,16 @@ func (self *Service) QueryHandlers() services.QueryHandlers {
 		"target": self.queryTarget,
 		"ch":     services.TextHandler(self.queryParty),
 		"party":  services.TextHandler(self.queryParty),
+		"away":   services.TextHandler(self.queryAway),
 		"help": services.StaticHandler("" +
 			"status: get status\n" +
-			"party [zone] temp [duration (1h)]: sets heating to temp for duration\n"),
+			"party [zone] temp [duration (1h)]: sets heating to temp for duration\n" +
+			"away [on|off]: get or set away\n"),
 	}
 }
 
 func (self *Service) queryStatus(q services.Question) services.Answer {
-	now := Clock()
+	now := util.Now()
 	return services.Answer{
 		Text: self.Status(now),
 		Json: self.Json(now),
@@ -427,7 +755,7 @@ func parseParty(value string) (err error, zone string, temp float64, duration ti
 func (self *Service) queryParty(q services.Question) string {
 	err, zone, temp, duration := parseParty(q.Args)
 	if err == nil {
-		now := Clock()
+		now := util.Now()
 		err = self.setParty(zone, temp, duration, now)
 		if err == nil {
 			self.Check(true)
@@ -436,3 +764,22 @@ func (self *Service) queryParty(q services.Question) string {
 	}
 	return fmt.Sprint(err)
 }
+
+func (self *Service) queryAway(q services.Question) string {
+	switch q.Args {
+	case "":
+	case "on", "off":
+		away := q.Args == "on"
+		if away != self.Away {
+			log.Printf("Away: %v", away)
+			self.Away = away
+			self.Check(true)
+		}
+	default:
+		return "Expected on or off"
+	}
+	if self.Away {
+		return "Away: on"
+	}
+	return "Away: off"
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/barnybug/gohome/pubsub"
 	"github.com/barnybug/gohome/pubsub/dummy"
 	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/services/sim"
+	"github.com/barnybug/gohome/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -53,13 +55,13 @@ func SetupTests() {
 }
 
 func setClock(t time.Time) {
-	Clock = func() time.Time { return t }
+	util.DefaultClock = util.NewVirtualClock(t)
 }
 
 func fire(ev *pubsub.Event) {
 	// set Clock to event time - as events trigger check of heating
 	setClock(ev.Timestamp)
-	service.handleEvent(ev)
+	service.HandleEvent(ev)
 }
 
 func TestOnOff(t *testing.T) {
@@ -142,6 +144,7 @@ func TestPartyModeTempOnly(t *testing.T) {
 
 func ExampleInterfaces() {
 	var _ services.Service = (*Service)(nil)
+	var _ sim.Service = (*Service)(nil)
 	var _ services.Queryable = (*Service)(nil)
 	// Output:
 }
@@ -226,3 +229,185 @@ func TestQueries(t *testing.T) {
 		})
 	}
 }
+
+var valvesYaml = `
+device: heater.boiler
+zones:
+  living:
+    sensor: temp.living
+    valves: [trv.living]
+  hallway: temp.hallway
+minimum: 10
+band: 2
+demand: 50
+min_on: 10m
+min_off: 10m
+`
+
+func valveLevels(events []*pubsub.Event) []interface{} {
+	var levels []interface{}
+	for _, ev := range events {
+		if ev.Command() == "valve" {
+			levels = append(levels, ev.Fields["level"])
+		}
+	}
+	return levels
+}
+
+func TestValves(t *testing.T) {
+	var heating config.HeatingConf
+	assert.NoError(t, yaml.Unmarshal([]byte(valvesYaml), &heating))
+	conf := config.ExampleConfig
+	conf.Heating = heating
+	em := &dummy.Publisher{}
+	svc := &Service{
+		config:    &services.ConfigService{Value: conf},
+		Publisher: em,
+	}
+	svc.Init()
+	svc.Zones["living"].Target = 20
+	svc.Zones["hallway"].Target = 18
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	setClock(now)
+
+	// 0.5°C below: valve 25% open, not enough demand for the boiler
+	svc.HandleEvent(tempEvent("temp.hallway", 19, now))
+	svc.HandleEvent(tempEvent("temp.living", 19.5, now))
+	assert.Equal(t, 25.0, svc.Zones["living"].Demand)
+	assert.Equal(t, []interface{}{0, 30}, valveLevels(em.Events))
+	assert.False(t, svc.State)
+
+	// 1.5°C below: fires the boiler
+	em.Events = nil
+	svc.HandleEvent(tempEvent("temp.living", 18.5, now))
+	assert.Equal(t, []interface{}{80}, valveLevels(em.Events))
+	assert.True(t, svc.State)
+	assert.Equal(t, 75.0, svc.Json(now).(map[string]interface{})["demand"])
+
+	// reaches target, but stays on for min_on
+	now = now.Add(5 * time.Minute)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.living", 20, now))
+	assert.Equal(t, 0.0, svc.Zones["living"].Demand)
+	assert.True(t, svc.State)
+	now = now.Add(5 * time.Minute)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.living", 20, now))
+	assert.False(t, svc.State)
+
+	// and off for min_off
+	now = now.Add(time.Minute)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.hallway", 17, now))
+	assert.False(t, svc.State)
+	now = now.Add(10 * time.Minute)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.hallway", 17, now))
+	assert.True(t, svc.State)
+	assert.Contains(t, svc.Status(now), "living  20.0°C")
+	assert.Contains(t, svc.Status(now), "demand 0%")
+}
+
+var windowYaml = `
+device: heater.boiler
+zones:
+  living:
+    sensor: temp.living
+    windows: [sensor.living_window]
+  hallway: temp.hallway
+minimum: 10
+window:
+  drop: 6
+  suspend: 20m
+  alert: admin
+`
+
+func setupWindows(t *testing.T) (*Service, *dummy.Publisher) {
+	var heating config.HeatingConf
+	assert.NoError(t, yaml.Unmarshal([]byte(windowYaml), &heating))
+	conf := config.ExampleConfig
+	conf.Heating = heating
+	em := &dummy.Publisher{}
+	svc := &Service{
+		config:    &services.ConfigService{Value: conf},
+		Publisher: em,
+	}
+	svc.Init()
+	svc.Zones["living"].Target = 20
+	svc.Zones["hallway"].Target = 20
+	return svc, em
+}
+
+func alerts(events []*pubsub.Event) []string {
+	var messages []string
+	for _, ev := range events {
+		if ev.Topic == "alert" {
+			messages = append(messages, ev.StringField("message"))
+		}
+	}
+	return messages
+}
+
+func TestWindowDrop(t *testing.T) {
+	svc, em := setupWindows(t)
+	hallway := svc.Zones["hallway"]
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.hallway", 18, now))
+	assert.True(t, svc.State)
+
+	// a gentle fall isn't a window
+	now = now.Add(5 * time.Minute)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.hallway", 17.8, now))
+	assert.False(t, hallway.suspended(now))
+
+	// 1°C in 5 minutes is
+	now = now.Add(5 * time.Minute)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.hallway", 16.8, now))
+	assert.True(t, hallway.suspended(now))
+	assert.False(t, svc.State)
+	temp, mode := svc.Setpoint(hallway, now)
+	assert.Equal(t, 10.0, temp)
+	assert.Equal(t, "window", mode)
+	assert.Equal(t, []string{"🪟 Window open in hallway: heating suspended for 20 minutes"}, alerts(em.Events))
+	for _, ev := range em.Events {
+		if ev.Topic == "alert" {
+			assert.Equal(t, "admin", ev.StringField("target"))
+		}
+	}
+	assert.Contains(t, svc.Status(now), "suspended until")
+	zones := svc.Json(now).(map[string]interface{})["zones"].(map[string]interface{})
+	assert.Equal(t, true, zones["hallway"].(map[string]interface{})["suspended"])
+
+	// resumes after the period
+	now = now.Add(20 * time.Minute)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.hallway", 16.5, now))
+	assert.False(t, hallway.suspended(now))
+	assert.True(t, svc.State)
+}
+
+func TestWindowContact(t *testing.T) {
+	svc, em := setupWindows(t)
+	living := svc.Zones["living"]
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.living", 18, now))
+	assert.True(t, svc.State)
+
+	svc.HandleEvent(pubsub.NewEvent("sensor", pubsub.Fields{"device": "sensor.living_window", "command": "on"}))
+	assert.True(t, living.WindowOpen)
+	assert.False(t, svc.State)
+	assert.Equal(t, []string{"🪟 Window open in living: heating suspended"}, alerts(em.Events))
+	assert.Contains(t, svc.Status(now), "window open")
+
+	svc.HandleEvent(pubsub.NewEvent("sensor", pubsub.Fields{"device": "sensor.living_window", "command": "off"}))
+	assert.False(t, living.WindowOpen)
+	assert.True(t, svc.State)
+
+	// other sensors are ignored
+	svc.HandleEvent(pubsub.NewEvent("sensor", pubsub.Fields{"device": "sensor.other", "command": "on"}))
+	assert.False(t, living.WindowOpen)
+}
@@ -0,0 +1,129 @@
+package heating
+
+import (
+	"sort"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+)
+
+// Setpoint is a scheduled change of temperature, at minutes into the day.
+type Setpoint struct {
+	Minute int
+	Temp   float64
+}
+
+// Schedule of setpoints by day of the week. A day's last setpoint carries on
+// into the next.
+type Schedule [7][]Setpoint
+
+// NewSchedule parses a zone's schedule config. Time ranges revert to minimum
+// at their end. Returns nil for no schedule.
+func NewSchedule(conf map[string][]map[string]float64, minimum float64) (*Schedule, error) {
+	if len(conf) == 0 {
+		return nil, nil
+	}
+	var schedule Schedule
+	for days, points := range conf {
+		weekdays, err := config.ParseDays(days)
+		if err != nil {
+			return nil, err
+		}
+		var setpoints []Setpoint
+		for _, point := range points {
+			for t, temp := range point {
+				start, end, err := config.ParseScheduleTime(t)
+				if err != nil {
+					return nil, err
+				}
+				setpoints = append(setpoints, Setpoint{start, temp})
+				if end != -1 {
+					setpoints = append(setpoints, Setpoint{end, minimum})
+				}
+			}
+		}
+		for _, d := range weekdays {
+			schedule[d] = append(schedule[d], setpoints...)
+		}
+	}
+	for d := range schedule {
+		sps := schedule[d]
+		sort.SliceStable(sps, func(i, j int) bool { return sps[i].Minute < sps[j].Minute })
+	}
+	return &schedule, nil
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// At returns the temperature scheduled at t, with weekday giving the schedule
+// day to use for a date (eg. Sunday on a holiday).
+func (self *Schedule) At(t time.Time, weekday func(time.Time) time.Weekday) (float64, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	date := midnight(t)
+	for i := 0; i <= 7; i++ {
+		sps := self[weekday(date.AddDate(0, 0, -i))]
+		for j := len(sps) - 1; j >= 0; j-- {
+			if i > 0 || sps[j].Minute <= minute {
+				return sps[j].Temp, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// changes returns the times the schedule may change over the week after t:
+// setpoints and midnights (for holidays), in order.
+func (self *Schedule) changes(t time.Time, weekday func(time.Time) time.Weekday) []time.Time {
+	var ts []time.Time
+	date := midnight(t)
+	for i := 0; i <= 7; i++ {
+		day := date.AddDate(0, 0, i)
+		if day.After(t) {
+			ts = append(ts, day)
+		}
+		if self == nil {
+			continue
+		}
+		for _, sp := range self[weekday(day)] {
+			at := day.Add(time.Duration(sp.Minute) * time.Minute)
+			if at.After(t) {
+				ts = append(ts, at)
+			}
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Before(ts[j]) })
+	return ts
+}
+
+// holiday overrides schedules between dates.
+type holiday struct {
+	from, to time.Time // dates, inclusive
+	day      time.Weekday
+	useDay   bool
+	temp     float64
+}
+
+func newHolidays(conf []config.HeatingHolidayConf) []holiday {
+	var hs []holiday
+	for _, c := range conf {
+		from, err1 := time.ParseInLocation(config.DateFormat, c.From, time.Local)
+		to, err2 := time.ParseInLocation(config.DateFormat, c.To, time.Local)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		h := holiday{from: from, to: to, temp: c.Temp}
+		if days, err := config.ParseDays(c.Day); err == nil && len(days) == 1 {
+			h.day = days[0]
+			h.useDay = true
+		}
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+func (self holiday) covers(t time.Time) bool {
+	date := midnight(t)
+	return !date.Before(self.from) && !date.After(self.to)
+}
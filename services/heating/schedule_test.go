@@ -0,0 +1,251 @@
+package heating
+
+import (
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+	"github.com/stretchr/testify/assert"
+)
+
+var scheduleYaml = `
+device: heater.boiler
+zones:
+  living:
+    sensor: temp.living
+    schedule:
+      Mon-Fri:
+      - '7:00': 17
+      - '9:00': 14
+      - 17:30-22:00: 19
+      Weekends:
+      - 09:00-23:00: 18
+  hallway: temp.hallway
+holidays:
+- from: 2024-12-24
+  to: 2024-12-26
+  day: Sunday
+- from: 2025-01-10
+  to: 2025-01-12
+  temp: 8
+minimum: 10
+`
+
+// Monday
+var monday = time.Date(2024, 12, 2, 0, 0, 0, 0, time.Local)
+
+func at(day int, hour, minute int) time.Time {
+	return monday.AddDate(0, 0, day).Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+}
+
+func setupSchedule(t *testing.T) *Service {
+	var heating config.HeatingConf
+	assert.NoError(t, yaml.Unmarshal([]byte(scheduleYaml), &heating))
+	conf := &config.Config{
+		Heating: heating,
+		Presence: config.PresenceConf{
+			People: map[string][]string{"person.alice": nil, "person.bob": nil},
+		},
+	}
+	svc := &Service{
+		config:    &services.ConfigService{Value: conf},
+		Publisher: &dummy.Publisher{},
+	}
+	svc.Init()
+	return svc
+}
+
+func TestScheduleSetpoints(t *testing.T) {
+	svc := setupSchedule(t)
+	living := svc.Zones["living"]
+	tests := []struct {
+		at   time.Time
+		temp float64
+	}{
+		{at(0, 6, 59), 10}, // carried over from Sunday, range ended
+		{at(0, 7, 0), 17},
+		{at(0, 12, 0), 14},
+		{at(0, 17, 30), 19},
+		{at(0, 22, 0), 10},
+		{at(5, 8, 0), 10},
+		{at(5, 9, 0), 18},
+		{at(6, 23, 30), 10},
+	}
+	for _, tt := range tests {
+		temp, mode := svc.Setpoint(living, tt.at)
+		assert.Equal(t, tt.temp, temp, tt.at.String())
+		assert.Equal(t, "schedule", mode)
+	}
+
+	// zones without a schedule use their target
+	svc.Zones["hallway"].Target = 18
+	temp, mode := svc.Setpoint(svc.Zones["hallway"], at(0, 12, 0))
+	assert.Equal(t, 18.0, temp)
+	assert.Equal(t, "target", mode)
+}
+
+func TestScheduleNext(t *testing.T) {
+	svc := setupSchedule(t)
+	living := svc.Zones["living"]
+
+	next, temp, ok := svc.Next(living, at(0, 12, 0))
+	assert.True(t, ok)
+	assert.Equal(t, at(0, 17, 30), next)
+	assert.Equal(t, 19.0, temp)
+
+	// Friday night -> Saturday morning
+	next, temp, ok = svc.Next(living, at(4, 22, 30))
+	assert.True(t, ok)
+	assert.Equal(t, at(5, 9, 0), next)
+	assert.Equal(t, 18.0, temp)
+
+	_, _, ok = svc.Next(svc.Zones["hallway"], at(0, 12, 0))
+	assert.False(t, ok)
+}
+
+func TestScheduleHolidays(t *testing.T) {
+	svc := setupSchedule(t)
+	living := svc.Zones["living"]
+
+	// Tuesday 24th runs Sunday's schedule
+	christmasEve := time.Date(2024, 12, 24, 8, 0, 0, 0, time.Local)
+	temp, mode := svc.Setpoint(living, christmasEve)
+	assert.Equal(t, 10.0, temp)
+	assert.Equal(t, "holiday", mode)
+	temp, _ = svc.Setpoint(living, christmasEve.Add(2*time.Hour))
+	assert.Equal(t, 18.0, temp)
+
+	// fixed temperature, for every zone
+	temp, mode = svc.Setpoint(svc.Zones["hallway"], time.Date(2025, 1, 11, 12, 0, 0, 0, time.Local))
+	assert.Equal(t, 8.0, temp)
+	assert.Equal(t, "holiday", mode)
+}
+
+func TestAway(t *testing.T) {
+	svc := setupSchedule(t)
+	svc.AwayTemp = 12
+	living := svc.Zones["living"]
+	now := at(0, 18, 0)
+
+	svc.HandleEvent(pubsub.NewEvent("presence", pubsub.Fields{"device": "person.alice", "command": "off"}))
+	assert.False(t, svc.Away)
+	svc.HandleEvent(pubsub.NewEvent("presence", pubsub.Fields{"device": "person.bob", "command": "off"}))
+	assert.True(t, svc.Away)
+	temp, mode := svc.Setpoint(living, now)
+	assert.Equal(t, 12.0, temp)
+	assert.Equal(t, "away", mode)
+
+	// zones without a schedule keep their target
+	hallway := svc.Zones["hallway"]
+	hallway.Target = 18
+	temp, mode = svc.Setpoint(hallway, now)
+	assert.Equal(t, 18.0, temp)
+	assert.Equal(t, "target", mode)
+
+	// party overrides away
+	living.setParty(20, time.Hour, now)
+	temp, mode = svc.Setpoint(living, now)
+	assert.Equal(t, 20.0, temp)
+	assert.Equal(t, "party", mode)
+
+	svc.HandleEvent(pubsub.NewEvent("presence", pubsub.Fields{"device": "person.bob", "command": "on"}))
+	assert.False(t, svc.Away)
+
+	assert.Equal(t, "Away: on", svc.queryAway(services.Question{Args: "on"}))
+	assert.True(t, svc.Away)
+}
+
+func TestAwayOptIn(t *testing.T) {
+	// heating.away not set
+	svc := setupSchedule(t)
+	svc.HandleEvent(pubsub.NewEvent("presence", pubsub.Fields{"device": "person.alice", "command": "off"}))
+	svc.HandleEvent(pubsub.NewEvent("presence", pubsub.Fields{"device": "person.bob", "command": "off"}))
+	assert.False(t, svc.Away)
+	temp, mode := svc.Setpoint(svc.Zones["living"], at(0, 18, 0))
+	assert.Equal(t, 19.0, temp)
+	assert.Equal(t, "schedule", mode)
+}
+
+func TestScheduleStatus(t *testing.T) {
+	svc := setupSchedule(t)
+	data := svc.Json(at(0, 12, 0)).(map[string]interface{})
+	living := data["zones"].(map[string]interface{})["living"].(map[string]interface{})
+	assert.Equal(t, 14.0, living["setpoint"])
+	assert.Equal(t, "schedule", living["mode"])
+	assert.Equal(t, map[string]interface{}{"at": at(0, 17, 30), "temp": 19.0}, living["next"])
+	assert.Equal(t, false, data["away"])
+}
+
+func TestLearnedRate(t *testing.T) {
+	var rate HeatingRate
+	_, ok := rate.Predict(5)
+	assert.False(t, ok)
+
+	// 1°C/hr at 0°C outside, 0.1°C/hr faster per °C warmer
+	for i := 0; i < 50; i++ {
+		outside := float64(i % 10)
+		rate.Add(outside, 1+0.1*outside)
+	}
+	intercept, slope, ok := rate.Fit()
+	assert.True(t, ok)
+	assert.InDelta(t, 1.0, intercept, 0.001)
+	assert.InDelta(t, 0.1, slope, 0.001)
+	predicted, _ := rate.Predict(20)
+	assert.InDelta(t, 3.0, predicted, 0.001)
+}
+
+func tempEvent(device string, value float64, at time.Time) *pubsub.Event {
+	ev := pubsub.NewEvent("temp", pubsub.Fields{"device": device, "temp": value})
+	ev.Timestamp = at
+	return ev
+}
+
+func TestOptimumStart(t *testing.T) {
+	svc := setupSchedule(t)
+	svc.Preheat = 2 * time.Hour
+	svc.OutsideSensor = "temp.outside"
+	living := svc.Zones["living"]
+
+	// learn heating at 1.5°C/hr: 0.25°C every 10 minutes, from 9am Monday
+	now := at(0, 9, 0)
+	setClock(now)
+	svc.HandleEvent(tempEvent("temp.outside", 5, now))
+	svc.HandleEvent(tempEvent("temp.living", 10, now))
+	svc.State = true
+	svc.StateChanged = now.Add(-time.Hour)
+	living.setParty(20, 4*time.Hour, now)
+	for i := 1; i <= 12; i++ {
+		now = now.Add(10 * time.Minute)
+		setClock(now)
+		svc.HandleEvent(tempEvent("temp.outside", 5, now))
+		svc.HandleEvent(tempEvent("temp.living", 10+0.25*float64(i), now))
+	}
+	predicted, ok := living.Learned.Predict(5)
+	assert.True(t, ok)
+	assert.InDelta(t, 1.5, predicted, 0.001)
+	living.PartyUntil = time.Time{}
+
+	// 15°C, 19°C due at 17:30 - needs 4°C at 1.5°C/hr = 2h40m, capped at 2h
+	svc.HandleEvent(tempEvent("temp.outside", 5, at(0, 15, 20)))
+	living.Update(15, at(0, 15, 20))
+	temp, mode := svc.Setpoint(living, at(0, 15, 20))
+	assert.Equal(t, 14.0, temp)
+	assert.Equal(t, "schedule", mode)
+	temp, mode = svc.Setpoint(living, at(0, 15, 30))
+	assert.Equal(t, 19.0, temp)
+	assert.Equal(t, "preheat", mode)
+
+	// persisted in the retained status
+	status := pubsub.NewEvent("heating", pubsub.Fields{"status": svc.Json(at(0, 15, 30))})
+	status.SetRetained(true)
+	restored := pubsub.Parse(status.String(), "gohome/heating")
+	restored.SetRetained(true)
+	restarted := setupSchedule(t)
+	restarted.HandleEvent(restored)
+	assert.Equal(t, living.Learned, restarted.Zones["living"].Learned)
+}
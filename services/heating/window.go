@@ -0,0 +1,74 @@
+package heating
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/util"
+)
+
+// DefaultSuspend is how long a zone's heating is suspended for, when its
+// temperature drop detects an open window.
+const DefaultSuspend = 30 * time.Minute
+
+// suspended returns whether the zone's heating is suspended for an open
+// window.
+func (self *Zone) suspended(now time.Time) bool {
+	return self.WindowOpen || now.Before(self.SuspendedUntil)
+}
+
+// windowDrop returns whether a new reading is falling fast enough to be an
+// open window.
+func (self *Service) windowDrop(zone *Zone, temp float64, at time.Time) bool {
+	if self.WindowDrop == 0 || zone.At.IsZero() {
+		return false
+	}
+	gap := at.Sub(zone.At)
+	if gap < time.Minute || gap > rateMaxGap {
+		return false
+	}
+	return (zone.Temp-temp)/gap.Hours() >= self.WindowDrop
+}
+
+// suspend the zone's heating, after a temperature drop.
+func (self *Service) suspend(name string, zone *Zone, at time.Time) {
+	alert := !zone.suspended(at)
+	zone.SuspendedUntil = at.Add(self.WindowSuspend)
+	if alert {
+		log.Printf("Window open in %s: suspended until %s", name, zone.SuspendedUntil.Format(time.Kitchen))
+		self.alert(fmt.Sprintf("🪟 Window open in %s: heating suspended for %s", name, util.FriendlyDuration(self.WindowSuspend)))
+	}
+}
+
+// window handles a window's contact sensor opening or closing.
+func (self *Service) window(sensor string, open bool, retained bool) {
+	for name, zone := range self.Zones {
+		if _, ok := zone.windows[sensor]; !ok {
+			continue
+		}
+		zone.windows[sensor] = open
+		was := zone.WindowOpen
+		zone.WindowOpen = false
+		for _, o := range zone.windows {
+			zone.WindowOpen = zone.WindowOpen || o
+		}
+		if zone.WindowOpen == was {
+			continue
+		}
+		log.Printf("Window open in %s: %v", name, zone.WindowOpen)
+		if zone.WindowOpen && !retained {
+			self.alert(fmt.Sprintf("🪟 Window open in %s: heating suspended", name))
+		}
+		self.Check(true)
+	}
+}
+
+func (self *Service) alert(message string) {
+	ev := pubsub.NewEvent("alert", pubsub.Fields{
+		"message": message,
+		"target":  self.WindowAlert,
+	})
+	self.Publisher.Emit(ev)
+}
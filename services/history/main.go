@@ -0,0 +1,320 @@
+// Service to record device events to disk, for querying by device and time
+// range.
+//
+// Events are kept for a retention period configured per topic, eg:
+//
+//	history:
+//	  path: ~/gohome/history
+//	  retention:
+//	    default: 30d
+//	    temp: 365d
+//	    heartbeat: 1d
+//
+// Query with:
+//
+//	history device=temp.hall [topic=temp] [since=24h] [until=...] [limit=100]
+//
+// Each config published (config, config/automata, ...) is also kept as a
+// numbered revision under <path>/_config, with who published it:
+//
+//	revisions [config/automata]
+//	diff REV [REV]
+//	rollback REV
+package history
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
+)
+
+// Service history
+type Service struct {
+	config    *services.ConfigService
+	store     *Store
+	revisions *Revisions
+	// "configured" events awaiting their config, by path
+	configured map[string]*pubsub.Event
+}
+
+// ID of the service
+func (self *Service) ID() string {
+	return "history"
+}
+
+func ignoreTopic(topic string) bool {
+	return topic == "query" || topic == "alert" || topic == "log" || strings.HasPrefix(topic, "_") || strings.HasPrefix(topic, "config")
+}
+
+func (self *Service) record(ev *pubsub.Event) {
+	if ev.Device() == "" || ignoreTopic(ev.Topic) {
+		return
+	}
+	if err := self.store.Append(ev); err != nil {
+		log.Println("Error recording event:", err)
+	}
+}
+
+func isConfig(topic string) bool {
+	return topic == "config" || strings.HasPrefix(topic, "config/")
+}
+
+// recordConfig adds a config revision, attributed to the "configured" event
+// preceding it.
+func (self *Service) recordConfig(ev *pubsub.Event) {
+	r := Revision{Path: ev.Topic, Timestamp: ev.Timestamp}
+	if c, ok := self.configured[ev.Topic]; ok && c.StringField("checksum") == services.ConfigChecksum(ev.Raw) {
+		r.Author = c.StringField("author")
+		r.Source = c.StringField("source")
+		delete(self.configured, ev.Topic)
+	}
+	r, added, err := self.revisions.Add(r, ev.Raw)
+	if err != nil {
+		log.Println("Error recording config revision:", err)
+	} else if added {
+		log.Printf("Recorded %s revision %d", r.Path, r.Rev)
+	}
+}
+
+func (self *Service) expire(now time.Time) {
+	retention := self.config.Value.History.Retention
+	for _, topic := range self.store.Topics() {
+		d, ok := retention[topic]
+		if !ok {
+			d, ok = retention["default"]
+		}
+		if !ok || d.IsZero() {
+			continue // keep forever
+		}
+		n, err := self.store.Expire(topic, now.Add(-d.Duration))
+		if err != nil {
+			log.Printf("Error expiring %s: %s", topic, err)
+		}
+		if n > 0 {
+			log.Printf("Expired %d days of %s history", n, topic)
+		}
+	}
+}
+
+func (self *Service) setup() {
+	p := self.config.Value.History.Path
+	if p == "" {
+		log.Fatal("history path not defined")
+	}
+	self.store = NewStore(util.ExpandUser(p))
+	self.revisions = NewRevisions(path.Join(self.store.Path, "_config"))
+}
+
+func (self *Service) Init() error {
+	self.config = services.WaitForConfig()
+	self.configured = map[string]*pubsub.Event{}
+	self.setup()
+	return nil
+}
+
+// Run the service
+func (self *Service) Run() error {
+	events := services.Subscriber.Subscribe(pubsub.All())
+	ticker := util.NewScheduler(time.Duration(0), time.Hour)
+	self.expire(time.Now())
+	for {
+		select {
+		case ev := <-events:
+			if ev.Topic == "configured" {
+				self.configured[ev.StringField("path")] = ev
+				continue
+			}
+			if isConfig(ev.Topic) {
+				// retained config is recorded too, if changed since last run
+				self.recordConfig(ev)
+				continue
+			}
+			if ev.Retained {
+				// ignore retained events from reconnecting
+				continue
+			}
+			self.record(ev)
+		case tick := <-ticker.C:
+			self.expire(tick)
+		case <-self.config.Updated:
+			self.setup()
+		}
+	}
+}
+
+func (self *Service) QueryHandlers() services.QueryHandlers {
+	return services.QueryHandlers{
+		"history":   self.queryHistory,
+		"revisions": self.queryRevisions,
+		"diff":      services.TextHandler(self.queryDiff),
+		"rollback":  services.TextHandler(self.queryRollback),
+		"help": services.StaticHandler("" +
+			"history device=id [topic=t] [since=24h] [until=time] [limit=n]: device events\n" +
+			"revisions [path]: config revisions\n" +
+			"diff rev [rev]: diff config revisions\n" +
+			"rollback rev: republish config revision\n"),
+	}
+}
+
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// parseTime understands durations ago (eg. 2h, 7d) and absolute times.
+func parseTime(now time.Time, s string) (time.Time, error) {
+	if d, err := util.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+func parseQuery(now time.Time, args string) (Query, error) {
+	kwargs := util.KeywordArgs(strings.Fields(args))
+	for k, v := range kwargs {
+		// values may be escaped, eg. from the api
+		value, err := url.PathUnescape(v)
+		if err != nil {
+			return Query{}, fmt.Errorf("invalid %s: %s", k, v)
+		}
+		kwargs[k] = value
+	}
+	q := Query{
+		Device: kwargs["device"],
+		Topic:  kwargs["topic"],
+		Since:  now.Add(-24 * time.Hour),
+		Until:  now,
+		Limit:  100,
+	}
+	if q.Device == "" {
+		q.Device = kwargs[""]
+	}
+	if q.Device == "" {
+		return q, fmt.Errorf("device required")
+	}
+	var err error
+	if v, ok := kwargs["since"]; ok {
+		if q.Since, err = parseTime(now, v); err != nil {
+			return q, err
+		}
+	}
+	if v, ok := kwargs["until"]; ok {
+		if q.Until, err = parseTime(now, v); err != nil {
+			return q, err
+		}
+	}
+	if v, ok := kwargs["limit"]; ok {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			return q, fmt.Errorf("invalid limit: %s", v)
+		}
+	}
+	return q, nil
+}
+
+func formatEvent(ev *pubsub.Event) string {
+	var keys []string
+	for k := range ev.Fields {
+		if k != "device" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	s := fmt.Sprintf("%s %s", ev.Timestamp.Local().Format("Jan _2 15:04:05"), ev.Topic)
+	for _, k := range keys {
+		s += fmt.Sprintf(" %s=%v", k, ev.Fields[k])
+	}
+	return s
+}
+
+func (self *Service) queryHistory(q services.Question) services.Answer {
+	query, err := parseQuery(time.Now(), q.Args)
+	if err != nil {
+		return services.Answer{Text: fmt.Sprint(err)}
+	}
+	events, err := self.store.Query(query)
+	if err != nil {
+		return services.Answer{Text: fmt.Sprint(err)}
+	}
+
+	text := fmt.Sprintf("%s: %d events", query.Device, len(events))
+	data := []interface{}{}
+	for _, ev := range events {
+		text += "\n" + formatEvent(ev)
+		data = append(data, ev.Map())
+	}
+	return services.Answer{Text: text, Json: data}
+}
+
+func (self *Service) queryRevisions(q services.Question) services.Answer {
+	revs, err := self.revisions.List(strings.TrimSpace(q.Args))
+	if err != nil {
+		return services.Answer{Text: fmt.Sprint(err)}
+	}
+	if len(revs) == 0 {
+		return services.Answer{Text: "No config revisions"}
+	}
+	text := fmt.Sprintf("%d revisions", len(revs))
+	for _, r := range revs {
+		text += "\n" + r.String()
+	}
+	return services.Answer{Text: text, Json: revs}
+}
+
+func parseRevs(args string, min, max int) ([]int, error) {
+	fields := strings.Fields(args)
+	if len(fields) < min || len(fields) > max {
+		return nil, fmt.Errorf("revision required")
+	}
+	var revs []int
+	for _, f := range fields {
+		rev, err := strconv.Atoi(strings.TrimPrefix(f, "r"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid revision: %s", f)
+		}
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+func (self *Service) queryDiff(q services.Question) string {
+	revs, err := parseRevs(q.Args, 1, 2)
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+	b := 0
+	if len(revs) == 2 {
+		b = revs[1]
+	}
+	diff, err := self.revisions.Diff(revs[0], b)
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+	if diff == "" {
+		return "No differences"
+	}
+	return diff
+}
+
+func (self *Service) queryRollback(q services.Question) string {
+	revs, err := parseRevs(q.Args, 1, 1)
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+	r, data, err := self.revisions.Get(revs[0])
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+	services.SendConfig(r.Path, data, q.From, "rollback")
+	return fmt.Sprintf("Rolled %s back to revision %d", r.Path, r.Rev)
+}
@@ -0,0 +1,155 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleInterfaces() {
+	var _ services.Service = (*Service)(nil)
+	var _ services.Queryable = (*Service)(nil)
+	// Output:
+}
+
+func event(topic string, temp float64, timestamp string) *pubsub.Event {
+	return pubsub.NewEvent(topic, pubsub.Fields{"device": "temp.hall", "temp": temp, "timestamp": timestamp})
+}
+
+var (
+	t1 = time.Date(2014, 1, 3, 23, 0, 0, 0, time.UTC)
+	t2 = time.Date(2014, 1, 4, 16, 0, 0, 0, time.UTC)
+	t3 = time.Date(2014, 1, 5, 16, 0, 0, 0, time.UTC)
+)
+
+func testStore(t *testing.T) *Store {
+	store := NewStore(t.TempDir())
+	assert.NoError(t, store.Append(event("temp", 10.1, "2014-01-03 23:00:00.000")))
+	assert.NoError(t, store.Append(event("temp", 12.5, "2014-01-04 16:00:00.000")))
+	assert.NoError(t, store.Append(event("humidity", 60, "2014-01-04 16:00:01.000")))
+	assert.NoError(t, store.Append(event("temp", 14.2, "2014-01-05 16:00:00.000")))
+	return store
+}
+
+func TestQueryRange(t *testing.T) {
+	store := testStore(t)
+	events, err := store.Query(Query{Device: "temp.hall", Since: t1.Add(time.Hour), Until: t3})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, 12.5, events[0].FloatField("temp"))
+	assert.Equal(t, "humidity", events[1].Topic)
+	assert.Equal(t, 14.2, events[2].FloatField("temp"))
+}
+
+func TestQueryTopicLimit(t *testing.T) {
+	store := testStore(t)
+	events, err := store.Query(Query{Device: "temp.hall", Topic: "temp", Since: t1, Until: t3, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, 12.5, events[0].FloatField("temp"))
+	assert.Equal(t, 14.2, events[1].FloatField("temp"))
+}
+
+func TestQueryUnknownDevice(t *testing.T) {
+	store := testStore(t)
+	_, err := store.Query(Query{Device: "temp.garden", Since: t1, Until: t3})
+	assert.Error(t, err)
+}
+
+func TestQueryInvalidName(t *testing.T) {
+	store := testStore(t)
+	for _, name := range []string{".", "..", "../temp.hall", `..\x`} {
+		_, err := store.Query(Query{Device: name, Since: t1, Until: t3})
+		assert.EqualError(t, err, "invalid name '"+name+"'")
+		_, err = store.Query(Query{Device: "temp.hall", Topic: name, Since: t1, Until: t3})
+		assert.EqualError(t, err, "invalid name '"+name+"'")
+	}
+	ev := pubsub.NewEvent("..", pubsub.Fields{"device": "temp.hall"})
+	assert.Error(t, store.Append(ev))
+	_, err := store.Expire("..", t2)
+	assert.Error(t, err)
+}
+
+func TestExpire(t *testing.T) {
+	store := testStore(t)
+	assert.Equal(t, []string{"humidity", "temp"}, store.Topics())
+	n, err := store.Expire("temp", t2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	events, _ := store.Query(Query{Device: "temp.hall", Since: t1, Until: t3})
+	assert.Equal(t, 3, len(events))
+}
+
+func TestParseQuery(t *testing.T) {
+	now := t3
+	q, err := parseQuery(now, "device=temp.hall since=2h limit=5")
+	assert.NoError(t, err)
+	assert.Equal(t, "temp.hall", q.Device)
+	assert.Equal(t, now.Add(-2*time.Hour), q.Since)
+	assert.Equal(t, now, q.Until)
+	assert.Equal(t, 5, q.Limit)
+
+	q, err = parseQuery(now, "temp.hall topic=temp since=2014-01-04")
+	assert.NoError(t, err)
+	assert.Equal(t, "temp.hall", q.Device)
+	assert.Equal(t, "temp", q.Topic)
+	assert.Equal(t, time.Date(2014, 1, 4, 0, 0, 0, 0, time.Local), q.Since)
+
+	// escaped values can't add arguments
+	q, err = parseQuery(now, "device=temp.hall%20limit=1 since=2014-01-04T10:00:00+01:00")
+	assert.NoError(t, err)
+	assert.Equal(t, "temp.hall limit=1", q.Device)
+	assert.Equal(t, 100, q.Limit)
+
+	_, err = parseQuery(now, "since=2h")
+	assert.Error(t, err)
+	_, err = parseQuery(now, "temp.hall since=yesterday")
+	assert.Error(t, err)
+}
+
+func TestRevisions(t *testing.T) {
+	revisions := NewRevisions(t.TempDir())
+	r, added, err := revisions.Add(Revision{Path: "config", Author: "bob"}, []byte("a: 1\nb: 2\n"))
+	assert.NoError(t, err)
+	assert.True(t, added)
+	assert.Equal(t, 1, r.Rev)
+	revisions.Add(Revision{Path: "config/automata"}, []byte("x: 1\n"))
+	r, added, _ = revisions.Add(Revision{Path: "config"}, []byte("a: 1\nb: 3\n"))
+	assert.Equal(t, 3, r.Rev)
+	// unchanged
+	r, added, _ = revisions.Add(Revision{Path: "config"}, []byte("a: 1\nb: 3\n"))
+	assert.False(t, added)
+	assert.Equal(t, 3, r.Rev)
+
+	revs, err := revisions.List("config")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(revs))
+	assert.Equal(t, "bob", revs[0].Author)
+
+	diff, err := revisions.Diff(3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "--- config@1\n+++ config@3\n@@ -1,2 +1,2 @@\n a: 1\n-b: 2\n+b: 3\n", diff)
+	_, err = revisions.Diff(4, 0)
+	assert.Error(t, err)
+}
+
+func TestRecordConfig(t *testing.T) {
+	service := &Service{configured: map[string]*pubsub.Event{}}
+	service.store = NewStore(t.TempDir())
+	service.revisions = NewRevisions(t.TempDir())
+	data := []byte("automata: {}\n")
+	service.configured["config/automata"] = pubsub.NewEvent("configured", pubsub.Fields{
+		"path": "config/automata", "author": "bob@host", "source": "cmd", "checksum": services.ConfigChecksum(data)})
+	service.recordConfig(pubsub.NewRawEvent("config/automata", data))
+	service.recordConfig(pubsub.NewRawEvent("config", []byte("devices: {}\n")))
+
+	revs, _ := service.revisions.List("")
+	assert.Equal(t, 2, len(revs))
+	assert.Equal(t, "bob@host", revs[0].Author)
+	assert.Equal(t, "cmd", revs[0].Source)
+	assert.Equal(t, "", revs[1].Author)
+	assert.Empty(t, service.configured)
+}
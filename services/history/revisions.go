@@ -0,0 +1,190 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Revision of a config path.
+type Revision struct {
+	Rev       int       `json:"rev"`
+	Path      string    `json:"path"`
+	Author    string    `json:"author,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int       `json:"size"`
+}
+
+func (r Revision) String() string {
+	author := r.Author
+	if author == "" {
+		author = "unknown"
+	}
+	if r.Source != "" {
+		author += " (" + r.Source + ")"
+	}
+	return fmt.Sprintf("%d %s %s %s %d bytes", r.Rev, r.Timestamp.Local().Format("Jan _2 15:04:05"), r.Path, author, r.Size)
+}
+
+// Revisions of published config, numbered across all config paths:
+//
+//	<path>/index.log - json lines of Revision
+//	<path>/<rev>.yml - config data
+type Revisions struct {
+	Path string
+}
+
+func NewRevisions(path string) *Revisions {
+	return &Revisions{Path: path}
+}
+
+func (s *Revisions) dataFile(rev int) string {
+	return path.Join(s.Path, fmt.Sprintf("%d.yml", rev))
+}
+
+// List revisions, oldest first, optionally only of a config path.
+func (s *Revisions) List(configPath string) ([]Revision, error) {
+	f, err := os.Open(path.Join(s.Path, "index.log"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var revs []Revision
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Revision
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, err
+		}
+		if configPath == "" || r.Path == configPath {
+			revs = append(revs, r)
+		}
+	}
+	return revs, scanner.Err()
+}
+
+// Get a revision and its data.
+func (s *Revisions) Get(rev int) (Revision, []byte, error) {
+	revs, err := s.List("")
+	if err != nil {
+		return Revision{}, nil, err
+	}
+	for _, r := range revs {
+		if r.Rev == rev {
+			data, err := ioutil.ReadFile(s.dataFile(rev))
+			return r, data, err
+		}
+	}
+	return Revision{}, nil, fmt.Errorf("revision %d not found", rev)
+}
+
+// Previous revision of the same path, or nil data if rev is the first.
+func (s *Revisions) Previous(rev int) (Revision, []byte, error) {
+	r, _, err := s.Get(rev)
+	if err != nil {
+		return r, nil, err
+	}
+	revs, err := s.List(r.Path)
+	if err != nil {
+		return r, nil, err
+	}
+	for i := len(revs) - 1; i >= 0; i-- {
+		if revs[i].Rev < rev {
+			return s.Get(revs[i].Rev)
+		}
+	}
+	return Revision{Path: r.Path}, nil, nil
+}
+
+// Add data as a new revision, unless it's unchanged from the latest of its
+// path. Returns whether a revision was added.
+func (s *Revisions) Add(r Revision, data []byte) (Revision, bool, error) {
+	revs, err := s.List("")
+	if err != nil {
+		return r, false, err
+	}
+	r.Rev = 1
+	for _, prev := range revs {
+		if prev.Rev >= r.Rev {
+			r.Rev = prev.Rev + 1
+		}
+	}
+	for i := len(revs) - 1; i >= 0; i-- {
+		if revs[i].Path == r.Path {
+			latest, err := ioutil.ReadFile(s.dataFile(revs[i].Rev))
+			if err == nil && bytes.Equal(latest, data) {
+				return revs[i], false, nil
+			}
+			break
+		}
+	}
+	r.Size = len(data)
+
+	if err := os.MkdirAll(s.Path, 0755); err != nil {
+		return r, false, err
+	}
+	if err := ioutil.WriteFile(s.dataFile(r.Rev), data, 0660); err != nil {
+		return r, false, err
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return r, false, err
+	}
+	f, err := os.OpenFile(path.Join(s.Path, "index.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return r, false, err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return r, err == nil, err
+}
+
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Diff two revisions as a unified diff. If b is 0, rev a is compared to the
+// previous revision of its path.
+func (s *Revisions) Diff(a, b int) (string, error) {
+	var ra, rb Revision
+	var da, db []byte
+	var err error
+	if b == 0 {
+		if rb, db, err = s.Get(a); err != nil {
+			return "", err
+		}
+		ra, da, err = s.Previous(a)
+	} else {
+		if ra, da, err = s.Get(a); err != nil {
+			return "", err
+		}
+		rb, db, err = s.Get(b)
+	}
+	if err != nil {
+		return "", err
+	}
+	diff := difflib.UnifiedDiff{
+		A:        splitLines(da),
+		B:        splitLines(db),
+		FromFile: fmt.Sprintf("%s@%d", ra.Path, ra.Rev),
+		ToFile:   fmt.Sprintf("%s@%d", rb.Path, rb.Rev),
+		Context:  3,
+	}
+	return difflib.GetUnifiedDiffString(diff)
+}
@@ -0,0 +1,224 @@
+package history
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+)
+
+const dayFormat = "2006-01-02"
+
+// Store of events on disk, indexed by device, topic and day:
+//
+//	<path>/<device>/<topic>/<yyyy-mm-dd>.log
+//
+// Each file contains the events for that day (UTC) as json lines, so a time
+// range query only reads the days it covers, and retention simply removes
+// whole days.
+type Store struct {
+	Path string
+}
+
+func NewStore(path string) *Store {
+	return &Store{Path: path}
+}
+
+// Query for events of a device between Since and Until.
+type Query struct {
+	Device string
+	Topic  string // optional
+	Since  time.Time
+	Until  time.Time
+	Limit  int // most recent, 0 for unlimited
+}
+
+// escape a device or topic name as a path component, refusing any that
+// would be outside the store.
+func escape(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid name '%s'", name)
+	}
+	return url.PathEscape(name), nil
+}
+
+func unescape(name string) string {
+	s, err := url.PathUnescape(name)
+	if err != nil {
+		return name
+	}
+	return s
+}
+
+func (s *Store) dayFile(device, topic string, t time.Time) (string, error) {
+	d, err := escape(device)
+	if err != nil {
+		return "", err
+	}
+	tp, err := escape(topic)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.Path, d, tp, t.UTC().Format(dayFormat)+".log"), nil
+}
+
+// Append an event to the store.
+func (s *Store) Append(ev *pubsub.Event) error {
+	p, err := s.dayFile(ev.Device(), ev.Topic, ev.Timestamp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(ev.Bytes(), '\n'))
+	return err
+}
+
+func listDir(p string) []string {
+	infos, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+// listDevices skips directories like _config that aren't devices.
+func listDevices(p string) []string {
+	var devices []string
+	for _, name := range listDir(p) {
+		if !strings.HasPrefix(name, "_") {
+			devices = append(devices, name)
+		}
+	}
+	return devices
+}
+
+// Query events, returned in timestamp order.
+func (s *Store) Query(q Query) ([]*pubsub.Event, error) {
+	if q.Device == "" {
+		return nil, fmt.Errorf("device required")
+	}
+	if q.Until.IsZero() {
+		q.Until = time.Now()
+	}
+	device, err := escape(q.Device)
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Join(s.Path, device)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("no history for device '%s'", q.Device)
+	}
+	topics := listDir(dir)
+	if q.Topic != "" {
+		topic, err := escape(q.Topic)
+		if err != nil {
+			return nil, err
+		}
+		topics = []string{topic}
+	}
+
+	first := q.Since.UTC().Format(dayFormat)
+	last := q.Until.UTC().Format(dayFormat)
+	var events []*pubsub.Event
+	for _, topic := range topics {
+		for _, name := range listDir(path.Join(dir, topic)) {
+			day := strings.TrimSuffix(name, ".log")
+			if day < first || day > last {
+				continue
+			}
+			evs, err := readEvents(path.Join(dir, topic, name), q.Since, q.Until)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, evs...)
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events, nil
+}
+
+func readEvents(p string, since, until time.Time) ([]*pubsub.Event, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []*pubsub.Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		ev := pubsub.Parse(scanner.Text(), "")
+		if ev == nil || ev.Timestamp.Before(since) || ev.Timestamp.After(until) {
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// Topics recorded, across all devices.
+func (s *Store) Topics() []string {
+	seen := map[string]bool{}
+	for _, device := range listDevices(s.Path) {
+		for _, topic := range listDir(path.Join(s.Path, device)) {
+			seen[unescape(topic)] = true
+		}
+	}
+	var topics []string
+	for topic := range seen {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Expire removes the days of a topic wholly before the given time, returning
+// the number of files removed.
+func (s *Store) Expire(topic string, before time.Time) (int, error) {
+	escaped, err := escape(topic)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := before.UTC().Format(dayFormat)
+	n := 0
+	for _, device := range listDevices(s.Path) {
+		dir := path.Join(s.Path, device, escaped)
+		for _, name := range listDir(dir) {
+			day := strings.TrimSuffix(name, ".log")
+			if day >= cutoff {
+				continue
+			}
+			if err := os.Remove(path.Join(dir, name)); err != nil {
+				return n, err
+			}
+			n += 1
+		}
+	}
+	return n, nil
+}
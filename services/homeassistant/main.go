@@ -0,0 +1,392 @@
+// Service to expose gohome devices to Home Assistant, by MQTT discovery.
+//
+// Configured devices are published as Home Assistant entities by their caps:
+//
+//	switch                     - switch (or light, for light.* devices)
+//	dimmer, colour, colourtemp - light
+//	thermostat                 - climate, setting the heating zone's target
+//	presence                   - binary_sensor
+//
+// Commands from Home Assistant (on <topic>/<device>/set) are sent as gohome
+// commands, and device state from events (acks, reports, presence and the
+// heating status) is published to <topic>/<device>/state:
+//
+//	homeassistant:
+//	  prefix: homeassistant
+//	  topic: gohome-ha
+package homeassistant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/mqtt"
+	"github.com/barnybug/gohome/services"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	DefaultPrefix = "homeassistant"
+	DefaultTopic  = "gohome-ha"
+)
+
+// messages queued to and from the MQTT client
+const queueSize = 1000
+
+// colour temperature range of lights, as googlehome
+const (
+	minMireds = 1_000_000 / 6700
+	maxMireds = 1_000_000 / 2200
+)
+
+// Service homeassistant
+type Service struct {
+	config  *services.ConfigService
+	publish func(topic string, payload []byte)
+	// discovery topics published, to remove devices no longer configured
+	discovered map[string]bool
+	// last state of lights
+	lights map[string]map[string]interface{}
+}
+
+func (self *Service) ID() string {
+	return "homeassistant"
+}
+
+// MqttBridge marks the service as using mqtt.Client directly.
+func (self *Service) MqttBridge() {}
+
+func (self *Service) prefix() string {
+	if p := self.config.Value.Homeassistant.Prefix; p != "" {
+		return p
+	}
+	return DefaultPrefix
+}
+
+func (self *Service) topic() string {
+	if t := self.config.Value.Homeassistant.Topic; t != "" {
+		return t
+	}
+	return DefaultTopic
+}
+
+// component of Home Assistant for a device, by its caps.
+func component(device config.DeviceConf) string {
+	switch {
+	case device.Cap["thermostat"]:
+		return "climate"
+	case device.Cap["presence"]:
+		return "binary_sensor"
+	case device.Cap["dimmer"] || device.Cap["colour"] || device.Cap["colourtemp"]:
+		return "light"
+	case device.Cap["switch"] && device.Prefix() == "light":
+		return "light"
+	case device.Cap["switch"]:
+		return "switch"
+	}
+	return ""
+}
+
+func objectId(id string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(id)
+}
+
+// Discovery returns the discovery config of a device, and its topic, if it's
+// exposed.
+func (self *Service) Discovery(device config.DeviceConf) (string, map[string]interface{}, bool) {
+	comp := component(device)
+	if comp == "" {
+		return "", nil, false
+	}
+	base := fmt.Sprintf("%s/%s", self.topic(), device.Id)
+	name := device.Name
+	if name == "" {
+		name = device.Id
+	}
+	payload := map[string]interface{}{
+		"name":      name,
+		"unique_id": "gohome_" + objectId(device.Id),
+		"device": map[string]interface{}{
+			"identifiers":    []string{"gohome_" + objectId(device.Id)},
+			"name":           name,
+			"manufacturer":   "gohome",
+			"suggested_area": device.Location,
+		},
+	}
+	switch comp {
+	case "climate":
+		payload["modes"] = []string{"heat"}
+		payload["temperature_unit"] = "C"
+		payload["temp_step"] = 0.5
+		payload["temperature_command_topic"] = base + "/target/set"
+		payload["temperature_state_topic"] = base + "/target"
+		payload["current_temperature_topic"] = base + "/temp"
+	case "binary_sensor":
+		payload["device_class"] = "presence"
+		payload["state_topic"] = base + "/state"
+		payload["payload_on"] = "on"
+		payload["payload_off"] = "off"
+	case "light":
+		payload["schema"] = "json"
+		payload["command_topic"] = base + "/set"
+		payload["state_topic"] = base + "/state"
+		var modes []string
+		if device.Cap["colour"] {
+			modes = append(modes, "rgb")
+		}
+		if device.Cap["colourtemp"] {
+			modes = append(modes, "color_temp")
+			payload["min_mireds"] = minMireds
+			payload["max_mireds"] = maxMireds
+		}
+		if len(modes) == 0 && device.Cap["dimmer"] {
+			modes = append(modes, "brightness")
+		}
+		if len(modes) == 0 {
+			modes = append(modes, "onoff")
+		}
+		payload["supported_color_modes"] = modes
+		if device.Cap["dimmer"] || device.Cap["colour"] || device.Cap["colourtemp"] {
+			payload["brightness"] = true
+			payload["brightness_scale"] = 100
+		}
+	case "switch":
+		payload["command_topic"] = base + "/set"
+		payload["state_topic"] = base + "/state"
+	}
+	topic := fmt.Sprintf("%s/%s/gohome/%s/config", self.prefix(), comp, objectId(device.Id))
+	return topic, payload, true
+}
+
+// discover publishes the discovery config of every device, and removes any
+// no longer configured.
+func (self *Service) discover() {
+	var ids []string
+	for id := range self.config.Value.Devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	discovered := map[string]bool{}
+	for _, id := range ids {
+		topic, payload, ok := self.Discovery(self.config.Value.Devices[id])
+		if !ok {
+			continue
+		}
+		data, _ := json.Marshal(payload)
+		self.publish(topic, data)
+		discovered[topic] = true
+	}
+	for topic := range self.discovered {
+		if !discovered[topic] {
+			self.publish(topic, []byte{})
+		}
+	}
+	log.Printf("Published %d devices for discovery", len(discovered))
+	self.discovered = discovered
+}
+
+// HandleMessage handles a command from Home Assistant.
+func (self *Service) HandleMessage(topic string, payload []byte) {
+	rest := strings.TrimPrefix(topic, self.topic()+"/")
+	if rest == topic {
+		return
+	}
+	id, sub, _ := strings.Cut(rest, "/")
+	device, ok := self.config.Value.Devices[id]
+	if !ok {
+		return
+	}
+	switch {
+	case sub == "target/set" && device.Cap["thermostat"]:
+		temp, err := strconv.ParseFloat(string(payload), 64)
+		if err != nil {
+			log.Printf("Invalid target for %s: %s", id, payload)
+			return
+		}
+		zone := strings.TrimPrefix(id, "thermostat.")
+		services.SendQuery(fmt.Sprintf("heating/target %s %v", zone, temp), self.ID(), "", "")
+	case sub == "set" && component(device) == "light":
+		var body struct {
+			State      string
+			Brightness *int
+			Color_Temp int
+			Color      *struct{ R, G, B int }
+		}
+		if err := json.Unmarshal(payload, &body); err != nil {
+			log.Printf("Invalid command for %s: %s", id, payload)
+			return
+		}
+		ev := pubsub.NewCommand(id, strings.ToLower(body.State))
+		if body.Brightness != nil {
+			ev.SetField("level", *body.Brightness)
+		}
+		if body.Color_Temp > 0 {
+			ev.SetField("temp", 1_000_000/body.Color_Temp)
+		}
+		if body.Color != nil {
+			ev.SetField("colour", fmt.Sprintf("#%02x%02x%02x", body.Color.R, body.Color.G, body.Color.B))
+		}
+		services.Publisher.Emit(ev)
+	case sub == "set" && component(device) == "switch":
+		ev := pubsub.NewCommand(id, strings.ToLower(string(payload)))
+		services.Publisher.Emit(ev)
+	}
+}
+
+// state publishes the device's state from an event.
+func (self *Service) state(ev *pubsub.Event) {
+	id := ev.Device()
+	device, ok := self.config.Value.Devices[id]
+	if !ok {
+		return
+	}
+	base := fmt.Sprintf("%s/%s", self.topic(), id)
+	command := ev.Command()
+	switch component(device) {
+	case "binary_sensor":
+		if command == "on" || command == "off" {
+			self.publish(base+"/state", []byte(command))
+		}
+	case "switch":
+		if command == "on" || command == "off" {
+			self.publish(base+"/state", []byte(strings.ToUpper(command)))
+		}
+	case "light":
+		state, ok := self.lights[id]
+		if !ok {
+			state = map[string]interface{}{}
+			self.lights[id] = state
+		}
+		changed := false
+		if command == "on" || command == "off" {
+			state["state"] = strings.ToUpper(command)
+			changed = true
+		}
+		if ev.IsSet("level") {
+			state["brightness"] = ev.IntField("level")
+			changed = true
+		}
+		if temp := ev.IntField("temp"); temp > 0 && device.Cap["colourtemp"] {
+			state["color_temp"] = 1_000_000 / temp
+			changed = true
+		}
+		if changed && state["state"] != nil {
+			data, _ := json.Marshal(state)
+			self.publish(base+"/state", data)
+		}
+	}
+}
+
+// heating publishes thermostats' targets and temperatures from the heating
+// status.
+func (self *Service) heating(ev *pubsub.Event) {
+	status, _ := ev.Fields["status"].(map[string]interface{})
+	zones, _ := status["zones"].(map[string]interface{})
+	for _, z := range zones {
+		zone, _ := z.(map[string]interface{})
+		id, _ := zone["thermostat"].(string)
+		if _, ok := self.config.Value.Devices[id]; !ok {
+			continue
+		}
+		base := fmt.Sprintf("%s/%s", self.topic(), id)
+		if setpoint, ok := zone["setpoint"].(float64); ok {
+			self.publish(base+"/target", []byte(strconv.FormatFloat(setpoint, 'f', -1, 64)))
+		}
+		if temp, ok := zone["temp"].(float64); ok && temp != 0 {
+			self.publish(base+"/temp", []byte(strconv.FormatFloat(temp, 'f', -1, 64)))
+		}
+	}
+}
+
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// publishLoop publishes queued messages, retained.
+func publishLoop(queue chan message) {
+	for msg := range queue {
+		token := mqtt.Client.Publish(msg.topic, 1, true, msg.payload)
+		if token.Wait() && token.Error() != nil {
+			log.Println("Failed to publish message:", token.Error())
+		}
+	}
+}
+
+func (self *Service) Init() error {
+	self.config = services.WaitForConfig()
+	if self.publish == nil {
+		// Waiting on a publish while the MQTT client delivers messages can
+		// deadlock it, so we hand off to a channel.
+		queue := make(chan message, queueSize)
+		go publishLoop(queue)
+		self.publish = func(topic string, payload []byte) {
+			select {
+			case queue <- message{topic, payload}:
+			default:
+				log.Println("Publish channel FULL - dropping message!")
+			}
+		}
+	}
+	self.lights = map[string]map[string]interface{}{}
+	return nil
+}
+
+func (self *Service) Topics() []pubsub.Topic {
+	return []pubsub.Topic{pubsub.All()}
+}
+
+// HandleEvent publishes state from gohome events.
+func (self *Service) HandleEvent(ev *pubsub.Event) {
+	switch ev.Topic {
+	case "command", "query", "alert":
+		// not state
+	case "heating":
+		self.heating(ev)
+	default:
+		if ev.Device() != "" {
+			self.state(ev)
+		}
+	}
+}
+
+// Tick republishes discovery on config changes.
+func (self *Service) Tick() {
+	select {
+	case <-self.config.Updated:
+		self.discover()
+	default:
+	}
+}
+
+func (self *Service) Run() error {
+	self.discover()
+	messages := make(chan MQTT.Message, queueSize)
+	// never block the MQTT client's callbacks
+	handler := func(client MQTT.Client, msg MQTT.Message) {
+		select {
+		case messages <- msg:
+		default:
+			log.Println("Message channel FULL - dropping message!")
+		}
+	}
+	mqtt.Client.Subscribe(self.topic()+"/+/+/set", 1, handler)
+	mqtt.Client.Subscribe(self.topic()+"/+/set", 1, handler)
+	events := services.Subscriber.Subscribe(self.Topics()...)
+	for {
+		select {
+		case msg := <-messages:
+			self.HandleMessage(msg.Topic(), msg.Payload())
+		case ev := <-events:
+			self.HandleEvent(ev)
+		case <-self.config.Updated:
+			self.discover()
+		}
+	}
+}
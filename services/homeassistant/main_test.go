@@ -0,0 +1,138 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/services/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleInterfaces() {
+	var _ services.Service = (*Service)(nil)
+	var _ sim.Service = (*Service)(nil)
+	// Output:
+}
+
+const haYaml = `
+devices:
+  light.kitchen:
+    name: Kitchen
+    location: kitchen
+    caps: [switch]
+  light.lounge:
+    name: Lounge
+    caps: [switch, dimmer, colourtemp]
+  socket.fan:
+    caps: [switch]
+  thermostat.living:
+    name: Living
+  person.alice:
+    caps: [presence]
+  temp.hallway:
+    caps: [temp]
+`
+
+type published map[string]string
+
+func setup(t *testing.T) (*sim.Harness, *Service, published) {
+	h := sim.New(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	h.Config(haYaml)
+	pub := published{}
+	service := &Service{
+		publish: func(topic string, payload []byte) {
+			pub[topic] = string(payload)
+		},
+	}
+	assert.NoError(t, h.Start(service))
+	return h, service, pub
+}
+
+func discovery(t *testing.T, pub published, topic string) map[string]interface{} {
+	var payload map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(pub[topic]), &payload))
+	return payload
+}
+
+func TestDiscover(t *testing.T) {
+	h, service, pub := setup(t)
+	defer h.Close()
+	service.discover()
+
+	assert.Len(t, pub, 5)
+	kitchen := discovery(t, pub, "homeassistant/light/gohome/light_kitchen/config")
+	assert.Equal(t, "Kitchen", kitchen["name"])
+	assert.Equal(t, "gohome_light_kitchen", kitchen["unique_id"])
+	assert.Equal(t, "gohome-ha/light.kitchen/set", kitchen["command_topic"])
+	assert.Equal(t, []interface{}{"onoff"}, kitchen["supported_color_modes"])
+	assert.Equal(t, "kitchen", kitchen["device"].(map[string]interface{})["suggested_area"])
+
+	lounge := discovery(t, pub, "homeassistant/light/gohome/light_lounge/config")
+	assert.Equal(t, []interface{}{"color_temp"}, lounge["supported_color_modes"])
+	assert.Equal(t, true, lounge["brightness"])
+
+	fan := discovery(t, pub, "homeassistant/switch/gohome/socket_fan/config")
+	assert.Equal(t, "gohome-ha/socket.fan/state", fan["state_topic"])
+
+	living := discovery(t, pub, "homeassistant/climate/gohome/thermostat_living/config")
+	assert.Equal(t, "gohome-ha/thermostat.living/target/set", living["temperature_command_topic"])
+
+	alice := discovery(t, pub, "homeassistant/binary_sensor/gohome/person_alice/config")
+	assert.Equal(t, "presence", alice["device_class"])
+
+	// devices no longer configured are removed
+	delete(service.config.Value.Devices, "socket.fan")
+	service.discover()
+	assert.Equal(t, "", pub["homeassistant/switch/gohome/socket_fan/config"])
+}
+
+func TestCommands(t *testing.T) {
+	h, service, _ := setup(t)
+	defer h.Close()
+
+	service.HandleMessage("gohome-ha/socket.fan/set", []byte("ON"))
+	service.HandleMessage("gohome-ha/light.lounge/set", []byte(`{"state":"ON","brightness":40,"color_temp":250}`))
+	service.HandleMessage("gohome-ha/light.unknown/set", []byte("ON"))
+	commands := h.Emitted("command")
+	assert.Len(t, commands, 2)
+	assert.Equal(t, "socket.fan", commands[0].Device())
+	assert.Equal(t, "on", commands[0].Command())
+	assert.Equal(t, "light.lounge", commands[1].Device())
+	assert.Equal(t, 40, commands[1].Fields["level"])
+	assert.Equal(t, 4000, commands[1].Fields["temp"])
+
+	service.HandleMessage("gohome-ha/thermostat.living/target/set", []byte("19.5"))
+	queries := h.Emitted("query")
+	assert.Len(t, queries, 1)
+	assert.Equal(t, "heating/target living 19.5", queries[0].StringField("query"))
+}
+
+func TestState(t *testing.T) {
+	h, _, pub := setup(t)
+	defer h.Close()
+
+	h.Inject(pubsub.NewEvent("ack", pubsub.Fields{"device": "socket.fan", "command": "on"}))
+	assert.Equal(t, "ON", pub["gohome-ha/socket.fan/state"])
+
+	h.Inject(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.lounge", "command": "on", "level": 40}))
+	assert.JSONEq(t, `{"state":"ON","brightness":40}`, pub["gohome-ha/light.lounge/state"])
+
+	h.Inject(pubsub.NewEvent("presence", pubsub.Fields{"device": "person.alice", "command": "off"}))
+	assert.Equal(t, "off", pub["gohome-ha/person.alice/state"])
+
+	// commands aren't state
+	h.Inject(pubsub.NewCommand("socket.fan", "off"))
+	assert.Equal(t, "ON", pub["gohome-ha/socket.fan/state"])
+
+	status := map[string]interface{}{
+		"zones": map[string]interface{}{
+			"living": map[string]interface{}{"thermostat": "thermostat.living", "temp": 18.5, "setpoint": 20.0},
+		},
+	}
+	h.Inject(pubsub.NewEvent("heating", pubsub.Fields{"device": "heating", "status": status}))
+	assert.Equal(t, "20", pub["gohome-ha/thermostat.living/target"])
+	assert.Equal(t, "18.5", pub["gohome-ha/thermostat.living/temp"])
+}
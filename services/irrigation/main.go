@@ -14,6 +14,7 @@ import (
 	"github.com/barnybug/gohome/lib/graphite"
 	"github.com/barnybug/gohome/pubsub"
 	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
 )
 
 func calculateDuration(g graphite.Querier) (duration time.Duration, avgTemp float64) {
@@ -64,7 +65,7 @@ func run(t time.Time) {
 
 	// switch on
 	command(services.Config.Irrigation.Device, true, 3)
-	time.AfterFunc(duration, func() {
+	util.AfterFunc(duration, func() {
 		// switch off
 		command(services.Config.Irrigation.Device, false, 3)
 	})
@@ -90,7 +91,7 @@ func (self *Service) ID() string {
 // Run the service
 func (self *Service) Run() error {
 	// schedule at given time and interval
-	now := time.Now()
+	now := util.Now()
 	run(now)
 	return nil
 }
@@ -1,6 +1,8 @@
 package services
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
@@ -77,6 +79,33 @@ func splitLast(s string, sep string) string {
 	return bits[len(bits)-1]
 }
 
+// subscriberStatus adds any events dropped by slow consumers in this process
+// to a status answer.
+func subscriberStatus(a Answer) Answer {
+	dc, ok := Subscriber.(pubsub.DropCounter)
+	if !ok {
+		return a
+	}
+	dropped := dc.Dropped()
+	if len(dropped) == 0 {
+		return a
+	}
+	var keys []string
+	for k := range dropped {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	text := "dropped events:"
+	for _, k := range keys {
+		text += fmt.Sprintf("\n- %s: %d", k, dropped[k])
+	}
+	if a.Text != "" && !strings.HasSuffix(a.Text, "\n") {
+		a.Text += "\n"
+	}
+	a.Text += text
+	return a
+}
+
 var queries sync.WaitGroup
 
 func handleQuery(ev *pubsub.Event, queryables []Queryable) {
@@ -105,6 +134,9 @@ func handleQuery(ev *pubsub.Event, queryables []Queryable) {
 			go func() {
 				defer queries.Done()
 				a := handler(q)
+				if verb == "status" {
+					a = subscriberStatus(a)
+				}
 				sendAnswer(ev, id, a)
 			}()
 		}
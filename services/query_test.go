@@ -45,3 +45,21 @@ func ExampleQuerySubscriber() {
 	// 1
 	// squiggle
 }
+
+type mockDropCounter struct {
+	dummy.Subscriber
+}
+
+func (m *mockDropCounter) Dropped() map[string]uint64 {
+	return map[string]uint64{"[1] gohome/#": 3}
+}
+
+func ExampleSubscriberStatus() {
+	defer func(s pubsub.Subscriber) { Subscriber = s }(Subscriber)
+	Subscriber = &mockDropCounter{}
+	fmt.Println(subscriberStatus(Answer{Text: "processed: 0"}).Text)
+	// Output:
+	// processed: 0
+	// dropped events:
+	// - [1] gohome/#: 3
+}
@@ -182,9 +182,11 @@ func (self *Service) translatePacket(packet gorfxtrx.Packet) *pubsub.Event {
 	case *gorfxtrx.TransmitAck:
 		pending := <-self.inflight
 		if p.OK() {
+			// only that the transceiver sent it, not that the device received it
 			fields := pubsub.Fields{
-				"device":  pending.Device(),
-				"command": pending.Command(),
+				"device":   pending.Device(),
+				"command":  pending.Command(),
+				"transmit": true,
 			}
 			if level := pending.IntField("level"); level > 0 {
 				fields["level"] = level
@@ -21,6 +21,9 @@ func (self *Service) ID() string {
 	return "rtl433"
 }
 
+// MqttBridge marks the service as using mqtt.Client directly.
+func (self *Service) MqttBridge() {}
+
 var modelMap = map[string]string{
 	"CurrentCost-EnviR": "power",
 	"Oregon-THGR122N":   "temp",
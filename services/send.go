@@ -1,6 +1,15 @@
 package services
 
-import "github.com/barnybug/gohome/pubsub"
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+)
 
 func SendAlert(message string, target string, subtopic string, interval int64) {
 	fields := pubsub.Fields{
@@ -25,3 +34,122 @@ func SendQuery(query, source, remote, reply_to string) {
 	ev := pubsub.NewEvent("query", fields)
 	Publisher.Emit(ev)
 }
+
+// ConfigChecksum identifies config data, to match it to its "configured" event.
+func ConfigChecksum(data []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(data))
+}
+
+// SendConfig publishes config data to path (eg. config/automata), retained.
+// It's preceded by a "configured" event recording who made the change, for
+// the history service to record the revision against.
+func SendConfig(path string, data []byte, author, source string) {
+	fields := pubsub.Fields{
+		"path":     path,
+		"author":   author,
+		"source":   source,
+		"checksum": ConfigChecksum(data),
+	}
+	Publisher.Emit(pubsub.NewEvent("configured", fields))
+	ev := pubsub.NewRawEvent(path, data)
+	ev.SetRetained(true) // config messages are retained
+	Publisher.Emit(ev)
+}
+
+// SendScene emits the commands of a configured scene.
+func SendScene(name string) error {
+	scene, ok := Config.Scenes[name]
+	if !ok {
+		return fmt.Errorf("scene '%s' not found", name)
+	}
+	for _, ev := range scene.Commands() {
+		Publisher.Emit(ev)
+	}
+	log.Printf("Applied scene %s", name)
+	return nil
+}
+
+// CommandResult of a command sent to a target, by device.
+type CommandResult struct {
+	Sent   []string          `json:"sent"`
+	Failed map[string]string `json:"failed,omitempty"` // device -> reason
+}
+
+func (self CommandResult) String() string {
+	s := fmt.Sprintf("sent to %d devices", len(self.Sent))
+	if len(self.Sent) > 0 {
+		s += ": " + strings.Join(self.Sent, ", ")
+	}
+	var failed []string
+	for device, reason := range self.Failed {
+		failed = append(failed, fmt.Sprintf("%s (%s)", device, reason))
+	}
+	sort.Strings(failed)
+	if len(failed) > 0 {
+		s += "; failed: " + strings.Join(failed, ", ")
+	}
+	return s
+}
+
+// fieldCaps are the caps a device needs for command fields.
+var fieldCaps = map[string]string{
+	"level":  "dimmer",
+	"colour": "colour",
+	"temp":   "colourtemp",
+}
+
+// fieldCap needed by the device for a command field, if any. A thermostat's
+// temp is its setpoint, a light's its colour temperature.
+func fieldCap(dev config.DeviceConf, field string) (string, bool) {
+	if field == "temp" && dev.Prefix() == "thermostat" {
+		return "thermostat", true
+	}
+	c, ok := fieldCaps[field]
+	return c, ok
+}
+
+func unsupportedField(device string, fields pubsub.Fields) string {
+	dev := Config.Devices[device]
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, field := range keys {
+		if c, ok := fieldCap(dev, field); ok && !dev.Cap[c] {
+			return field
+		}
+	}
+	return ""
+}
+
+// SendCommand sends a command (fields such as command, level) to a target
+// device, or fans it out to every device of a group:<group> or room:<room>
+// target. Devices in a group not supporting the command's fields fail.
+func SendCommand(target string, fields pubsub.Fields) (CommandResult, error) {
+	result := CommandResult{Sent: []string{}, Failed: map[string]string{}}
+	matches := MatchTarget(target)
+	if len(matches) == 0 {
+		return result, fmt.Errorf("device %s not found", target)
+	}
+	group := GroupTarget(target)
+	if len(matches) > 1 && !group {
+		return result, fmt.Errorf("device %s is ambiguous", strings.Join(matches, ", "))
+	}
+	for _, device := range matches {
+		if group {
+			if field := unsupportedField(device, fields); field != "" {
+				result.Failed[device] = fmt.Sprintf("%s not supported", field)
+				continue
+			}
+		}
+		ev := pubsub.NewEvent("command", pubsub.Fields{})
+		for k, v := range fields {
+			ev.SetField(k, v)
+		}
+		ev.SetField("device", device)
+		Publisher.Emit(ev)
+		result.Sent = append(result.Sent, device)
+	}
+	return result, nil
+}
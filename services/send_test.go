@@ -0,0 +1,74 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupSend with conf, restoring the globals after.
+func setupSend(t *testing.T, conf *config.Config) *dummy.Publisher {
+	previous, publisher := Config, Publisher
+	t.Cleanup(func() { Config, Publisher = previous, publisher })
+	Config = conf
+	me := &dummy.Publisher{}
+	Publisher = me
+	return me
+}
+
+func TestMatchTarget(t *testing.T) {
+	setupSend(t, config.ExampleConfig)
+	assert.Equal(t, []string{"light.kitchen"}, MatchTarget("light.kitchen"))
+	assert.Equal(t, []string{"light.glowworm", "light.kitchen"}, MatchTarget("group:downstairs"))
+	assert.Equal(t, []string{"light.glowworm", "thermostat.living"}, MatchTarget("room:living_room"))
+	assert.Equal(t, []string{"light.kitchen"}, MatchTarget("room:Kitchen"))
+	assert.Equal(t, []string{}, MatchTarget("room:attic"))
+}
+
+func TestSendCommandGroup(t *testing.T) {
+	me := setupSend(t, config.ExampleConfig)
+
+	result, err := SendCommand("group:downstairs", pubsub.Fields{"command": "on", "level": 20})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"light.glowworm"}, result.Sent)
+	assert.Equal(t, map[string]string{"light.kitchen": "level not supported"}, result.Failed)
+	assert.Equal(t, "sent to 1 devices: light.glowworm; failed: light.kitchen (level not supported)", result.String())
+	assert.Equal(t, 1, len(me.Events))
+	assert.Equal(t, "light.glowworm", me.Events[0].Device())
+	assert.Equal(t, 20, me.Events[0].Fields["level"])
+
+	_, err = SendCommand("group:upstairs", pubsub.Fields{"command": "off"})
+	assert.Error(t, err)
+}
+
+func TestSendCommandTemp(t *testing.T) {
+	conf, err := config.OpenRaw([]byte(`
+devices:
+  light.lamp:
+    group: supported
+    caps: [light, colourtemp]
+  thermostat.hall:
+    group: supported
+    caps: [thermostat]
+  light.hall:
+    group: unsupported
+    caps: [light, thermostat]
+  thermostat.living:
+    group: unsupported
+    caps: [colourtemp]
+`))
+	assert.NoError(t, err)
+	setupSend(t, conf)
+
+	// a light's colour temperature, a thermostat's setpoint
+	result, err := SendCommand("group:supported", pubsub.Fields{"command": "on", "temp": 20})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"light.lamp", "thermostat.hall"}, result.Sent)
+
+	result, _ = SendCommand("group:unsupported", pubsub.Fields{"command": "on", "temp": 20})
+	assert.Empty(t, result.Sent)
+	assert.Equal(t, map[string]string{"light.hall": "temp not supported", "thermostat.living": "temp not supported"}, result.Failed)
+}
@@ -5,12 +5,17 @@ import (
 	"fmt"
 	"hash/fnv"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/barnybug/gohome/config"
 	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/embedded"
 	"github.com/barnybug/gohome/pubsub/mqtt"
 	"github.com/barnybug/gohome/util"
 )
@@ -31,6 +36,12 @@ type Flags interface {
 	Flags()
 }
 
+// MqttBridge is implemented by services bridging other mqtt topics with
+// mqtt.Client, which need an mqtt broker - they can't run with mem://.
+type MqttBridge interface {
+	MqttBridge()
+}
+
 var serviceMap map[string]Service = map[string]Service{}
 var enabled []Service
 var Config *config.Config
@@ -45,7 +56,7 @@ type ConfigWaiter struct {
 	Value   []byte
 	hash    uint32
 	events  <-chan *pubsub.Event
-	update  func()
+	update  func(value []byte) bool
 	Updated chan bool
 }
 
@@ -58,11 +69,15 @@ func NewConfigWaiter(topic pubsub.Topic) *ConfigWaiter {
 }
 
 func (c *ConfigWaiter) Wait() {
-	// wait until changed
-	for !c.loopOne() {
-	}
-	if c.update != nil {
-		c.update()
+	// wait until changed, and accepted
+	for {
+		value, changed := c.loopOne()
+		if !changed || (c.update != nil && !c.update(value)) {
+			continue
+		}
+		c.hash = hash(value)
+		c.Value = value
+		return
 	}
 }
 
@@ -77,21 +92,17 @@ func (c *ConfigWaiter) notify() {
 	}
 }
 
-func (c *ConfigWaiter) loopOne() bool {
+func (c *ConfigWaiter) loopOne() ([]byte, bool) {
 	// log.Printf("ConfigWaiter %s waiting for events", c.topic)
 	ev := <-c.events
 	value := ev.Bytes()
-	hashValue := hash(value)
-	previous := c.hash
-	if previous == hashValue {
+	if c.hash == hash(value) {
 		// ignore duplicate events - from services subscribing to gohome/#.
 		// log.Printf("ConfigWaiter %s received event - unchanged", c.topic)
-		return false
+		return nil, false
 	}
 	// log.Printf("ConfigWaiter %s received event", c.topic)
-	c.hash = hashValue
-	c.Value = value
-	return true
+	return value, true
 }
 
 func (c *ConfigWaiter) Watch() {
@@ -116,19 +127,32 @@ func NewConfigService() *ConfigService {
 		},
 		nil,
 	}
-	cs.update = func() {
-		// (re)load config
-		conf, err := config.OpenRaw(cs.ConfigWaiter.Value)
-		if err != nil {
-			log.Println("Error reading config:", err)
-			return
-		}
-		cs.Value = conf
-		Config = conf // set global
-	}
+	cs.update = cs.load
 	return cs
 }
 
+// load the (re)loaded config, returning false if rejected. The value is only
+// kept once accepted.
+func (cs *ConfigService) load(value []byte) bool {
+	// (re)load config
+	conf, problems := config.Check(value)
+	if conf == nil {
+		log.Printf("Error reading config:\n%s", problems)
+		return false
+	}
+	if err := problems.Err(); err != nil && cs.Value != nil {
+		// keep running with the current config, rather than half-apply
+		log.Printf("Rejected invalid config:\n%s", err)
+		return false
+	}
+	if len(problems) > 0 {
+		log.Printf("Config problems:\n%s", problems)
+	}
+	cs.Value = conf
+	Config = conf // set global
+	return true
+}
+
 func SetupLogging() {
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
 	log.SetOutput(os.Stdout)
@@ -153,6 +177,13 @@ func WaitForConfig() *ConfigService {
 	return globalConfigService
 }
 
+// ResetConfig forgets the config service, so the next WaitForConfig waits for
+// config afresh (eg. on a new Subscriber).
+func ResetConfig() {
+	globalConfigService = nil
+	Config = nil
+}
+
 func SetupFlags() {
 	for _, service := range enabled {
 		// any service specific flags
@@ -165,21 +196,64 @@ func SetupFlags() {
 
 func SetupBroker(name string) {
 	// create Publisher
-	url := os.Getenv("GOHOME_MQTT")
-	if url == "" {
-		log.Fatalln("Set GOHOME_MQTT to the mqtt server. eg: tcp://127.0.0.1:1883")
+	uri := os.Getenv("GOHOME_MQTT")
+	if uri == "" {
+		log.Fatalln("Set GOHOME_MQTT to the mqtt server. eg: tcp://127.0.0.1:1883 (or mem:// for in-process)")
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		log.Fatalln("Invalid GOHOME_MQTT:", err)
 	}
 
-	broker := mqtt.NewBroker(url, name)
-	Publisher = broker.Publisher()
+	switch u.Scheme {
+	case "mem":
+		// in-process only
+		broker := embedded.NewBroker("")
+		Publisher = broker.Publisher()
+		Subscriber = broker.Subscriber()
+	case "embedded":
+		// in-process broker, also accepting mqtt connections. Connect to it as
+		// a regular mqtt client, so services bridging other mqtt topics work.
+		broker := embedded.NewBroker(u.Host)
+		addr, err := broker.Listen(u.Host)
+		if err != nil {
+			log.Fatalln("Failed to start embedded broker:", err)
+		}
+		log.Println("Embedded mqtt broker listening on", addr)
+		_, port, _ := net.SplitHostPort(addr.String())
+		setupMqtt("tcp://127.0.0.1:"+port, name)
+	default:
+		setupMqtt(uri, name)
+	}
 	if Publisher == nil {
 		log.Fatalln("Failed to initialise pub endpoint")
 	}
-	Subscriber = broker.Subscriber()
 	if Subscriber == nil {
 		log.Fatalln("Failed to initialise sub endpoint")
 	}
+}
+
+func setupMqtt(uri, name string) {
+	broker := mqtt.NewBroker(uri, name)
+	if value := os.Getenv("GOHOME_QUEUE"); value != "" {
+		// eg. drop-oldest,64 or block,16,2s
+		opts, err := pubsub.ParseQueueOptions(value)
+		if err != nil {
+			log.Fatalln("Invalid GOHOME_QUEUE:", err)
+		}
+		broker.SetQueueOptions(opts)
+	}
+	Publisher = broker.Publisher()
+	Subscriber = broker.Subscriber()
+}
 
+// SubscribeQueue subscribes with specific queue options, if supported by the
+// Subscriber.
+func SubscribeQueue(opts pubsub.QueueOptions, topics ...pubsub.Topic) <-chan *pubsub.Event {
+	if qs, ok := Subscriber.(pubsub.QueueSubscriber); ok {
+		return qs.SubscribeQueue(opts, topics...)
+	}
+	return Subscriber.Subscribe(topics...)
 }
 
 func Setup(name string) {
@@ -196,6 +270,12 @@ func Launch(ss []string) {
 		}
 	}
 
+	for _, service := range enabled {
+		if _, ok := service.(MqttBridge); ok && mqtt.Client == nil {
+			log.Fatalf("Service %s needs an mqtt broker: set GOHOME_MQTT to embedded:// or tcp://, not mem://", service.ID())
+		}
+	}
+
 	SetupFlags()
 
 	// listen for commands
@@ -215,14 +295,21 @@ func Launch(ss []string) {
 		}
 	}
 
+	// run services concurrently, so several can share one process
+	var wg sync.WaitGroup
 	for _, service := range enabled {
-		// run heartbeater
-		go Heartbeat(service.ID())
-		err := service.Run()
-		if err != nil {
-			log.Fatalf("Error running service %s: %s", service.ID(), err.Error())
-		}
+		wg.Add(1)
+		go func(service Service) {
+			defer wg.Done()
+			// run heartbeater
+			go Heartbeat(service.ID())
+			err := service.Run()
+			if err != nil {
+				log.Fatalf("Error running service %s: %s", service.ID(), err.Error())
+			}
+		}(service)
 	}
+	wg.Wait()
 }
 
 func Heartbeat(id string) {
@@ -274,6 +361,52 @@ func MatchDevices(n string) []string {
 	return matches
 }
 
+// commandCaps are the caps of devices that take commands.
+var commandCaps = []string{"switch", "dimmer", "colour", "colourtemp", "thermostat"}
+
+// GroupTarget returns if the target addresses a group of devices, eg.
+// group:lights or room:kitchen.
+func GroupTarget(target string) bool {
+	return strings.HasPrefix(target, "group:") || strings.HasPrefix(target, "room:")
+}
+
+func normalizeRoom(s string) string {
+	s = strings.ToLower(s)
+	return strings.NewReplacer("_", " ", "-", " ").Replace(s)
+}
+
+// MatchTarget resolves a command target to devices. group:<group> and
+// room:<location> match every device taking commands in the group or room
+// (case insensitive, with _ or - for spaces in rooms), otherwise as
+// MatchDevices.
+func MatchTarget(target string) []string {
+	if !GroupTarget(target) {
+		return MatchDevices(target)
+	}
+	kind, name, _ := strings.Cut(target, ":")
+	matches := []string{}
+	for id, dev := range Config.Devices {
+		switch kind {
+		case "group":
+			if !strings.EqualFold(dev.Group, name) {
+				continue
+			}
+		case "room":
+			if dev.Location == "" || normalizeRoom(dev.Location) != normalizeRoom(name) {
+				continue
+			}
+		}
+		for _, c := range commandCaps {
+			if dev.Cap[c] {
+				matches = append(matches, id)
+				break
+			}
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
 func Shutdown() {
 	if Publisher != nil {
 		Publisher.Close()
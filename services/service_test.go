@@ -0,0 +1,37 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func configEvents(values ...string) chan *pubsub.Event {
+	ch := make(chan *pubsub.Event, len(values))
+	for _, v := range values {
+		ch <- pubsub.NewRawEvent("config", []byte(v))
+	}
+	return ch
+}
+
+func TestConfigServiceRejectsInvalidReload(t *testing.T) {
+	valid := "heating:\n  zones:\n    hall: temp.hall\ndevices:\n  temp.hall: {}\n"
+	invalid := "heating:\n  zones:\n    hall: temp.hall\n    living: temp.living\ndevices:\n  temp.hall: {}\n"
+	cs := &ConfigService{ConfigWaiter: ConfigWaiter{events: configEvents(valid, invalid, valid+"\n")}}
+	var current []string
+	cs.update = func(value []byte) bool {
+		current = append(current, string(cs.ConfigWaiter.Value))
+		return cs.load(value)
+	}
+
+	cs.Wait()
+	assert.Len(t, cs.Value.Heating.Zones, 1)
+
+	// invalid reload is skipped, keeping the current config
+	cs.Wait()
+	assert.Len(t, cs.Value.Heating.Zones, 1)
+	assert.Equal(t, valid+"\n", string(cs.ConfigWaiter.Value))
+	// the invalid value was never kept
+	assert.Equal(t, []string{"", valid, valid}, current)
+}
@@ -22,6 +22,9 @@ func (self *Service) ID() string {
 	return "shelly"
 }
 
+// MqttBridge marks the service as using mqtt.Client directly.
+func (self *Service) MqttBridge() {}
+
 type StatusPayload struct {
 	Ison       bool `json:"ison"`
 	Brightness int  `json:"brightness"`
@@ -0,0 +1,314 @@
+// Package sim is a deterministic simulation harness for services, so whole
+// scenarios (eg. a day of heating and automata behaviour) run in milliseconds
+// under go test.
+//
+// The harness stands in for the pubsub Publisher and Subscriber, and swaps
+// util.DefaultClock for a VirtualClock. Services are stepped synchronously,
+// rather than by Run: each emitted event is delivered in order to every
+// service subscribed, and advancing the clock fires timers in deadline order,
+// ticking each service after every one.
+//
+//	h := sim.New(start)
+//	defer h.Close()
+//	h.Config(configYaml)
+//	h.Start(&heating.Service{})
+//	h.Inject(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 15.0}))
+//	h.Advance(time.Hour)
+//	commands := h.Emitted("command")
+package sim
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
+)
+
+// Service is implemented by services that can be stepped by the harness. The
+// methods mirror the service's Run loop.
+type Service interface {
+	services.Service
+	// Topics the service subscribes to.
+	Topics() []pubsub.Topic
+	// HandleEvent handles an event received on Topics.
+	HandleEvent(ev *pubsub.Event)
+	// Tick handles anything pending from the service's timers, without
+	// blocking.
+	Tick()
+}
+
+// maximum events delivered in one step, before assuming services are looping
+const maxEvents = 10000
+
+// Harness is a simulated gohome bus and clock.
+type Harness struct {
+	// Virtual clock, starting at the time given to New.
+	Clock *util.VirtualClock
+	// Every event emitted, in order.
+	Events *dummy.Publisher
+
+	lock     sync.Mutex
+	services []Service
+	queue    []*pubsub.Event
+	retained map[string]*pubsub.Event
+
+	publisher  pubsub.Publisher
+	subscriber pubsub.Subscriber
+	clock      util.Clock
+}
+
+// New creates a harness starting at start, and installs it as the services
+// Publisher/Subscriber and util.DefaultClock until Close.
+func New(start time.Time) *Harness {
+	h := &Harness{
+		Clock:      util.NewVirtualClock(start),
+		Events:     &dummy.Publisher{},
+		retained:   map[string]*pubsub.Event{},
+		publisher:  services.Publisher,
+		subscriber: services.Subscriber,
+		clock:      util.DefaultClock,
+	}
+	services.Publisher = publisher{h}
+	services.Subscriber = subscriber{h}
+	services.ResetConfig()
+	util.DefaultClock = h.Clock
+	return h
+}
+
+// Close restores the previous Publisher, Subscriber and clock.
+func (h *Harness) Close() {
+	services.Publisher = h.publisher
+	services.Subscriber = h.subscriber
+	services.ResetConfig()
+	util.DefaultClock = h.clock
+}
+
+// Config sets the retained gohome config.
+func (h *Harness) Config(value string) {
+	h.Retain(pubsub.NewRawEvent("config", []byte(value)))
+}
+
+// Retain sets a retained event, as delivered on subscribing or to services
+// on Start.
+func (h *Harness) Retain(ev *pubsub.Event) {
+	ev.SetRetained(true)
+	h.lock.Lock()
+	h.retained[routingTopic(ev)] = ev
+	h.lock.Unlock()
+}
+
+// Start initializes services, delivers retained events to them, and runs
+// until idle.
+func (h *Harness) Start(svcs ...Service) error {
+	for _, service := range svcs {
+		if service, ok := service.(services.ServiceInit); ok {
+			if err := service.Init(); err != nil {
+				return fmt.Errorf("init %s: %s", service.ID(), err)
+			}
+		} else {
+			services.WaitForConfig()
+		}
+		h.services = append(h.services, service)
+	}
+
+	for _, ev := range h.retainedEvents() {
+		for _, service := range svcs {
+			if subscribed(service, ev) {
+				service.HandleEvent(copyEvent(ev, true))
+			}
+		}
+	}
+	// fire any timers already due
+	h.AdvanceTo(h.Clock.Now())
+	return nil
+}
+
+// Inject emits an event and runs until idle.
+func (h *Harness) Inject(ev *pubsub.Event) {
+	h.Emit(ev)
+	h.settle()
+}
+
+// Advance moves the clock forward by d, running until idle after each timer
+// fires.
+func (h *Harness) Advance(d time.Duration) {
+	h.AdvanceTo(h.Clock.Now().Add(d))
+}
+
+// AdvanceTo moves the clock forward to t, running until idle after each
+// timer fires.
+func (h *Harness) AdvanceTo(t time.Time) {
+	for h.Clock.Step(t) {
+		h.settle()
+	}
+	h.settle()
+}
+
+// Now returns the simulated time.
+func (h *Harness) Now() time.Time {
+	return h.Clock.Now()
+}
+
+// Emitted returns the events emitted on topic, in order.
+func (h *Harness) Emitted(topic string) []*pubsub.Event {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var evs []*pubsub.Event
+	for _, ev := range h.Events.Events {
+		if ev.Topic == topic {
+			evs = append(evs, ev)
+		}
+	}
+	return evs
+}
+
+// Clear forgets the events emitted so far.
+func (h *Harness) Clear() {
+	h.lock.Lock()
+	h.Events.Events = nil
+	h.lock.Unlock()
+}
+
+// Emit an event, without running.
+func (h *Harness) Emit(ev *pubsub.Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.Events.Emit(ev)
+	if ev.Retained && ev.Format == "raw" && len(ev.Raw) == 0 {
+		// empty retained message clears the topic
+		delete(h.retained, routingTopic(ev))
+	} else if ev.Retained {
+		h.retained[routingTopic(ev)] = ev
+	}
+	h.queue = append(h.queue, ev)
+}
+
+type publisher struct {
+	h *Harness
+}
+
+func (p publisher) ID() string {
+	return "sim"
+}
+
+func (p publisher) Emit(ev *pubsub.Event) {
+	p.h.Emit(ev)
+}
+
+func (p publisher) Close() {}
+
+// subscriber only sends the retained events at the time of subscribing (eg.
+// config) - services are sent events by HandleEvent.
+type subscriber struct {
+	h *Harness
+}
+
+func (s subscriber) ID() string {
+	return "sim"
+}
+
+func (s subscriber) Subscribe(topics ...pubsub.Topic) <-chan *pubsub.Event {
+	var evs []*pubsub.Event
+	for _, ev := range s.h.retainedEvents() {
+		for _, t := range topics {
+			if pubsub.Matches(t, routingTopic(ev), ev) {
+				evs = append(evs, copyEvent(ev, true))
+				break
+			}
+		}
+	}
+	ch := make(chan *pubsub.Event, len(evs))
+	for _, ev := range evs {
+		ch <- ev
+	}
+	return ch
+}
+
+func (s subscriber) Close(<-chan *pubsub.Event) {}
+
+func (h *Harness) retainedEvents() []*pubsub.Event {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var keys []string
+	for k := range h.retained {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var evs []*pubsub.Event
+	for _, k := range keys {
+		evs = append(evs, h.retained[k])
+	}
+	return evs
+}
+
+func (h *Harness) next() *pubsub.Event {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.queue) == 0 {
+		return nil
+	}
+	ev := h.queue[0]
+	h.queue = h.queue[1:]
+	return ev
+}
+
+// settle ticks services and delivers queued events until there are none left.
+func (h *Harness) settle() {
+	for i := 0; ; i++ {
+		if i > maxEvents {
+			panic("sim: services did not settle")
+		}
+		for _, service := range h.services {
+			service.Tick()
+		}
+		ev := h.next()
+		if ev == nil {
+			return
+		}
+		for _, service := range h.services {
+			if subscribed(service, ev) {
+				service.HandleEvent(copyEvent(ev, false))
+			}
+		}
+	}
+}
+
+func subscribed(service Service, ev *pubsub.Event) bool {
+	topic := routingTopic(ev)
+	for _, t := range service.Topics() {
+		if pubsub.Matches(t, topic, ev) {
+			return true
+		}
+	}
+	return false
+}
+
+// routingTopic is the topic events are published under, as mqtt.
+func routingTopic(ev *pubsub.Event) string {
+	if ev.Device() != "" {
+		return ev.Topic + "/" + ev.Device()
+	}
+	return ev.Topic
+}
+
+// copyEvent round trips the event through the wire format, so each service
+// gets its own copy with the same field types as from mqtt.
+func copyEvent(ev *pubsub.Event, retained bool) *pubsub.Event {
+	var c *pubsub.Event
+	if ev.Format == "raw" {
+		c = pubsub.NewRawEvent(ev.Topic, ev.Raw)
+	} else {
+		c = pubsub.Parse(string(ev.Bytes()), ev.Topic)
+	}
+	if c == nil {
+		panic(fmt.Sprintf("sim: unparseable event: %s", ev))
+	}
+	c.Timestamp = ev.Timestamp
+	c.SetRetained(retained)
+	return c
+}
@@ -0,0 +1,143 @@
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services/automata"
+	"github.com/barnybug/gohome/services/heating"
+	"github.com/stretchr/testify/assert"
+)
+
+var configYaml = `
+devices:
+  heater.boiler:
+    name: Boiler
+  light.porch:
+    name: Porch
+  pir.hall:
+    name: Hall
+  temp.hallway:
+    name: Hallway
+heating:
+  device: heater.boiler
+  zones:
+    hallway: temp.hallway
+  minimum: 10
+  slop: 0.3
+`
+
+var automataYaml = `
+porch:
+  start: Off
+  states:
+    Off:
+      entering:
+      - Command('light.porch off')
+    On:
+      entering:
+      - Command('light.porch on')
+  transitions:
+    Off->On:
+    - when: device=='pir.hall' && command=='on'
+      actions:
+      - StartTimer('porch', 300)
+    On->Off:
+    - when: device=='timer.porch'
+`
+
+var start = time.Date(2020, 1, 6, 19, 0, 30, 0, time.UTC)
+
+func setup(t *testing.T) *Harness {
+	h := New(start)
+	h.Config(configYaml)
+	h.Retain(pubsub.NewRawEvent("config/automata", []byte(automataYaml)))
+	err := h.Start(&heating.Service{}, &automata.Service{})
+	assert.NoError(t, err)
+	return h
+}
+
+func commands(h *Harness, device string) []string {
+	var out []string
+	for _, ev := range h.Emitted("command") {
+		if ev.Device() == device {
+			out = append(out, ev.Timestamp.Format("15:04:05")+" "+ev.Command())
+		}
+	}
+	return out
+}
+
+func TestAutomataTimer(t *testing.T) {
+	h := setup(t)
+	defer h.Close()
+
+	h.Inject(pubsub.NewEvent("pir", pubsub.Fields{"device": "pir.hall", "command": "on"}))
+	assert.Equal(t, []string{"19:00:30 on"}, commands(h, "light.porch"))
+
+	h.Advance(4 * time.Minute)
+	assert.Equal(t, []string{"19:00:30 on"}, commands(h, "light.porch"))
+
+	h.Advance(2 * time.Minute)
+	assert.Equal(t, []string{"19:00:30 on", "19:05:30 off"}, commands(h, "light.porch"))
+
+	// minute clock events from automata
+	assert.Len(t, h.Emitted("clock"), 6)
+}
+
+func TestHeatingDay(t *testing.T) {
+	h := setup(t)
+	defer h.Close()
+
+	h.Inject(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 9.0}))
+	assert.Equal(t, []string{"19:00:30 on"}, commands(h, "heater.boiler"))
+
+	// sensor goes quiet - heating turns off once the reading is stale, and
+	// the heartbeat repeats the command every minute for the rest of the day
+	h.Clear()
+	h.AdvanceTo(start.Add(24 * time.Hour))
+	cmds := commands(h, "heater.boiler")
+	assert.Equal(t, []string{"19:01:00 on", "19:02:00 on", "19:03:00 on", "19:04:00 on", "19:05:00 on", "19:06:00 on", "19:07:00 off"}, cmds[:7])
+	assert.Len(t, cmds, 24*60+1)
+	assert.Len(t, h.Emitted("heating"), 24*60)
+}
+
+// restart runs a fresh automata service at t, with the retained events left
+// by h.
+func restart(t *testing.T, h *Harness, at time.Time) *Harness {
+	retained := h.retainedEvents()
+	h.Close()
+	h = New(at)
+	for _, ev := range retained {
+		h.Retain(ev)
+	}
+	assert.NoError(t, h.Start(&automata.Service{}))
+	return h
+}
+
+func TestAutomataTimerRestart(t *testing.T) {
+	h := setup(t)
+	h.Inject(pubsub.NewEvent("pir", pubsub.Fields{"device": "pir.hall", "command": "on"}))
+	h.Advance(time.Minute)
+
+	// timer re-armed for its remaining time
+	h = restart(t, h, start.Add(3*time.Minute))
+	defer h.Close()
+	h.Advance(time.Minute)
+	assert.Empty(t, commands(h, "light.porch"))
+	h.Advance(time.Minute)
+	assert.Equal(t, []string{"19:05:30 off"}, commands(h, "light.porch"))
+	// and no longer pending
+	for _, ev := range h.retainedEvents() {
+		assert.NotEqual(t, "pending", ev.Topic)
+	}
+}
+
+func TestAutomataTimerExpiredWhileDown(t *testing.T) {
+	h := setup(t)
+	h.Inject(pubsub.NewEvent("pir", pubsub.Fields{"device": "pir.hall", "command": "on"}))
+
+	h = restart(t, h, start.Add(10*time.Minute))
+	defer h.Close()
+	assert.Equal(t, []string{"19:10:30 off"}, commands(h, "light.porch"))
+}
@@ -105,6 +105,9 @@ func (self *Service) ID() string {
 	return "tasmota"
 }
 
+// MqttBridge marks the service as using mqtt.Client directly.
+func (self *Service) MqttBridge() {}
+
 func (self *Service) Run() error {
 	commandChannel := services.Subscriber.Subscribe(pubsub.Prefix("command"))
 	messageChannel := make(chan MQTT.Message)
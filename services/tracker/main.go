@@ -0,0 +1,256 @@
+// Service to track commands are confirmed by devices, retrying those that
+// aren't, for unreliable radios (eg. 433MHz) that can miss a packet.
+//
+// Only devices with the report cap are tracked: those that report their
+// state (eg. a smart plug's power), as one-way devices could never confirm.
+// A command is confirmed by a subsequent event from the device: an ack, or
+// any event reporting the same command. Acks marked transmit (eg. rfxtrx's)
+// only report the command was sent, so don't confirm it.
+// Commands not confirmed within the protocol's timeout are resent, and after
+// the retries a command_failed event and alert are sent:
+//
+//	devices:
+//	  switch.heater:
+//	    caps: [switch, report]
+//	    source: homeeasy.00123453
+//	tracker:
+//	  alert: admin
+//	  protocols:
+//	    homeeasy:
+//	      timeout: 5s
+//	      retries: 2
+//	    default:
+//	      timeout: 30s
+package tracker
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
+)
+
+// failures kept for the status query
+const failuresSize = 20
+
+// Pending is a command awaiting confirmation.
+type Pending struct {
+	Device   string
+	Command  *pubsub.Event
+	Sent     time.Time
+	Attempts int
+	timer    *util.Timer
+}
+
+// Service tracker
+type Service struct {
+	config   *services.ConfigService
+	lock     sync.Mutex // pending and failures, also read by queries
+	pending  map[string]*Pending
+	failures []*pubsub.Event
+	expired  chan *Pending
+}
+
+func (self *Service) ID() string {
+	return "tracker"
+}
+
+// policy for confirming commands to the device, if tracked.
+func (self *Service) policy(device string) (config.TrackerPolicyConf, bool) {
+	conf := self.config.Value
+	dev, ok := conf.Devices[device]
+	if !ok || dev.Source == "" || !dev.Cap["report"] {
+		return config.TrackerPolicyConf{}, false
+	}
+	protocol := strings.SplitN(dev.Source, ".", 2)[0]
+	if p, ok := conf.Tracker.Protocols[protocol]; ok {
+		return p, !p.Timeout.IsZero()
+	}
+	p, ok := conf.Tracker.Protocols["default"]
+	return p, ok && !p.Timeout.IsZero()
+}
+
+func (self *Service) track(ev *pubsub.Event) {
+	if ev.IsSet("retry") {
+		// our own resend
+		return
+	}
+	device := ev.Device()
+	policy, ok := self.policy(device)
+	if !ok {
+		return
+	}
+	// a new command supersedes any pending
+	self.stop(device)
+	p := &Pending{Device: device, Command: ev, Sent: util.Now(), Attempts: 1}
+	self.arm(p, policy.Timeout.Duration)
+}
+
+func (self *Service) arm(p *Pending, timeout time.Duration) {
+	p.timer = util.AfterFunc(timeout, func() {
+		self.expired <- p
+	})
+	self.pending[p.Device] = p
+}
+
+func (self *Service) stop(device string) {
+	if p, ok := self.pending[device]; ok {
+		p.timer.Stop()
+		delete(self.pending, device)
+	}
+}
+
+// confirms returns if an event from a device confirms the command.
+func confirms(ev *pubsub.Event, command *pubsub.Event) bool {
+	if ev.Topic == "ack" {
+		if ev.IsSet("transmit") {
+			// sent, but not necessarily received
+			return false
+		}
+		return ev.Command() == "" || ev.Command() == command.Command()
+	}
+	return ev.IsSet("command") && ev.Command() == command.Command()
+}
+
+func (self *Service) confirm(ev *pubsub.Event) {
+	p, ok := self.pending[ev.Device()]
+	if !ok || !confirms(ev, p.Command) {
+		return
+	}
+	if p.Attempts > 1 {
+		log.Printf("%s confirmed %s after %d attempts", p.Device, p.Command.Command(), p.Attempts)
+	}
+	self.stop(p.Device)
+}
+
+func (self *Service) timeout(p *Pending) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.pending[p.Device] != p {
+		// confirmed or superseded since
+		return
+	}
+	policy, _ := self.policy(p.Device)
+	if p.Attempts <= policy.Retries {
+		p.Attempts++
+		log.Printf("Resending %s %s (attempt %d)", p.Device, p.Command.Command(), p.Attempts)
+		ev := pubsub.NewEvent("command", pubsub.Fields{})
+		for k, v := range p.Command.Fields {
+			ev.SetField(k, v)
+		}
+		ev.SetField("retry", p.Attempts-1)
+		services.Publisher.Emit(ev)
+		self.arm(p, policy.Timeout.Duration)
+		return
+	}
+	delete(self.pending, p.Device)
+	self.failed(p)
+}
+
+func (self *Service) failed(p *Pending) {
+	fields := pubsub.Fields{
+		"device":   p.Device,
+		"command":  p.Command.Command(),
+		"attempts": p.Attempts,
+	}
+	ev := pubsub.NewEvent("command_failed", fields)
+	services.Publisher.Emit(ev)
+	self.failures = append(self.failures, ev)
+	if len(self.failures) > failuresSize {
+		self.failures = self.failures[1:]
+	}
+
+	name := p.Device
+	if dev, ok := self.config.Value.Devices[p.Device]; ok && dev.Name != "" {
+		name = dev.Name
+	}
+	message := fmt.Sprintf("%s did not confirm '%s' after %d attempts", name, p.Command.Command(), p.Attempts)
+	log.Println(message)
+	services.SendAlert("⚠️ "+message, self.config.Value.Tracker.Alert, "", 0)
+}
+
+func (self *Service) Init() error {
+	self.config = services.WaitForConfig()
+	self.pending = map[string]*Pending{}
+	self.expired = make(chan *Pending, 32)
+	return nil
+}
+
+func (self *Service) Topics() []pubsub.Topic {
+	return []pubsub.Topic{pubsub.All()}
+}
+
+func (self *Service) HandleEvent(ev *pubsub.Event) {
+	if ev.Retained || ev.Device() == "" {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	switch ev.Topic {
+	case "command":
+		self.track(ev)
+	case "command_failed":
+	default:
+		self.confirm(ev)
+	}
+}
+
+// Tick handles any timeouts due, without blocking.
+func (self *Service) Tick() {
+	for {
+		select {
+		case p := <-self.expired:
+			self.timeout(p)
+		default:
+			return
+		}
+	}
+}
+
+func (self *Service) Run() error {
+	events := services.Subscriber.Subscribe(self.Topics()...)
+	for {
+		select {
+		case ev := <-events:
+			self.HandleEvent(ev)
+		case p := <-self.expired:
+			self.timeout(p)
+		}
+	}
+}
+
+func (self *Service) QueryHandlers() services.QueryHandlers {
+	return services.QueryHandlers{
+		"status": services.TextHandler(self.queryStatus),
+		"help":   services.StaticHandler("status: get pending and failed commands\n"),
+	}
+}
+
+func (self *Service) queryStatus(q services.Question) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var devices []string
+	for device := range self.pending {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	now := util.Now()
+	out := fmt.Sprintf("%d pending\n", len(devices))
+	for _, device := range devices {
+		p := self.pending[device]
+		out += fmt.Sprintf("%-20s %-6s attempt %d, %s ago\n", device, p.Command.Command(), p.Attempts, util.ShortDuration(now.Sub(p.Sent)))
+	}
+	out += fmt.Sprintf("%d failed\n", len(self.failures))
+	for i := len(self.failures) - 1; i >= 0; i-- {
+		ev := self.failures[i]
+		out += fmt.Sprintf("%s %-20s %s\n", ev.Timestamp.Local().Format("Jan _2 15:04:05"), ev.Device(), ev.Command())
+	}
+	return out
+}
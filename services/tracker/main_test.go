@@ -0,0 +1,159 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/services/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleInterfaces() {
+	var _ services.Service = (*Service)(nil)
+	var _ sim.Service = (*Service)(nil)
+	// Output:
+}
+
+var start = time.Date(2024, 1, 1, 19, 0, 0, 0, time.UTC)
+
+const trackerYaml = `
+devices:
+  light.kitchen:
+    name: Kitchen
+    caps: [switch, report]
+    source: homeeasy.001
+  light.porch:
+    caps: [switch]
+    source: homeeasy.002
+  light.hall:
+    caps: [switch]
+    source: zigbee.hall
+  light.virtual:
+    caps: [switch]
+tracker:
+  alert: admin
+  protocols:
+    homeeasy:
+      timeout: 5s
+      retries: 2
+`
+
+func setup(t *testing.T) *sim.Harness {
+	h := sim.New(start)
+	h.Config(trackerYaml)
+	assert.NoError(t, h.Start(&Service{}))
+	return h
+}
+
+func TestConfirmed(t *testing.T) {
+	h := setup(t)
+	defer h.Close()
+
+	h.Inject(pubsub.NewCommand("light.kitchen", "on"))
+	h.Inject(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}))
+	h.Advance(time.Minute)
+	assert.Len(t, h.Emitted("command"), 1)
+	assert.Len(t, h.Emitted("command_failed"), 0)
+}
+
+func TestTransmitAck(t *testing.T) {
+	h := setup(t)
+	defer h.Close()
+
+	// the transceiver sent it, the device may not have received it
+	h.Inject(pubsub.NewCommand("light.kitchen", "on"))
+	h.Inject(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on", "transmit": true}))
+	h.Advance(5 * time.Second)
+	assert.Len(t, h.Emitted("command"), 2)
+
+	h.Inject(pubsub.NewEvent("power", pubsub.Fields{"device": "light.kitchen", "command": "on"}))
+	h.Advance(time.Minute)
+	assert.Len(t, h.Emitted("command"), 2)
+	assert.Len(t, h.Emitted("command_failed"), 0)
+}
+
+func TestRetries(t *testing.T) {
+	h := setup(t)
+	defer h.Close()
+
+	h.Inject(pubsub.NewCommand("light.kitchen", "on"))
+	h.Advance(5 * time.Second)
+	commands := h.Emitted("command")
+	assert.Len(t, commands, 2)
+	assert.Equal(t, 1, commands[1].Fields["retry"])
+
+	// confirmed by a state report
+	h.Inject(pubsub.NewEvent("power", pubsub.Fields{"device": "light.kitchen", "command": "on"}))
+	h.Advance(time.Minute)
+	assert.Len(t, h.Emitted("command"), 2)
+	assert.Len(t, h.Emitted("command_failed"), 0)
+}
+
+func TestFailed(t *testing.T) {
+	h := setup(t)
+	defer h.Close()
+
+	h.Inject(pubsub.NewCommand("light.kitchen", "on"))
+	// a different command isn't a confirmation
+	h.Inject(pubsub.NewEvent("power", pubsub.Fields{"device": "light.kitchen", "command": "off"}))
+	h.Advance(time.Minute)
+	assert.Len(t, h.Emitted("command"), 3)
+	failed := h.Emitted("command_failed")
+	assert.Len(t, failed, 1)
+	assert.Equal(t, "light.kitchen", failed[0].Device())
+	assert.Equal(t, 3, failed[0].Fields["attempts"])
+	alerts := h.Emitted("alert")
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, "⚠️ Kitchen did not confirm 'on' after 3 attempts", alerts[0].StringField("message"))
+}
+
+func TestSuperseded(t *testing.T) {
+	h := setup(t)
+	defer h.Close()
+
+	h.Inject(pubsub.NewCommand("light.kitchen", "on"))
+	h.Advance(3 * time.Second)
+	h.Inject(pubsub.NewCommand("light.kitchen", "off"))
+	h.Inject(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "off"}))
+	h.Advance(time.Minute)
+	assert.Len(t, h.Emitted("command"), 2)
+	assert.Len(t, h.Emitted("command_failed"), 0)
+}
+
+func TestUntracked(t *testing.T) {
+	h := setup(t)
+	defer h.Close()
+
+	// one-way, no policy for the protocol, or no source
+	h.Inject(pubsub.NewCommand("light.porch", "on"))
+	h.Inject(pubsub.NewCommand("light.hall", "on"))
+	h.Inject(pubsub.NewCommand("light.virtual", "on"))
+	h.Advance(time.Hour)
+	assert.Len(t, h.Emitted("command"), 3)
+	assert.Len(t, h.Emitted("command_failed"), 0)
+}
+
+func TestStatus(t *testing.T) {
+	h := sim.New(start)
+	h.Config(trackerYaml)
+	service := &Service{}
+	assert.NoError(t, h.Start(service))
+	defer h.Close()
+
+	done := make(chan bool)
+	go func() {
+		// queried while commands are tracked
+		for i := 0; i < 100; i++ {
+			service.QueryHandlers()["status"](services.Question{Verb: "status"})
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		h.Inject(pubsub.NewCommand("light.kitchen", "on"))
+	}
+	<-done
+	answer := service.QueryHandlers()["status"](services.Question{Verb: "status"})
+	assert.Contains(t, answer.Text, "1 pending\nlight.kitchen        on     attempt 1, ")
+}
@@ -165,7 +165,7 @@ func (self *Service) touch(device string, timestamp time.Time) {
 	}
 
 	// discard if timestamp is over a year, or event not latest by timestamp
-	now := time.Now()
+	now := util.Now()
 	age := now.Sub(timestamp)
 	if age.Hours() > 24*365 || timestamp.Before(w.LastEvent) {
 		return
@@ -211,7 +211,7 @@ func sendWatchdogEvent(device, status string) {
 
 func (self *Service) scheduleNextTimeout() {
 	next := time.Time{}
-	now := time.Now()
+	now := util.Now()
 	self.nextProblem = nil
 	for _, w := range watches {
 		if w.NextAlert.IsZero() {
@@ -263,7 +263,7 @@ type Service struct {
 	sniffer     *ArpSniffer
 	problems    *Alerter
 	recoveries  *Alerter
-	timeout     *time.Timer
+	timeout     *util.Timer
 	nextProblem *Watch
 	pings       chan string
 }
@@ -291,7 +291,7 @@ func (self *Service) setup() {
 }
 
 func (self *Service) setupDevices() {
-	now := time.Now()
+	now := util.Now()
 	for _, d := range self.config.Value.Devices {
 		if d.Watchdog.IsZero() {
 			continue
@@ -314,7 +314,7 @@ func (self *Service) setupDevices() {
 }
 
 func (self *Service) setupHeartbeats() {
-	nextAlert := time.Now().Add(time.Second * 241)
+	nextAlert := util.Now().Add(time.Second * 241)
 	// monitor gohome processes heartbeats
 	for _, process := range self.config.Value.Watchdog.Processes {
 		id := fmt.Sprintf("heartbeat.%s", process)
@@ -470,7 +470,7 @@ func (self *Service) queryStatus(q services.Question) string {
 	// return oldest last
 	sort.Sort(sort.Reverse(list))
 
-	now := time.Now()
+	now := util.Now()
 	for _, w := range list {
 		symbol := "✔️"
 		if w.Problem {
@@ -504,20 +504,20 @@ func (self *Service) Init() error {
 	self.config = services.WaitForConfig()
 	self.problems = NewAlerter("PROBLEM")
 	self.recoveries = NewAlerter("RECOVERED")
-	self.timeout = time.NewTimer(time.Hour)
+	self.timeout = util.NewTimer(time.Hour)
 	self.setup()
 	return nil
 }
 
 type Alerter struct {
-	Timer   *time.Timer
+	Timer   *util.Timer
 	watches map[*Watch]bool
 	delayed bool
 	suffix  string
 }
 
 func NewAlerter(suffix string) *Alerter {
-	timer := time.NewTimer(time.Hour)
+	timer := util.NewTimer(time.Hour)
 	timer.Stop()
 	return &Alerter{watches: map[*Watch]bool{}, suffix: suffix, Timer: timer}
 }
@@ -540,7 +540,7 @@ func (self *Alerter) sendAlert() {
 	}
 	message := fmt.Sprintf("%s %s", listOfLots(names, 10), self.suffix)
 	if self.suffix == "PROBLEM" && len(names) == 1 && !lastWatch.LastEvent.IsZero() {
-		duration := time.Now().Sub(lastWatch.LastEvent)
+		duration := util.Now().Sub(lastWatch.LastEvent)
 		message += " for " + util.FriendlyDuration(duration)
 	}
 	sendAlert(message)
@@ -568,8 +568,32 @@ func (self *Alerter) TimerCallback() {
 	}
 }
 
+func (self *Service) Topics() []pubsub.Topic {
+	return []pubsub.Topic{pubsub.All()}
+}
+
+func (self *Service) HandleEvent(ev *pubsub.Event) {
+	self.checkEvent(ev)
+}
+
+// Tick handles any timeouts or alerts due, without blocking.
+func (self *Service) Tick() {
+	for {
+		select {
+		case <-self.timeout.C:
+			self.checkTimeouts()
+		case <-self.problems.Timer.C:
+			self.problems.TimerCallback()
+		case <-self.recoveries.Timer.C:
+			self.recoveries.TimerCallback()
+		default:
+			return
+		}
+	}
+}
+
 func (self *Service) Run() error {
-	events := services.Subscriber.Subscribe(pubsub.All())
+	events := services.Subscriber.Subscribe(self.Topics()...)
 	for {
 		select {
 		case ev := <-events:
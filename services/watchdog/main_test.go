@@ -5,11 +5,13 @@ import (
 
 	"github.com/barnybug/gohome/config"
 	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/services/sim"
 	"github.com/stretchr/testify/assert"
 )
 
 func ExampleInterfaces() {
 	var _ services.Service = (*Service)(nil)
+	var _ sim.Service = (*Service)(nil)
 	// Output:
 }
 
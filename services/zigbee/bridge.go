@@ -0,0 +1,267 @@
+package zigbee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/mqtt"
+	"github.com/barnybug/gohome/services"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	bridgeRequest  = "zigbee2mqtt/bridge/request/"
+	bridgeResponse = "zigbee2mqtt/bridge/response/"
+	// DefaultJoin is how long devices are permitted to join (seconds).
+	DefaultJoin = 120
+	// maximum zigbee allows
+	maxJoin = 254
+	// how long to wait for the bridge to respond
+	bridgeTimeout     = 10 * time.Second
+	networkmapTimeout = time.Minute
+)
+
+// BridgeResponse is zigbee2mqtt's response to a bridge request.
+type BridgeResponse struct {
+	Data        map[string]interface{} `json:"data"`
+	Status      string                 `json:"status"`
+	Error       string                 `json:"error"`
+	Transaction string                 `json:"transaction"`
+}
+
+// bridge tracks requests to zigbee2mqtt awaiting a response.
+type bridge struct {
+	lock        sync.Mutex
+	transaction int
+	pending     map[string]chan BridgeResponse
+	publish     func(topic string, payload []byte)
+}
+
+func publishRequest(topic string, payload []byte) {
+	token := mqtt.Client.Publish(topic, 1, false, payload)
+	if token.Wait() && token.Error() != nil {
+		log.Println("Failed to publish message:", token.Error())
+	}
+}
+
+// request an operation of the bridge, and wait for its response.
+func (self *Service) request(operation string, body map[string]interface{}, timeout time.Duration) (BridgeResponse, error) {
+	self.bridge.lock.Lock()
+	if self.bridge.pending == nil {
+		self.bridge.pending = map[string]chan BridgeResponse{}
+	}
+	if self.bridge.publish == nil {
+		self.bridge.publish = publishRequest
+	}
+	publish := self.bridge.publish
+	self.bridge.transaction++
+	transaction := fmt.Sprintf("gohome-%d", self.bridge.transaction)
+	ch := make(chan BridgeResponse, 1)
+	self.bridge.pending[transaction] = ch
+	self.bridge.lock.Unlock()
+	defer func() {
+		self.bridge.lock.Lock()
+		delete(self.bridge.pending, transaction)
+		self.bridge.lock.Unlock()
+	}()
+
+	body["transaction"] = transaction
+	payload, _ := json.Marshal(body)
+	log.Printf("Bridge request %s: %s", operation, payload)
+	publish(bridgeRequest+operation, payload)
+
+	select {
+	case resp := <-ch:
+		if resp.Status != "ok" && resp.Error != "" {
+			return resp, errors.New(resp.Error)
+		} else if resp.Status != "ok" {
+			return resp, fmt.Errorf("zigbee2mqtt failed %s", operation)
+		}
+		return resp, nil
+	case <-time.After(timeout):
+		return BridgeResponse{}, fmt.Errorf("no response from zigbee2mqtt to %s", operation)
+	}
+}
+
+// response from the bridge, emitted as a bridge event and returned to any
+// request waiting for it.
+func (self *Service) response(topic string, payload []byte) {
+	var resp BridgeResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		log.Printf("Failed to parse message %s: '%s'", topic, payload)
+		return
+	}
+	operation := strings.TrimPrefix(topic, bridgeResponse)
+	fields := pubsub.Fields{
+		"source":    "zigbee.bridge",
+		"operation": operation,
+		"status":    resp.Status,
+	}
+	if resp.Error != "" {
+		fields["error"] = resp.Error
+	}
+	if resp.Data != nil && operation != "networkmap" {
+		// the network map is too large for an event
+		fields["data"] = resp.Data
+	}
+	services.Publisher.Emit(pubsub.NewEvent("bridge", fields))
+
+	self.bridge.lock.Lock()
+	ch, ok := self.bridge.pending[resp.Transaction]
+	self.bridge.lock.Unlock()
+	if ok {
+		ch <- resp
+	}
+}
+
+// zigbeeName of a gohome device, or the zigbee2mqtt friendly name as is.
+func zigbeeName(name string) string {
+	if id, ok := services.Config.LookupDeviceProtocol(name, "zigbee"); ok {
+		zid, _ := splitEndpoint(id)
+		return zid
+	}
+	return name
+}
+
+// configuredDevices with a source of the zigbee2mqtt device, any endpoint.
+func configuredDevices(name string) []string {
+	var ret []string
+	for _, dev := range services.Config.DevicesByProtocol("zigbee") {
+		if zid, _ := splitEndpoint(dev.SourceId()); zid == name {
+			ret = append(ret, dev.Id)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// answer with the bridge's response data, or its error.
+func answer(text string, resp BridgeResponse, err error) services.Answer {
+	if err != nil {
+		return services.Answer{Text: "Error: " + err.Error()}
+	}
+	return services.Answer{Text: text, Json: resp.Data}
+}
+
+func (self *Service) queryJoin(q services.Question) services.Answer {
+	seconds := DefaultJoin
+	if q.Args != "" {
+		var err error
+		seconds, err = strconv.Atoi(strings.TrimSpace(q.Args))
+		if err != nil || seconds < 0 || seconds > maxJoin {
+			return services.Answer{Text: fmt.Sprintf("Expected seconds, up to %d", maxJoin)}
+		}
+	}
+	body := map[string]interface{}{"value": seconds > 0}
+	if seconds > 0 {
+		body["time"] = seconds
+	}
+	resp, err := self.request("permit_join", body, bridgeTimeout)
+	text := fmt.Sprintf("Permitting devices to join for %ds", seconds)
+	if seconds == 0 {
+		text = "Stopped permitting devices to join"
+	}
+	return answer(text, resp, err)
+}
+
+func (self *Service) queryRename(q services.Question) services.Answer {
+	args := strings.Fields(q.Args)
+	if len(args) != 2 {
+		return services.Answer{Text: "Usage: rename device name"}
+	}
+	from := zigbeeName(args[0])
+	if devices := configuredDevices(from); len(devices) > 0 {
+		// the config would no longer match the device's events
+		return services.Answer{Text: fmt.Sprintf("Refusing to rename %s, the source of %s: change the config to zigbee.%s first, then rename %s",
+			from, strings.Join(devices, ", "), args[1], from)}
+	}
+	body := map[string]interface{}{"from": from, "to": args[1]}
+	resp, err := self.request("device/rename", body, bridgeTimeout)
+	text := fmt.Sprintf("Renamed %s to %s, now source zigbee.%s", from, args[1], args[1])
+	return answer(text, resp, err)
+}
+
+func (self *Service) queryRemove(q services.Question) services.Answer {
+	args := strings.Fields(q.Args)
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "force") {
+		return services.Answer{Text: "Usage: remove device [force]"}
+	}
+	id := zigbeeName(args[0])
+	body := map[string]interface{}{"id": id, "force": len(args) == 2}
+	resp, err := self.request("device/remove", body, bridgeTimeout)
+	return answer(fmt.Sprintf("Removed %s", id), resp, err)
+}
+
+func (self *Service) queryUpdate(q services.Question) services.Answer {
+	args := strings.Fields(q.Args)
+	if len(args) != 1 {
+		return services.Answer{Text: "Usage: update device"}
+	}
+	id := zigbeeName(args[0])
+	body := map[string]interface{}{"id": id}
+	resp, err := self.request("device/ota_update/check", body, networkmapTimeout)
+	text := fmt.Sprintf("No update available for %s", id)
+	if resp.Data["update_available"] == true {
+		text = fmt.Sprintf("Update available for %s", id)
+	}
+	return answer(text, resp, err)
+}
+
+func (self *Service) queryNetworkmap(q services.Question) services.Answer {
+	body := map[string]interface{}{"type": "raw", "routes": false}
+	resp, err := self.request("networkmap", body, networkmapTimeout)
+	if err != nil {
+		return answer("", resp, err)
+	}
+	value, _ := resp.Data["value"].(map[string]interface{})
+	nodes, _ := value["nodes"].([]interface{})
+	links, _ := value["links"].([]interface{})
+	var lines []string
+	for _, n := range nodes {
+		node, _ := n.(map[string]interface{})
+		lines = append(lines, fmt.Sprintf("%v (%v)", node["friendlyName"], node["type"]))
+	}
+	text := fmt.Sprintf("%d devices, %d links:\n%s", len(nodes), len(links), strings.Join(lines, "\n"))
+	return services.Answer{Text: text, Json: value}
+}
+
+// BridgeEvent is a zigbee2mqtt bridge event, eg. a device joining.
+type BridgeEvent struct {
+	Type string `json:"type"`
+	Data struct {
+		FriendlyName string `json:"friendly_name"`
+		Status       string `json:"status"`
+		Supported    bool   `json:"supported"`
+		Definition   struct {
+			Description string `json:"description"`
+			Model       string `json:"model"`
+			Vendor      string `json:"vendor"`
+		} `json:"definition"`
+	} `json:"data"`
+}
+
+func checkBridgeEvent(message MQTT.Message) {
+	var msg BridgeEvent
+	err := json.Unmarshal(message.Payload(), &msg)
+	if err != nil {
+		log.Printf("Failed to parse message %s: '%s'", message.Topic(), message.Payload())
+		return
+	}
+	switch {
+	case msg.Type == "device_joined":
+		log.Printf("Device joined: %s", msg.Data.FriendlyName)
+	case msg.Type == "device_interview" && msg.Data.Status == "successful":
+		def := msg.Data.Definition
+		announce(msg.Data.FriendlyName, msg.Data.Supported, def.Vendor, def.Model, def.Description)
+	case msg.Type == "device_interview" && msg.Data.Status == "failed":
+		log.Printf("Device interview failed: %s", msg.Data.FriendlyName)
+	}
+}
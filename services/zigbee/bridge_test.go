@@ -0,0 +1,159 @@
+package zigbee
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleInterfaces() {
+	var _ services.Service = (*Service)(nil)
+	var _ services.Queryable = (*Service)(nil)
+	// Output:
+}
+
+const bridgeYaml = `
+devices:
+  sensor.door:
+    source: zigbee.0x00158d0001a2b3c4
+`
+
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m message) Duplicate() bool   { return false }
+func (m message) Qos() byte         { return 1 }
+func (m message) Retained() bool    { return false }
+func (m message) Topic() string     { return m.topic }
+func (m message) MessageID() uint16 { return 0 }
+func (m message) Payload() []byte   { return m.payload }
+func (m message) Ack()              {}
+
+// setup a service with a bridge answering requests with response.
+func setup(t *testing.T, response func(request map[string]interface{}) map[string]interface{}) (*Service, *dummy.Publisher, *[]message) {
+	conf, err := config.OpenRaw([]byte(bridgeYaml))
+	assert.NoError(t, err)
+	previous, previousPublisher := services.Config, services.Publisher
+	t.Cleanup(func() { services.Config, services.Publisher = previous, previousPublisher })
+	services.Config = conf
+	publisher := &dummy.Publisher{}
+	services.Publisher = publisher
+
+	service := &Service{}
+	var requests []message
+	service.bridge.publish = func(topic string, payload []byte) {
+		requests = append(requests, message{topic, payload})
+		var request map[string]interface{}
+		json.Unmarshal(payload, &request)
+		resp := response(request)
+		resp["transaction"] = request["transaction"]
+		data, _ := json.Marshal(resp)
+		operation := topic[len(bridgeRequest):]
+		go service.response(bridgeResponse+operation, data)
+	}
+	return service, publisher, &requests
+}
+
+func ok(request map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{}
+	for k, v := range request {
+		if k != "transaction" {
+			data[k] = v
+		}
+	}
+	return map[string]interface{}{"status": "ok", "data": data}
+}
+
+func TestJoin(t *testing.T) {
+	service, publisher, requests := setup(t, ok)
+	handlers := service.QueryHandlers()
+
+	answer := handlers["join"](services.Question{Verb: "join", Args: "60"})
+	assert.Equal(t, "Permitting devices to join for 60s", answer.Text)
+	assert.Equal(t, "zigbee2mqtt/bridge/request/permit_join", (*requests)[0].topic)
+	assert.JSONEq(t, `{"value":true,"time":60,"transaction":"gohome-1"}`, string((*requests)[0].payload))
+
+	answer = handlers["join"](services.Question{Verb: "join", Args: "0"})
+	assert.Equal(t, "Stopped permitting devices to join", answer.Text)
+	assert.JSONEq(t, `{"value":false,"transaction":"gohome-2"}`, string((*requests)[1].payload))
+
+	answer = handlers["join"](services.Question{Verb: "join", Args: "1000"})
+	assert.Equal(t, "Expected seconds, up to 254", answer.Text)
+	assert.Len(t, *requests, 2)
+
+	// responses are events
+	assert.Len(t, publisher.Events, 2)
+	ev := publisher.Events[0]
+	assert.Equal(t, "bridge", ev.Topic)
+	assert.Equal(t, "permit_join", ev.StringField("operation"))
+	assert.Equal(t, "ok", ev.StringField("status"))
+}
+
+func TestDeviceOperations(t *testing.T) {
+	service, _, requests := setup(t, ok)
+	handlers := service.QueryHandlers()
+
+	// configured devices would be orphaned
+	answer := handlers["rename"](services.Question{Verb: "rename", Args: "sensor.door front_door"})
+	assert.Equal(t, "Refusing to rename 0x00158d0001a2b3c4, the source of sensor.door: change the config to zigbee.front_door first, then rename 0x00158d0001a2b3c4", answer.Text)
+	assert.Nil(t, answer.Json)
+	assert.Len(t, *requests, 0)
+
+	answer = handlers["rename"](services.Question{Verb: "rename", Args: "0x00158d0001d5e6f7 front_door"})
+	assert.Equal(t, "Renamed 0x00158d0001d5e6f7 to front_door, now source zigbee.front_door", answer.Text)
+	assert.JSONEq(t, `{"from":"0x00158d0001d5e6f7","to":"front_door","transaction":"gohome-1"}`, string((*requests)[0].payload))
+
+	answer = handlers["remove"](services.Question{Verb: "remove", Args: "front_door force"})
+	assert.Equal(t, "Removed front_door", answer.Text)
+	assert.Equal(t, "zigbee2mqtt/bridge/request/device/remove", (*requests)[1].topic)
+	assert.JSONEq(t, `{"id":"front_door","force":true,"transaction":"gohome-2"}`, string((*requests)[1].payload))
+
+	answer = handlers["remove"](services.Question{Verb: "remove", Args: ""})
+	assert.Equal(t, "Usage: remove device [force]", answer.Text)
+}
+
+func TestBridgeError(t *testing.T) {
+	service, publisher, _ := setup(t, func(request map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"status": "error", "error": "Device 'missing' does not exist"}
+	})
+	answer := service.QueryHandlers()["update"](services.Question{Verb: "update", Args: "missing"})
+	assert.Equal(t, "Error: Device 'missing' does not exist", answer.Text)
+	assert.Nil(t, answer.Json)
+	assert.Equal(t, "Device 'missing' does not exist", publisher.Events[0].StringField("error"))
+}
+
+func TestNetworkmap(t *testing.T) {
+	service, publisher, _ := setup(t, func(request map[string]interface{}) map[string]interface{} {
+		value := map[string]interface{}{
+			"nodes": []interface{}{
+				map[string]interface{}{"friendlyName": "Coordinator", "type": "Coordinator"},
+				map[string]interface{}{"friendlyName": "front_door", "type": "EndDevice"},
+			},
+			"links": []interface{}{map[string]interface{}{"linkquality": 120}},
+		}
+		return map[string]interface{}{"status": "ok", "data": map[string]interface{}{"type": "raw", "value": value}}
+	})
+	answer := service.QueryHandlers()["networkmap"](services.Question{Verb: "networkmap"})
+	assert.Equal(t, "2 devices, 1 links:\nCoordinator (Coordinator)\nfront_door (EndDevice)", answer.Text)
+	assert.NotNil(t, answer.Json)
+	assert.False(t, publisher.Events[0].IsSet("data"))
+}
+
+func TestBridgeEventAnnounce(t *testing.T) {
+	_, publisher, _ := setup(t, ok)
+	payload := `{"type":"device_interview","data":{"friendly_name":"0x00158d0001a2b3c4","status":"successful","supported":true,
+		"definition":{"vendor":"Xiaomi","model":"MCCGQ11LM","description":"Door sensor"}}}`
+	ev := translate(message{"zigbee2mqtt/bridge/event", []byte(payload)})
+	assert.Nil(t, ev)
+	assert.Len(t, publisher.Events, 1)
+	announce := publisher.Events[0]
+	assert.Equal(t, "announce", announce.Topic)
+	assert.Equal(t, "Xiaomi MCCGQ11LM Door sensor", announce.StringField("name"))
+	assert.Equal(t, "sensor.door", announce.Device())
+}
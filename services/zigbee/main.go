@@ -20,12 +20,16 @@ import (
 // Service zigbee
 type Service struct {
 	rollup map[string]map[string]interface{}
+	bridge bridge
 }
 
 func (self *Service) ID() string {
 	return "zigbee"
 }
 
+// MqttBridge marks the service as using mqtt.Client directly.
+func (self *Service) MqttBridge() {}
+
 type Field struct {
 	Topic string
 	Field string
@@ -177,13 +181,17 @@ func checkLogMessage(message MQTT.Message) {
 		return
 	}
 	// announce new devices
-	source := fmt.Sprintf("zigbee.%s", msg.Meta.FriendlyName)
-	supported := "unsupported"
-	if msg.Meta.Supported {
-		supported = ""
+	announce(msg.Meta.FriendlyName, msg.Meta.Supported, msg.Meta.Vendor, msg.Meta.Model, msg.Meta.Description)
+}
+
+// announce a device, so it can be added to the config.
+func announce(friendlyName string, supported bool, description ...string) {
+	source := fmt.Sprintf("zigbee.%s", friendlyName)
+	if !supported {
+		description = append(description, "unsupported")
 	}
 	name := ""
-	for _, s := range []string{msg.Meta.Vendor, msg.Meta.Model, msg.Meta.Description, supported} {
+	for _, s := range description {
 		if s == "" {
 			continue
 		}
@@ -213,27 +221,8 @@ func checkBridgeDevices(message MQTT.Message) {
 			continue
 		}
 		// announce device
-		source := fmt.Sprintf("zigbee.%s", device.FriendlyName)
-		supported := "unsupported"
-		if device.Supported {
-			supported = ""
-		}
-		name := ""
-		for _, s := range []string{device.Definition.Vendor, device.Definition.Model, device.Definition.Description, supported} {
-			if s == "" {
-				continue
-			}
-			if name != "" {
-				name += " "
-			}
-			name += s
-		}
-		log.Printf("Announcing %s: %s", source, name)
-		fields := pubsub.Fields{"source": source, "name": name}
-		ev := pubsub.NewEvent("announce", fields)
-		ev.SetRetained(true)
-		services.Config.AddDeviceToEvent(ev)
-		services.Publisher.Emit(ev)
+		def := device.Definition
+		announce(device.FriendlyName, device.Supported, def.Vendor, def.Model, def.Description)
 	}
 }
 
@@ -246,6 +235,10 @@ func translate(message MQTT.Message) *pubsub.Event {
 		checkBridgeDevices(message)
 		return nil
 	}
+	if message.Topic() == "zigbee2mqtt/bridge/event" {
+		checkBridgeEvent(message)
+		return nil
+	}
 	if strings.HasPrefix(message.Topic(), "zigbee2mqtt/bridge/") || strings.HasPrefix(message.Topic(), "zigbee2mqtt/901/") {
 		// ignore other bridge messages
 		return nil
@@ -341,7 +334,9 @@ func (self *Service) handleCommand(ev *pubsub.Event) {
 	}
 
 	device := services.Config.Devices[ev.Device()]
-	if device.Cap["switch"] {
+	if ev.Command() == "valve" {
+		self.valveCommand(ev, id)
+	} else if device.Cap["switch"] {
 		self.switchCommand(ev, id, device)
 	} else if device.Cap["thermostat"] {
 		self.thermostatCommand(ev, id)
@@ -395,6 +390,18 @@ func (self *Service) switchCommand(ev *pubsub.Event, id string, device config.De
 	self.publish(id, body)
 }
 
+func (self *Service) valveCommand(ev *pubsub.Event, id string) {
+	// radiator valve position (%), eg. from heating zone demand
+	if !ev.IsSet("level") {
+		log.Println("Error: valve command level field missing:", ev)
+		return
+	}
+	body := map[string]interface{}{
+		"position": ev.IntField("level"),
+	}
+	self.publish(id, body)
+}
+
 func (self *Service) thermostatCommand(ev *pubsub.Event, id string) {
 	// hive https://www.zigbee2mqtt.io/devices/SLR2b.html
 	zid, ep := splitEndpoint(id)
@@ -442,6 +449,10 @@ func (self *Service) thermostatCommand(ev *pubsub.Event, id string) {
 func (self *Service) Run() error {
 	self.rollup = map[string]map[string]interface{}{}
 	mqtt.Client.Subscribe("zigbee2mqtt/#", 1, func(client MQTT.Client, msg MQTT.Message) {
+		if strings.HasPrefix(msg.Topic(), bridgeResponse) {
+			self.response(msg.Topic(), msg.Payload())
+			return
+		}
 		ev := translate(msg)
 		if ev != nil {
 			services.Publisher.Emit(ev)
@@ -461,3 +472,19 @@ func (self *Service) Run() error {
 	}
 	return nil
 }
+
+func (self *Service) QueryHandlers() services.QueryHandlers {
+	return services.QueryHandlers{
+		"join":       self.queryJoin,
+		"rename":     self.queryRename,
+		"remove":     self.queryRemove,
+		"update":     self.queryUpdate,
+		"networkmap": self.queryNetworkmap,
+		"help": services.StaticHandler("" +
+			"join [seconds]: permit devices to join\n" +
+			"rename device name: rename a device in zigbee2mqtt\n" +
+			"remove device [force]: remove a device from the network\n" +
+			"update device: check for a firmware update\n" +
+			"networkmap: list devices in the network\n"),
+	}
+}
@@ -25,6 +25,9 @@ func (self *Service) ID() string {
 	return "zwave"
 }
 
+// MqttBridge marks the service as using mqtt.Client directly.
+func (self *Service) MqttBridge() {}
+
 type Field struct {
 	Topic string
 	Field string
@@ -0,0 +1,207 @@
+package util
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a source of time and timers. Services use DefaultClock (via Now,
+// NewTimer and AfterFunc) rather than the time package directly, so tests can
+// substitute a VirtualClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) *Timer
+	AfterFunc(d time.Duration, f func()) *Timer
+}
+
+// Timer is a single event timer, as time.Timer. C is nil for timers created by
+// AfterFunc.
+type Timer struct {
+	C     <-chan time.Time
+	stop  func() bool
+	reset func(d time.Duration) bool
+}
+
+// Stop prevents the Timer from firing. It returns false if the timer has
+// already expired or been stopped.
+func (t *Timer) Stop() bool {
+	return t.stop()
+}
+
+// Reset changes the timer to expire after duration d. It returns true if the
+// timer had been active.
+func (t *Timer) Reset(d time.Duration) bool {
+	return t.reset(d)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) *Timer {
+	t := time.NewTimer(d)
+	return &Timer{C: t.C, stop: t.Stop, reset: t.Reset}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) *Timer {
+	t := time.AfterFunc(d, f)
+	return &Timer{stop: t.Stop, reset: t.Reset}
+}
+
+// RealClock is the system clock.
+var RealClock Clock = realClock{}
+
+// DefaultClock is the clock used by Now, NewTimer and AfterFunc.
+var DefaultClock Clock = RealClock
+
+// Now returns the current time of DefaultClock.
+func Now() time.Time {
+	return DefaultClock.Now()
+}
+
+// NewTimer creates a Timer on DefaultClock.
+func NewTimer(d time.Duration) *Timer {
+	return DefaultClock.NewTimer(d)
+}
+
+// AfterFunc calls f after duration d on DefaultClock.
+func AfterFunc(d time.Duration, f func()) *Timer {
+	return DefaultClock.AfterFunc(d, f)
+}
+
+type virtualTimer struct {
+	when time.Time
+	seq  int
+	c    chan time.Time
+	fn   func()
+}
+
+// VirtualClock is a Clock that only moves when told to. Timers fire during
+// Advance/Step, in deadline order, on the calling goroutine: AfterFunc
+// functions are called synchronously and timer channels are sent to without
+// blocking (buffered 1, as time.Timer).
+type VirtualClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    int
+	timers []*virtualTimer
+}
+
+// NewVirtualClock creates a VirtualClock starting at now.
+func NewVirtualClock(now time.Time) *VirtualClock {
+	return &VirtualClock{now: now}
+}
+
+// Now returns the virtual time.
+func (self *VirtualClock) Now() time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.now
+}
+
+func (self *VirtualClock) NewTimer(d time.Duration) *Timer {
+	c := make(chan time.Time, 1)
+	return self.newTimer(d, &virtualTimer{c: c}, c)
+}
+
+func (self *VirtualClock) AfterFunc(d time.Duration, f func()) *Timer {
+	return self.newTimer(d, &virtualTimer{fn: f}, nil)
+}
+
+func (self *VirtualClock) newTimer(d time.Duration, vt *virtualTimer, c chan time.Time) *Timer {
+	self.lock.Lock()
+	self.add(vt, d)
+	self.lock.Unlock()
+	return &Timer{
+		C: c,
+		stop: func() bool {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			return self.remove(vt)
+		},
+		reset: func(d time.Duration) bool {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			active := self.remove(vt)
+			self.add(vt, d)
+			return active
+		},
+	}
+}
+
+func (self *VirtualClock) add(vt *virtualTimer, d time.Duration) {
+	vt.when = self.now.Add(d)
+	vt.seq = self.seq
+	self.seq++
+	self.timers = append(self.timers, vt)
+	sort.SliceStable(self.timers, func(i, j int) bool {
+		a, b := self.timers[i], self.timers[j]
+		if a.when.Equal(b.when) {
+			return a.seq < b.seq
+		}
+		return a.when.Before(b.when)
+	})
+}
+
+func (self *VirtualClock) remove(vt *virtualTimer) bool {
+	for i, t := range self.timers {
+		if t == vt {
+			self.timers = append(self.timers[:i], self.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Pending returns the number of active timers.
+func (self *VirtualClock) Pending() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.timers)
+}
+
+// Step fires the next timer due at or before until, moving the clock to its
+// deadline, and returns true. If none is due, the clock is moved to until
+// (if later) and Step returns false.
+func (self *VirtualClock) Step(until time.Time) bool {
+	self.lock.Lock()
+	if len(self.timers) == 0 || self.timers[0].when.After(until) {
+		if until.After(self.now) {
+			self.now = until
+		}
+		self.lock.Unlock()
+		return false
+	}
+	vt := self.timers[0]
+	self.timers = self.timers[1:]
+	if vt.when.After(self.now) {
+		self.now = vt.when
+	}
+	now := self.now
+	self.lock.Unlock()
+
+	// fire outside the lock, as f may create timers
+	if vt.fn != nil {
+		vt.fn()
+	} else {
+		select {
+		case vt.c <- now:
+		default:
+		}
+	}
+	return true
+}
+
+// Advance moves the clock forward by d, firing any timers falling due.
+func (self *VirtualClock) Advance(d time.Duration) {
+	self.Set(self.Now().Add(d))
+}
+
+// Set moves the clock forward to t, firing any timers falling due.
+func (self *VirtualClock) Set(t time.Time) {
+	for self.Step(t) {
+	}
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func ExampleVirtualClock() {
+	clock := NewVirtualClock(epoch)
+	clock.AfterFunc(time.Hour, func() { fmt.Println("hour", clock.Now().Format("15:04")) })
+	clock.AfterFunc(time.Minute, func() { fmt.Println("minute", clock.Now().Format("15:04")) })
+	clock.Advance(2 * time.Hour)
+	fmt.Println(clock.Now().Format("15:04"))
+	// Output:
+	// minute 00:01
+	// hour 01:00
+	// 02:00
+}
+
+func TestVirtualTimer(t *testing.T) {
+	clock := NewVirtualClock(epoch)
+	timer := clock.NewTimer(time.Minute)
+	clock.Advance(59 * time.Second)
+	assert.Len(t, timer.C, 0)
+	clock.Advance(time.Second)
+	assert.Equal(t, epoch.Add(time.Minute), <-timer.C)
+
+	assert.False(t, timer.Reset(time.Minute))
+	assert.True(t, timer.Stop())
+	assert.False(t, timer.Stop())
+	clock.Advance(time.Hour)
+	assert.Len(t, timer.C, 0)
+	assert.Equal(t, 0, clock.Pending())
+}
+
+func TestVirtualAfterFuncChain(t *testing.T) {
+	// timers created while firing are fired within the same Advance
+	clock := NewVirtualClock(epoch)
+	count := 0
+	var tick func()
+	tick = func() {
+		count++
+		clock.AfterFunc(time.Minute, tick)
+	}
+	clock.AfterFunc(time.Minute, tick)
+	clock.Advance(time.Hour)
+	assert.Equal(t, 60, count)
+}
+
+func TestSchedulerVirtual(t *testing.T) {
+	clock := NewVirtualClock(epoch.Add(30 * time.Second))
+	s := NewSchedulerClock(clock, 2*time.Second, time.Minute)
+	clock.Advance(time.Minute)
+	assert.Equal(t, epoch.Add(62*time.Second), <-s.C)
+	// later ticks are dropped if not read
+	clock.Advance(10 * time.Minute)
+	assert.Equal(t, epoch.Add(122*time.Second), <-s.C)
+	assert.Len(t, s.C, 0)
+}
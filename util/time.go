@@ -26,8 +26,13 @@ func NextSchedule(now time.Time, offset time.Duration, d time.Duration) time.Tim
 // A schedulable Ticker
 // NewScheduler returns a new Scheduler containing a channel that will send
 // the time with a period specified by the duration argument, at the specified
-// offset into the day.
+// offset into the day. Ticks are timed by DefaultClock.
 func NewScheduler(offset time.Duration, d time.Duration) *Scheduler {
+	return NewSchedulerClock(DefaultClock, offset, d)
+}
+
+// NewSchedulerClock is NewScheduler, timed by the given clock.
+func NewSchedulerClock(clock Clock, offset time.Duration, d time.Duration) *Scheduler {
 	if d <= 0 {
 		panic(errors.New("non-positive interval for NewScheduler"))
 	}
@@ -40,16 +45,19 @@ func NewScheduler(offset time.Duration, d time.Duration) *Scheduler {
 		C: c,
 	}
 
-	go func() {
-		for {
-			now := time.Now()
-			next := NextSchedule(now, offset, d)
-			dnext := next.Sub(now)
-			time.Sleep(dnext)
-			c <- time.Now()
-		}
-
-	}()
+	var schedule func()
+	schedule = func() {
+		now := clock.Now()
+		next := NextSchedule(now, offset, d)
+		clock.AfterFunc(next.Sub(now), func() {
+			select {
+			case c <- clock.Now():
+			default:
+			}
+			schedule()
+		})
+	}
+	schedule()
 
 	return t
 }